@@ -17,10 +17,6 @@ import (
 	// Import drivers - these register themselves on init
 	_ "github.com/pion/mediadevices/pkg/driver/camera"     // Camera driver
 	_ "github.com/pion/mediadevices/pkg/driver/microphone" // Microphone driver
-
-	// Import codecs - required for media processing
-	_ "github.com/pion/mediadevices/pkg/codec/opus" // Opus audio codec
-	_ "github.com/pion/mediadevices/pkg/codec/vpx"  // VP8/VP9 codec
 )
 
 type ScreenSize struct {
@@ -60,7 +56,15 @@ type VideoStream struct {
 	fps            float64
 	resolution     string
 	audioLevel     float64
+	media          MediaConfig
+	blackFrame     image.Image
 	mu             sync.RWMutex
+
+	// rtcVideo and rtcAudio are the tracks CreateWebRTCTracks made. Their
+	// encoders run until the stream stops.
+	rtcVideo *webrtc.TrackLocalStaticSample
+	rtcAudio *webrtc.TrackLocalStaticSample
+	rtcMu    sync.Mutex
 }
 
 func GetCameraDevices() []mediadevices.MediaDeviceInfo {
@@ -83,7 +87,7 @@ func GetCameraDevices() []mediadevices.MediaDeviceInfo {
 	return cameraDevices
 }
 
-func getMediaStream(resolution, cameraDeviceID string) (mediadevices.MediaStream, error) {
+func getMediaStream(resolution, cameraDeviceID string, codecSelector *mediadevices.CodecSelector) (mediadevices.MediaStream, error) {
 	size, ok := Resolution[resolution]
 	if !ok {
 		size = Resolution["HD"]
@@ -101,6 +105,7 @@ func getMediaStream(resolution, cameraDeviceID string) (mediadevices.MediaStream
 		},
 		Audio: func(c *mediadevices.MediaTrackConstraints) {
 		},
+		Codec: codecSelector,
 	}
 
 	stream, err := mediadevices.GetUserMedia(constraints)
@@ -119,6 +124,7 @@ func getMediaStream(resolution, cameraDeviceID string) (mediadevices.MediaStream
 				c.DeviceID = prop.String(cameraDeviceID)
 			}
 		},
+		Codec: codecSelector,
 	}
 
 	stream, err = mediadevices.GetUserMedia(constraints)
@@ -135,6 +141,7 @@ func getMediaStream(resolution, cameraDeviceID string) (mediadevices.MediaStream
 		constraints = mediadevices.MediaStreamConstraints{
 			Video: func(c *mediadevices.MediaTrackConstraints) {
 			},
+			Codec: codecSelector,
 		}
 		stream, err = mediadevices.GetUserMedia(constraints)
 		if err == nil {
@@ -146,7 +153,7 @@ func getMediaStream(resolution, cameraDeviceID string) (mediadevices.MediaStream
 	return nil, fmt.Errorf("all attempts to get media stream failed: %w", err)
 }
 
-func StartVideoStream(resolution, cameraDeviceID string, updateFunc func(image.Image)) (*VideoStream, error) {
+func StartVideoStream(resolution, cameraDeviceID string, mediaConfig MediaConfig, updateFunc func(image.Image)) (*VideoStream, error) {
 	size, ok := Resolution[resolution]
 	if !ok {
 		log.Printf("Unknown resolution %s, defaulting to HD", resolution)
@@ -154,7 +161,12 @@ func StartVideoStream(resolution, cameraDeviceID string, updateFunc func(image.I
 		resolution = "HD"
 	}
 
-	stream, err := getMediaStream(resolution, cameraDeviceID)
+	codecSelector, err := newCodecSelector(mediaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := getMediaStream(resolution, cameraDeviceID, codecSelector)
 	if err != nil {
 		log.Printf("Failed to get user media: %v", err)
 		return nil, err
@@ -176,8 +188,6 @@ func StartVideoStream(resolution, cameraDeviceID string, updateFunc func(image.I
 		log.Println("No audio track available")
 	}
 
-	reader := videoTrack.NewReader(false)
-
 	vs := &VideoStream{
 		track:          videoTrack,
 		audioTrack:     audioTrack,
@@ -192,8 +202,16 @@ func StartVideoStream(resolution, cameraDeviceID string, updateFunc func(image.I
 		fps:            0,
 		audioLevel:     -100.0,
 		resolution:     resolution,
+		media:          mediaConfig,
+	}
+
+	videoTrack.Transform(vs.pauseVideoTransform)
+	if audioTrack != nil {
+		audioTrack.Transform(vs.pauseAudioTransform)
 	}
 
+	reader := videoTrack.NewReader(false)
+
 	go vs.streamLoop(reader, updateFunc)
 	if audioTrack != nil {
 		go vs.audioLoop()
@@ -422,9 +440,38 @@ func (vs *VideoStream) GetAudioTrack() *mediadevices.AudioTrack {
 	return vs.audioTrack
 }
 
+// CreateWebRTCTracks returns the stream's WebRTC tracks, starting their
+// encoders on the first call. Later calls return the same tracks rather
+// than starting more encoders.
 func (vs *VideoStream) CreateWebRTCTracks() (*webrtc.TrackLocalStaticSample, *webrtc.TrackLocalStaticSample, error) {
+	vs.rtcMu.Lock()
+	defer vs.rtcMu.Unlock()
+
+	if vs.rtcVideo != nil {
+		return vs.rtcVideo, vs.rtcAudio, nil
+	}
+	videoTrack, audioTrack, err := vs.createWebRTCTracks()
+	if err != nil {
+		return nil, nil, err
+	}
+	vs.rtcVideo, vs.rtcAudio = videoTrack, audioTrack
+	return videoTrack, audioTrack, nil
+}
+
+func (vs *VideoStream) createWebRTCTracks() (*webrtc.TrackLocalStaticSample, *webrtc.TrackLocalStaticSample, error) {
+	vs.mu.RLock()
+	mediaConfig := vs.media
+	videoSource := vs.track
+	audioSource := vs.audioTrack
+	vs.mu.RUnlock()
+
+	videoMime, err := mediaConfig.videoMimeType()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		webrtc.RTPCodecCapability{MimeType: videoMime},
 		"video",
 		"zero-video",
 	)
@@ -432,8 +479,32 @@ func (vs *VideoStream) CreateWebRTCTracks() (*webrtc.TrackLocalStaticSample, *we
 		return nil, nil, fmt.Errorf("failed to create video track: %w", err)
 	}
 
+	// cleanup stops the video encoder if audio then fails. It is cleared
+	// once the tracks are returned.
+	cleanup := func() {}
+	defer func() { cleanup() }()
+
+	if videoSource != nil {
+		stopVideo, err := vs.startVideoPipeline(videoTrack)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = stopVideo
+	}
+
+	if audioSource == nil {
+		cleanup = func() {}
+		log.Println("Created WebRTC video track (no audio source)")
+		return videoTrack, nil, nil
+	}
+
+	audioMime, err := mediaConfig.audioMimeType()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	audioTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		webrtc.RTPCodecCapability{MimeType: audioMime},
 		"audio",
 		"zero-audio",
 	)
@@ -441,6 +512,11 @@ func (vs *VideoStream) CreateWebRTCTracks() (*webrtc.TrackLocalStaticSample, *we
 		return nil, nil, fmt.Errorf("failed to create audio track: %w", err)
 	}
 
-	log.Println("Created WebRTC tracks (tracks will be populated by mediadevices integration)")
+	if _, err := vs.startAudioPipeline(audioTrack); err != nil {
+		return nil, nil, err
+	}
+
+	cleanup = func() {}
+	log.Printf("Created WebRTC tracks (%s, %s)", videoMime, audioMime)
 	return videoTrack, audioTrack, nil
 }
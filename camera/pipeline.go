@@ -0,0 +1,222 @@
+package camera
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+type MediaConfig struct {
+	VideoCodec   string
+	VideoBitrate int
+	AudioCodec   string
+	AudioBitrate int
+}
+
+func DefaultMediaConfig() MediaConfig {
+	return MediaConfig{
+		VideoCodec:   "vp8",
+		VideoBitrate: 1500000,
+		AudioCodec:   "opus",
+		AudioBitrate: 48000,
+	}
+}
+
+// videoMimeType only allows VP8, since that is all StartRemoteVideo can
+// decode.
+func (mc MediaConfig) videoMimeType() (string, error) {
+	switch strings.ToLower(mc.VideoCodec) {
+	case "", "vp8":
+		return webrtc.MimeTypeVP8, nil
+	default:
+		return "", fmt.Errorf("unsupported video codec: %s", mc.VideoCodec)
+	}
+}
+
+func (mc MediaConfig) audioMimeType() (string, error) {
+	switch strings.ToLower(mc.AudioCodec) {
+	case "", "opus":
+		return webrtc.MimeTypeOpus, nil
+	default:
+		return "", fmt.Errorf("unsupported audio codec: %s", mc.AudioCodec)
+	}
+}
+
+func newCodecSelector(mc MediaConfig) (*mediadevices.CodecSelector, error) {
+	if _, err := mc.videoMimeType(); err != nil {
+		return nil, err
+	}
+	if _, err := mc.audioMimeType(); err != nil {
+		return nil, err
+	}
+
+	opusParams, err := opus.NewParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus params: %w", err)
+	}
+	opusParams.BitRate = mc.AudioBitrate
+
+	vp8Params, err := vpx.NewVP8Params()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vp8 params: %w", err)
+	}
+	vp8Params.BitRate = mc.VideoBitrate
+
+	return mediadevices.NewCodecSelector(
+		mediadevices.WithVideoEncoders(&vp8Params),
+		mediadevices.WithAudioEncoders(&opusParams),
+	), nil
+}
+
+// pauseVideoTransform swaps captured frames for black ones while video is
+// paused, so the encoder keeps producing a stream the remote side can render.
+func (vs *VideoStream) pauseVideoTransform(r video.Reader) video.Reader {
+	return video.ReaderFunc(func() (image.Image, func(), error) {
+		frame, release, err := r.Read()
+		if err != nil {
+			return frame, release, err
+		}
+
+		vs.mu.RLock()
+		paused := vs.videoPaused
+		vs.mu.RUnlock()
+
+		if !paused {
+			return frame, release, nil
+		}
+
+		release()
+		return vs.getBlackFrame(frame.Bounds()), func() {}, nil
+	})
+}
+
+func (vs *VideoStream) getBlackFrame(bounds image.Rectangle) image.Image {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if vs.blackFrame != nil && vs.blackFrame.Bounds() == bounds {
+		return vs.blackFrame
+	}
+
+	frame := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
+	for i := range frame.Y {
+		frame.Y[i] = 16
+	}
+	for i := range frame.Cb {
+		frame.Cb[i] = 128
+		frame.Cr[i] = 128
+	}
+
+	vs.blackFrame = frame
+	return frame
+}
+
+// pauseAudioTransform replaces captured chunks with silence of the same
+// shape while audio is paused.
+func (vs *VideoStream) pauseAudioTransform(r audio.Reader) audio.Reader {
+	return audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		chunk, release, err := r.Read()
+		if err != nil {
+			return chunk, release, err
+		}
+
+		vs.mu.RLock()
+		paused := vs.audioPaused
+		vs.mu.RUnlock()
+
+		if !paused {
+			return chunk, release, nil
+		}
+
+		release()
+		return silentChunk(chunk), func() {}, nil
+	})
+}
+
+func silentChunk(chunk wave.Audio) wave.Audio {
+	info := chunk.ChunkInfo()
+
+	switch chunk.(type) {
+	case *wave.Float32Interleaved:
+		return wave.NewFloat32Interleaved(info)
+	case *wave.Float32NonInterleaved:
+		return wave.NewFloat32NonInterleaved(info)
+	case *wave.Int16NonInterleaved:
+		return wave.NewInt16NonInterleaved(info)
+	default:
+		return wave.NewInt16Interleaved(info)
+	}
+}
+
+// startVideoPipeline encodes the camera into track until the stream stops
+// or the returned function is called.
+func (vs *VideoStream) startVideoPipeline(track *webrtc.TrackLocalStaticSample) (func(), error) {
+	reader, err := vs.track.NewEncodedReader(track.Codec().MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create video encoder: %w", err)
+	}
+
+	stop := sync.OnceFunc(func() { reader.Close() })
+	go vs.writeSamples("video", reader, stop, track, videoClockRate)
+	return stop, nil
+}
+
+func (vs *VideoStream) startAudioPipeline(track *webrtc.TrackLocalStaticSample) (func(), error) {
+	reader, err := vs.audioTrack.NewEncodedReader(track.Codec().MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audio encoder: %w", err)
+	}
+
+	stop := sync.OnceFunc(func() { reader.Close() })
+	go vs.writeSamples("audio", reader, stop, track, audioClockRate)
+	return stop, nil
+}
+
+// writeSamples copies encoded samples from reader to track. Calling stop
+// closes reader, which ends the copy at its next read.
+func (vs *VideoStream) writeSamples(kind string, reader mediadevices.EncodedReadCloser, stop func(), track *webrtc.TrackLocalStaticSample, clockRate uint32) {
+	defer stop()
+
+	for {
+		select {
+		case <-vs.stopChan:
+			log.Printf("Stopping %s pipeline", kind)
+			return
+		default:
+		}
+
+		buffer, release, err := reader.Read()
+		if err != nil {
+			log.Printf("Stopping %s pipeline: %v", kind, err)
+			return
+		}
+
+		sample := media.Sample{
+			Data:     buffer.Data,
+			Duration: time.Duration(buffer.Samples) * time.Second / time.Duration(clockRate),
+		}
+		err = track.WriteSample(sample)
+		release()
+
+		if err != nil {
+			log.Printf("Failed to write %s sample: %v", kind, err)
+		}
+	}
+}
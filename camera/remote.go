@@ -0,0 +1,140 @@
+package camera
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+const remoteVideoMaxLate = 128
+
+type RemoteVideo struct {
+	track      *webrtc.TrackRemote
+	reader     *remoteFrameReader
+	frameCount uint64
+	stopped    bool
+	mu         sync.RWMutex
+}
+
+// remoteFrameReader turns the RTP packets of a remote VP8 track into whole
+// frames. Each Read returns exactly one frame, which is what the vpx decoder
+// expects from its io.Reader.
+type remoteFrameReader struct {
+	track           *webrtc.TrackRemote
+	builder         *samplebuilder.SampleBuilder
+	waitingKeyFrame bool
+	err             error
+}
+
+func (r *remoteFrameReader) Read(p []byte) (int, error) {
+	for {
+		if sample := r.builder.Pop(); sample != nil {
+			if r.waitingKeyFrame {
+				if !isVP8KeyFrame(sample.Data) {
+					continue
+				}
+				r.waitingKeyFrame = false
+			}
+			if len(sample.Data) > len(p) {
+				log.Printf("Dropping oversized remote frame (%d bytes)", len(sample.Data))
+				r.waitingKeyFrame = true
+				continue
+			}
+			return copy(p, sample.Data), nil
+		}
+
+		packet, _, err := r.track.ReadRTP()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.builder.Push(packet)
+	}
+}
+
+func isVP8KeyFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
+
+func StartRemoteVideo(track *webrtc.TrackRemote, updateFunc func(image.Image)) (*RemoteVideo, error) {
+	mimeType := track.Codec().MimeType
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return nil, fmt.Errorf("unsupported remote video codec: %s", mimeType)
+	}
+
+	reader := &remoteFrameReader{
+		track:           track,
+		builder:         samplebuilder.New(remoteVideoMaxLate, &codecs.VP8Packet{}, track.Codec().ClockRate),
+		waitingKeyFrame: true,
+	}
+
+	decoder, err := vpx.NewDecoder(reader, prop.Media{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vp8 decoder: %w", err)
+	}
+
+	rv := &RemoteVideo{
+		track:  track,
+		reader: reader,
+	}
+
+	go func() {
+		defer decoder.Close()
+
+		for {
+			frame, release, err := decoder.Read()
+			if err != nil {
+				if reader.err != nil {
+					if !errors.Is(reader.err, io.EOF) {
+						log.Printf("Remote video track %s ended: %v", track.ID(), reader.err)
+					}
+					return
+				}
+				log.Printf("Failed to decode remote frame: %v", err)
+				reader.waitingKeyFrame = true
+				continue
+			}
+
+			rv.mu.Lock()
+			stopped := rv.stopped
+			rv.frameCount++
+			rv.mu.Unlock()
+
+			if !stopped {
+				updateFunc(frame)
+			}
+			release()
+
+			if stopped {
+				return
+			}
+		}
+	}()
+
+	log.Printf("Started remote video for track %s", track.ID())
+	return rv, nil
+}
+
+func (rv *RemoteVideo) GetFrameCount() uint64 {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+	return rv.frameCount
+}
+
+// Stop detaches the update callback. The decode loop itself exits once the
+// underlying track is closed by its peer connection.
+func (rv *RemoteVideo) Stop() {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.stopped = true
+}
@@ -1,30 +1,149 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/javanhut/zero/config"
+	"github.com/javanhut/zero/metrics"
 	"github.com/javanhut/zero/signaling"
 )
 
 func main() {
-	server := signaling.NewServer()
+	configPath := flag.String("config", config.DefaultPath, "path to config.yaml")
+	addr := flag.String("addr", "", "listen address (overrides signaling_server.listen_address)")
+	wsPath := flag.String("ws-path", "", "websocket path (overrides signaling_server.ws_path)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enables wss://")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	origins := flag.String("allowed-origins", "", "comma-separated websocket origins to allow, or *")
+	proxies := flag.String("trusted-proxies", "", "comma-separated proxy IPs or CIDR ranges trusted for X-Forwarded-For")
+	maxMessageSize := flag.Int64("max-message-size", 0, "largest client message in bytes")
+	sendBufferSize := flag.Int("send-buffer", 0, "outgoing messages queued per client")
+	maxRoomSize := flag.Int("max-room-size", 0, "most peers in one session, 0 for unlimited")
+	maxPeers := flag.Int("max-peers", 0, "most peers joined on this server, 0 for unlimited")
+	meshThreshold := flag.Int("mesh-threshold", 0, "largest session to run as a full mesh before suggesting an SFU")
+	meetingCodeTTL := flag.Duration("meeting-code-ttl", 0, "how long new sessions' meeting codes stay valid")
+	redisAddr := flag.String("redis", "", "Redis address for clustering (overrides signaling_server.redis_address)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "how long to wait for clients to disconnect on shutdown")
+	flag.Parse()
+
+	cfg, err := config.LoadOrDefault(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	serverCfg := cfg.SignalingServer
+
+	// Flags given on the command line win over the config file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			serverCfg.ListenAddress = *addr
+		case "ws-path":
+			serverCfg.WSPath = *wsPath
+		case "tls-cert":
+			serverCfg.TLSCert = *tlsCert
+		case "tls-key":
+			serverCfg.TLSKey = *tlsKey
+		case "allowed-origins":
+			serverCfg.AllowedOrigins = nil
+			for _, origin := range strings.Split(*origins, ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					serverCfg.AllowedOrigins = append(serverCfg.AllowedOrigins, origin)
+				}
+			}
+		case "trusted-proxies":
+			serverCfg.TrustedProxies = nil
+			for _, proxy := range strings.Split(*proxies, ",") {
+				if proxy = strings.TrimSpace(proxy); proxy != "" {
+					serverCfg.TrustedProxies = append(serverCfg.TrustedProxies, proxy)
+				}
+			}
+		case "max-message-size":
+			serverCfg.MaxMessageSize = *maxMessageSize
+		case "send-buffer":
+			serverCfg.SendBufferSize = *sendBufferSize
+		case "max-room-size":
+			serverCfg.MaxPeersPerSession = *maxRoomSize
+		case "max-peers":
+			serverCfg.MaxPeers = *maxPeers
+		case "mesh-threshold":
+			serverCfg.MeshThreshold = *meshThreshold
+		case "meeting-code-ttl":
+			serverCfg.MeetingCodeTTL = *meetingCodeTTL
+		case "redis":
+			serverCfg.RedisAddress = *redisAddr
+		}
+	})
+
+	registry := metrics.NewRegistry()
+
+	tokenSecret := os.Getenv("ZERO_TOKEN_SECRET")
+	var backplane signaling.Backplane
+	if serverCfg.RedisAddress != "" {
+		if tokenSecret == "" {
+			log.Fatalf("ZERO_TOKEN_SECRET must be set when clustering with Redis")
+		}
+		redis, err := signaling.NewRedisBackplane(signaling.RedisBackplaneConfig{
+			Addr:     serverCfg.RedisAddress,
+			Password: os.Getenv("ZERO_REDIS_PASSWORD"),
+			Channel:  serverCfg.RedisChannel,
+		})
+		if err != nil {
+			log.Fatalf("Failed to connect to backplane: %v", err)
+		}
+		defer redis.Close()
+		backplane = redis
+	}
+
+	server, err := signaling.NewServer(signaling.ServerConfig{
+		Addr:               serverCfg.ListenAddress,
+		WSPath:             serverCfg.WSPath,
+		TLSCertFile:        serverCfg.TLSCert,
+		TLSKeyFile:         serverCfg.TLSKey,
+		AllowedOrigins:     serverCfg.AllowedOrigins,
+		TrustedProxies:     serverCfg.TrustedProxies,
+		MaxMessageSize:     serverCfg.MaxMessageSize,
+		SendBufferSize:     serverCfg.SendBufferSize,
+		AdminToken:         os.Getenv("ZERO_ADMIN_TOKEN"),
+		Tokens:             signaling.TokenIssuerConfig{Secret: []byte(tokenSecret)},
+		Metrics:            signaling.NewPrometheusMetrics(registry),
+		Backplane:          backplane,
+		MaxPeersPerSession: serverCfg.MaxPeersPerSession,
+		MaxPeers:           serverCfg.MaxPeers,
+		MeshThreshold:      serverCfg.MeshThreshold,
+		MeetingCodeTTL:     serverCfg.MeetingCodeTTL,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	server.Handle("GET /metrics", registry.Handler())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	shutdownDone := make(chan struct{})
 	go func() {
 		<-sigChan
 		log.Println("Shutting down signaling server...")
-		os.Exit(0)
-	}()
 
-	addr := ":8080"
-	log.Printf("Starting Zero signaling server on %s", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown did not complete cleanly: %v", err)
+		}
+		close(shutdownDone)
+	}()
 
-	if err := server.Start(addr); err != nil {
+	if err := server.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	<-shutdownDone
 }
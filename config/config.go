@@ -0,0 +1,162 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultPath = "config.yaml"
+
+type SignalingConfig struct {
+	ServerAddress string `yaml:"server_address"`
+	WSPath        string `yaml:"ws_path"`
+	// TLS makes the client connect with wss:// instead of ws://.
+	TLS bool `yaml:"tls"`
+}
+
+// URL returns the websocket URL of the signaling server.
+func (c SignalingConfig) URL() string {
+	scheme := "ws"
+	if c.TLS {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.ServerAddress, c.WSPath)
+}
+
+// SignalingServerConfig configures cmd/signaling.
+type SignalingServerConfig struct {
+	ListenAddress  string   `yaml:"listen_address"`
+	WSPath         string   `yaml:"ws_path"`
+	TLSCert        string   `yaml:"tls_cert"`
+	TLSKey         string   `yaml:"tls_key"`
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	MaxMessageSize int64    `yaml:"max_message_size"`
+	SendBufferSize int      `yaml:"send_buffer_size"`
+	// Capacity limits; zero means unlimited. MeshThreshold is the largest
+	// session clients are told to run as a full mesh.
+	MaxPeersPerSession int `yaml:"max_peers_per_session"`
+	MaxPeers           int `yaml:"max_peers"`
+	MeshThreshold      int `yaml:"mesh_threshold"`
+	// MeetingCodeTTL is how long a session's meeting code stays valid.
+	MeetingCodeTTL time.Duration `yaml:"meeting_code_ttl"`
+	// RedisAddress enables clustering through Redis pub/sub when set.
+	RedisAddress string `yaml:"redis_address"`
+	RedisChannel string `yaml:"redis_channel"`
+}
+
+type ICEServerConfig struct {
+	URLs string `yaml:"urls"`
+}
+
+type WebRTCConfig struct {
+	ICEServers []ICEServerConfig `yaml:"ice_servers"`
+}
+
+type SFUConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+}
+
+type VideoConfig struct {
+	Codec      string `yaml:"codec"`
+	Resolution string `yaml:"resolution"`
+	Bitrate    int    `yaml:"bitrate"`
+}
+
+type AudioConfig struct {
+	Codec      string `yaml:"codec"`
+	SampleRate int    `yaml:"sample_rate"`
+	Bitrate    int    `yaml:"bitrate"`
+	Output     string `yaml:"output"`
+	OutputFile string `yaml:"output_file"`
+}
+
+type MediaConfig struct {
+	Video VideoConfig `yaml:"video"`
+	Audio AudioConfig `yaml:"audio"`
+}
+
+type Config struct {
+	Signaling       SignalingConfig       `yaml:"signaling"`
+	SignalingServer SignalingServerConfig `yaml:"signaling_server"`
+	WebRTC          WebRTCConfig          `yaml:"webrtc"`
+	SFU             SFUConfig             `yaml:"sfu"`
+	Media           MediaConfig           `yaml:"media"`
+}
+
+func Default() *Config {
+	return &Config{
+		Signaling: SignalingConfig{
+			ServerAddress: "localhost:8080",
+			WSPath:        "/ws",
+		},
+		SignalingServer: SignalingServerConfig{
+			ListenAddress:      ":8080",
+			WSPath:             "/ws",
+			MaxMessageSize:     64 * 1024,
+			SendBufferSize:     256,
+			MaxPeersPerSession: 16,
+			MeshThreshold:      4,
+			MeetingCodeTTL:     24 * time.Hour,
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: []ICEServerConfig{
+				{URLs: "stun:stun.l.google.com:19302"},
+				{URLs: "stun:stun1.l.google.com:19302"},
+			},
+		},
+		SFU: SFUConfig{
+			Enabled: false,
+			Address: "localhost:5551",
+		},
+		Media: MediaConfig{
+			Video: VideoConfig{
+				Codec:      "vp8",
+				Resolution: "HD",
+				Bitrate:    1500000,
+			},
+			Audio: AudioConfig{
+				Codec:      "opus",
+				SampleRate: 48000,
+				Bitrate:    48000,
+				Output:     "device",
+			},
+		},
+	}
+}
+
+// Load reads the YAML file at path on top of Default, so any key missing
+// from the file keeps its default value.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// LoadOrDefault is like Load but falls back to Default when the file is
+// missing, which is the common case when running from outside the repo.
+func LoadOrDefault(path string) (*Config, error) {
+	cfg, err := Load(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Default(), nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
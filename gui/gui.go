@@ -1,21 +1,31 @@
 package gui
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
 	"log"
+	"os"
+	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
-	"github.com/google/uuid"
 	"github.com/javanhut/zero/camera"
+	"github.com/javanhut/zero/config"
+	"github.com/javanhut/zero/playback"
+	"github.com/javanhut/zero/profile"
 	"github.com/javanhut/zero/sessionmanager"
 	"github.com/javanhut/zero/signaling"
 	"github.com/javanhut/zero/webrtc"
@@ -68,6 +78,254 @@ func calculateAudioSize(dbLevel float64) float32 {
 	return minSize + float32(normalized)*(maxSize-minSize)
 }
 
+type remoteTile struct {
+	peerID    string
+	image     *canvas.Image
+	nameLabel *widget.Label
+	avatar    *canvas.Image
+	accent    *canvas.Rectangle
+	menuBtn   *widget.Button
+	content   fyne.CanvasObject
+	video     *camera.RemoteVideo
+}
+
+// setProfile shows a peer's name, color and avatar on its tile. It must run
+// on the Fyne thread.
+func (t *remoteTile) setProfile(username, hex string, avatar []byte) {
+	t.nameLabel.SetText(username)
+	t.accent.FillColor = profileColor(hex, color.Transparent)
+	t.accent.Refresh()
+
+	t.avatar.Image = avatarImage(avatar)
+	if t.avatar.Image != nil {
+		t.avatar.Show()
+	} else {
+		t.avatar.Hide()
+	}
+	t.avatar.Refresh()
+}
+
+// profileColor parses a profile's #rrggbb color, or returns fallback if it
+// has none.
+func profileColor(hex string, fallback color.Color) color.Color {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(hex, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return fallback
+	}
+	return color.RGBA{R: r, G: g, B: b, A: 255}
+}
+
+func hexColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// avatarImage decodes a profile's avatar, or returns nil if it has none.
+func avatarImage(data []byte) image.Image {
+	if len(data) == 0 {
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to decode avatar: %v", err)
+		return nil
+	}
+	return img
+}
+
+func validateDisplayName(name string) error {
+	if utf8.RuneCountInString(strings.TrimSpace(name)) > signaling.MaxDisplayNameLength {
+		return fmt.Errorf("at most %d characters", signaling.MaxDisplayNameLength)
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for rest := n / unit; rest >= unit; rest /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// transferRow shows one file transfer in the files panel.
+type transferRow struct {
+	box      *fyne.Container
+	title    *widget.Label
+	progress *widget.ProgressBar
+	status   *widget.Label
+	cancel   *widget.Button
+}
+
+func newTransferRow(onCancel func()) *transferRow {
+	row := &transferRow{
+		title:    widget.NewLabel(""),
+		progress: widget.NewProgressBar(),
+		status:   widget.NewLabel(""),
+		cancel:   widget.NewButtonWithIcon("", theme.CancelIcon(), onCancel),
+	}
+	row.title.Truncation = fyne.TextTruncateEllipsis
+	row.title.TextStyle = fyne.TextStyle{Bold: true}
+	row.status.Truncation = fyne.TextTruncateEllipsis
+	row.box = container.NewVBox(
+		row.title,
+		row.progress,
+		container.NewBorder(nil, nil, nil, row.cancel, row.status),
+	)
+	return row
+}
+
+// update shows the latest state of t, sent to or received from peerName.
+// It must run on the Fyne thread.
+func (r *transferRow) update(t webrtc.Transfer, peerName string) {
+	if t.Outgoing {
+		r.title.SetText(fmt.Sprintf("%s → %s", t.Name, peerName))
+	} else {
+		r.title.SetText(fmt.Sprintf("%s ← %s", t.Name, peerName))
+	}
+
+	switch {
+	case t.Size > 0:
+		r.progress.SetValue(float64(t.Transferred) / float64(t.Size))
+	case t.State == webrtc.TransferCompleted:
+		r.progress.SetValue(1)
+	}
+
+	var status string
+	switch t.State {
+	case webrtc.TransferOffered:
+		if t.Outgoing {
+			status = fmt.Sprintf("Waiting for %s to accept", peerName)
+		} else {
+			status = "Waiting for you to accept"
+		}
+	case webrtc.TransferActive:
+		status = fmt.Sprintf("%s of %s", formatBytes(t.Transferred), formatBytes(t.Size))
+	case webrtc.TransferInterrupted:
+		status = fmt.Sprintf("Interrupted at %s, resumes on reconnect", formatBytes(t.Transferred))
+	case webrtc.TransferCompleted:
+		status = fmt.Sprintf("Done, %s", formatBytes(t.Size))
+	case webrtc.TransferFailed:
+		status = "Failed: " + t.Error
+	case webrtc.TransferRejected:
+		status = "Declined"
+	case webrtc.TransferCanceled:
+		status = "Canceled"
+	}
+	r.status.SetText(status)
+
+	if t.State.Done() {
+		r.cancel.Hide()
+	} else {
+		r.cancel.Show()
+	}
+}
+
+// tileArea shows a remote tile and opens its participant menu on a
+// right-click.
+type tileArea struct {
+	widget.BaseWidget
+	content        fyne.CanvasObject
+	onSecondaryTap func(at fyne.Position)
+}
+
+func newTileArea(content fyne.CanvasObject, onSecondaryTap func(at fyne.Position)) *tileArea {
+	area := &tileArea{content: content, onSecondaryTap: onSecondaryTap}
+	area.ExtendBaseWidget(area)
+	return area
+}
+
+func (a *tileArea) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(a.content)
+}
+
+func (a *tileArea) TappedSecondary(event *fyne.PointEvent) {
+	a.onSecondaryTap(event.AbsolutePosition)
+}
+
+// newRemoteTile builds the tile for a peer. onMenu opens the participant
+// menu at a position on the window's canvas; the menu button is hidden
+// until the local peer becomes a moderator.
+func newRemoteTile(peerID, username string, onVolume func(float64), onMute func(bool), onMenu func(at fyne.Position)) *remoteTile {
+	img := canvas.NewImageFromImage(nil)
+	img.FillMode = canvas.ImageFillContain
+	img.ScaleMode = canvas.ImageScaleSmooth
+	img.SetMinSize(fyne.NewSize(320, 240))
+
+	background := canvas.NewRectangle(color.Black)
+	background.SetMinSize(fyne.NewSize(320, 240))
+
+	nameLabel := widget.NewLabel(username)
+	nameLabel.TextStyle = fyne.TextStyle{Bold: true}
+	nameLabel.Alignment = fyne.TextAlignCenter
+
+	avatar := canvas.NewImageFromImage(nil)
+	avatar.FillMode = canvas.ImageFillContain
+	avatar.SetMinSize(fyne.NewSize(32, 32))
+	avatar.Hide()
+
+	accent := canvas.NewRectangle(color.Transparent)
+	accent.SetMinSize(fyne.NewSize(0, 4))
+
+	volumeSlider := widget.NewSlider(0, 1)
+	volumeSlider.Step = 0.05
+	volumeSlider.SetValue(1)
+	volumeSlider.OnChanged = onVolume
+
+	muteCheck := widget.NewCheck("Mute", onMute)
+
+	audioControls := container.NewBorder(nil, nil, nil, muteCheck, volumeSlider)
+
+	var menuBtn *widget.Button
+	menuBtn = widget.NewButtonWithIcon("", theme.MoreVerticalIcon(), func() {
+		at := fyne.CurrentApp().Driver().AbsolutePositionForObject(menuBtn)
+		onMenu(at.Add(fyne.NewPos(0, menuBtn.Size().Height)))
+	})
+	menuBtn.Importance = widget.LowImportance
+	menuBtn.Hide()
+
+	return &remoteTile{
+		peerID:    peerID,
+		image:     img,
+		nameLabel: nameLabel,
+		avatar:    avatar,
+		accent:    accent,
+		menuBtn:   menuBtn,
+		content: newTileArea(container.NewBorder(
+			accent,
+			container.NewVBox(container.NewBorder(nil, nil, avatar, menuBtn, nameLabel), audioControls),
+			nil,
+			nil,
+			container.NewStack(background, img),
+		), onMenu),
+	}
+}
+
+// canModerate reports whether a peer with role may mute or remove a peer
+// with targetRole. The server enforces the same rule.
+func canModerate(role, targetRole string) bool {
+	switch role {
+	case signaling.RoleHost:
+		return targetRole != signaling.RoleHost
+	case signaling.RoleCoHost:
+		return targetRole == signaling.RoleParticipant
+	}
+	return false
+}
+
+func remoteGridColumns(tileCount int) int {
+	columns := 1
+	for columns*columns < tileCount {
+		columns++
+	}
+	return columns
+}
+
 func showCameraSelectionDialog(a fyne.App, onSelect func(string)) {
 	cameraDevices := camera.GetCameraDevices()
 
@@ -191,8 +449,22 @@ func showStatsDialog(a fyne.App, vs *camera.VideoStream) {
 	statsWindow.Show()
 }
 
-func Gui() {
-	sessions := sessionmanager.New()
+// Gui runs the desktop app. If invite is not nil, the login window opens
+// ready to join the session it links to.
+func Gui(invite *signaling.Invite) {
+	cfg, err := config.LoadOrDefault(config.DefaultPath)
+	if err != nil {
+		log.Printf("Failed to load config, using defaults: %v", err)
+		cfg = config.Default()
+	}
+
+	mediaConfig := camera.MediaConfig{
+		VideoCodec:   cfg.Media.Video.Codec,
+		VideoBitrate: cfg.Media.Video.Bitrate,
+		AudioCodec:   cfg.Media.Audio.Codec,
+		AudioBitrate: cfg.Media.Audio.Bitrate,
+	}
+
 	a := app.New()
 	w := a.NewWindow("Session Login")
 	videoWindow := a.NewWindow("Video Window")
@@ -205,7 +477,25 @@ func Gui() {
 	var videoStream *camera.VideoStream
 	var signalingClient *signaling.Client
 	var webrtcManager *webrtc.Manager
-	signalingServerURL := "ws://localhost:8080/ws"
+	var audioMixer *playback.Mixer
+	signalingServerURL := cfg.Signaling.URL()
+	if invite != nil && invite.ServerURL != "" {
+		signalingServerURL = invite.ServerURL
+	}
+	sessions := sessionmanager.New(signalingServerURL)
+	// currentCode is the meeting code of the joined session, if it has not
+	// expired.
+	var currentCode string
+
+	userProfile, err := profile.Load()
+	if err != nil {
+		log.Printf("Failed to load profile: %v", err)
+		userProfile = &profile.Profile{}
+	}
+	nameEntry := widget.NewEntry()
+	nameEntry.SetText(userProfile.DisplayName)
+	nameEntry.SetPlaceHolder("Shown to everyone in the session")
+	nameEntry.Validator = validateDisplayName
 
 	videoCanvas := canvas.NewImageFromImage(nil)
 	videoCanvas.FillMode = canvas.ImageFillOriginal
@@ -218,8 +508,14 @@ func Gui() {
 	pauseBackground := canvas.NewRectangle(color.Black)
 	pauseBackground.SetMinSize(fyne.NewSize(1280, 720))
 
-	pauseUsernameLabel := widget.NewLabel("")
+	pauseAvatar := canvas.NewImageFromImage(nil)
+	pauseAvatar.FillMode = canvas.ImageFillContain
+	pauseAvatar.SetMinSize(fyne.NewSize(96, 96))
+	pauseAvatar.Hide()
+
+	pauseUsernameLabel := canvas.NewText("", color.White)
 	pauseUsernameLabel.TextStyle = fyne.TextStyle{Bold: true}
+	pauseUsernameLabel.TextSize = 24
 	pauseUsernameLabel.Alignment = fyne.TextAlignCenter
 
 	pauseTextLabel := widget.NewLabel("Video Paused")
@@ -227,14 +523,110 @@ func Gui() {
 
 	pauseContainer := container.NewCenter(
 		container.NewVBox(
+			container.NewCenter(pauseAvatar),
 			pauseUsernameLabel,
 			pauseTextLabel,
 		),
 	)
 
+	// refreshPauseProfile shows our name, color and avatar on the pause
+	// overlay. It must run on the Fyne thread.
+	refreshPauseProfile := func() {
+		pauseUsernameLabel.Text = currentUsername
+		pauseUsernameLabel.Color = profileColor(userProfile.Color, color.White)
+		pauseUsernameLabel.Refresh()
+
+		pauseAvatar.Image = avatarImage(userProfile.Avatar)
+		if pauseAvatar.Image != nil {
+			pauseAvatar.Show()
+		} else {
+			pauseAvatar.Hide()
+		}
+		pauseAvatar.Refresh()
+	}
+
+	// showProfileDialog edits the local profile and saves it, then calls
+	// onSaved. It must run on the Fyne thread.
+	showProfileDialog := func(parent fyne.Window, onSaved func()) {
+		edited := *userProfile
+
+		displayNameEntry := widget.NewEntry()
+		displayNameEntry.SetText(edited.DisplayName)
+		displayNameEntry.Validator = validateDisplayName
+
+		swatch := canvas.NewRectangle(profileColor(edited.Color, color.Transparent))
+		swatch.SetMinSize(fyne.NewSize(24, 24))
+		colorBtn := widget.NewButton("Choose…", func() {
+			picker := dialog.NewColorPicker("Color", "Shown around your video", func(c color.Color) {
+				edited.Color = hexColor(c)
+				swatch.FillColor = c
+				swatch.Refresh()
+			}, parent)
+			picker.Advanced = true
+			picker.Show()
+		})
+
+		avatarPreview := canvas.NewImageFromImage(avatarImage(edited.Avatar))
+		avatarPreview.FillMode = canvas.ImageFillContain
+		avatarPreview.SetMinSize(fyne.NewSize(64, 64))
+		avatarBtn := widget.NewButton("Choose Image…", func() {
+			open := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
+				if err != nil {
+					dialog.ShowError(err, parent)
+					return
+				}
+				if reader == nil {
+					return
+				}
+				defer reader.Close()
+
+				if err := edited.SetAvatarFromFile(reader.URI().Path()); err != nil {
+					dialog.ShowError(err, parent)
+					return
+				}
+				avatarPreview.Image = avatarImage(edited.Avatar)
+				avatarPreview.Refresh()
+			}, parent)
+			open.SetFilter(storage.NewExtensionFileFilter([]string{".png", ".jpg", ".jpeg"}))
+			open.Show()
+		})
+		removeAvatarBtn := widget.NewButton("Remove", func() {
+			edited.Avatar = nil
+			avatarPreview.Image = nil
+			avatarPreview.Refresh()
+		})
+
+		items := []*widget.FormItem{
+			widget.NewFormItem("Name", displayNameEntry),
+			widget.NewFormItem("Color", container.NewHBox(swatch, colorBtn)),
+			widget.NewFormItem("Avatar", container.NewHBox(avatarPreview, avatarBtn, removeAvatarBtn)),
+		}
+		dialog.ShowForm("Profile", "Save", "Cancel", items, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			edited.DisplayName = strings.TrimSpace(displayNameEntry.Text)
+			if err := edited.Save(); err != nil {
+				log.Printf("Failed to save profile: %v", err)
+				dialog.ShowError(err, parent)
+				return
+			}
+			*userProfile = edited
+			nameEntry.SetText(edited.DisplayName)
+			onSaved()
+		}, parent)
+	}
+
 	pauseOverlay := container.NewStack(pauseBackground, pauseContainer)
 	pauseOverlay.Hide()
 
+	lobbyBackground := canvas.NewRectangle(color.RGBA{R: 0, G: 0, B: 0, A: 200})
+	lobbyLabel := widget.NewLabel("Waiting for the host to let you in…")
+	lobbyLabel.TextStyle = fyne.TextStyle{Bold: true}
+	lobbyLabel.Alignment = fyne.TextAlignCenter
+	lobbyOverlay := container.NewStack(lobbyBackground, container.NewCenter(lobbyLabel))
+	lobbyOverlay.Hide()
+
 	audioCircle := canvas.NewCircle(color.RGBA{R: 0, G: 255, B: 0, A: 255})
 	audioCircle.Resize(fyne.NewSize(30, 30))
 
@@ -283,41 +675,60 @@ func Gui() {
 	var fullScreenBtn *widget.Button
 	isFullScreen := false
 
-	cameraBtn = widget.NewButton("Camera On", func() {
+	// setCameraEnabled and setAudioEnabled must run on the Fyne thread.
+	setCameraEnabled := func(enabled bool) {
 		if videoStream == nil {
 			return
 		}
-		if cameraEnabled {
-			videoStream.PauseVideo()
-			cameraBtn.SetText("Camera Off")
-			cameraEnabled = false
-			pauseUsernameLabel.SetText(currentUsername)
-			pauseOverlay.Show()
-		} else {
+		if enabled {
 			videoStream.ResumeVideo()
 			cameraBtn.SetText("Camera On")
-			cameraEnabled = true
 			pauseOverlay.Hide()
+		} else {
+			videoStream.PauseVideo()
+			cameraBtn.SetText("Camera Off")
+			refreshPauseProfile()
+			pauseOverlay.Show()
 		}
-	})
-	cameraBtn.Importance = widget.HighImportance
+		cameraEnabled = enabled
+	}
 
-	audioBtn = widget.NewButton("Audio On", func() {
+	setAudioEnabled := func(enabled bool) {
 		if videoStream == nil {
 			return
 		}
-		if audioEnabled {
-			videoStream.PauseAudio()
-			audioBtn.SetText("Audio Off")
-			audioEnabled = false
-		} else {
+		if enabled {
 			videoStream.ResumeAudio()
 			audioBtn.SetText("Audio On")
-			audioEnabled = true
+		} else {
+			videoStream.PauseAudio()
+			audioBtn.SetText("Audio Off")
 		}
+		audioEnabled = enabled
+	}
+
+	cameraBtn = widget.NewButton("Camera On", func() {
+		setCameraEnabled(!cameraEnabled)
+	})
+	cameraBtn.Importance = widget.HighImportance
+
+	audioBtn = widget.NewButton("Audio On", func() {
+		setAudioEnabled(!audioEnabled)
 	})
 	audioBtn.Importance = widget.HighImportance
 
+	// roomLocked mirrors the session's lock from session_info.
+	roomLocked := false
+	lockBtn := widget.NewButtonWithIcon("Lock Room", theme.VisibilityOffIcon(), func() {
+		if signalingClient == nil {
+			return
+		}
+		if err := signalingClient.LockRoom(!roomLocked); err != nil {
+			log.Printf("Failed to lock room: %v", err)
+		}
+	})
+	lockBtn.Importance = widget.MediumImportance
+
 	statsBtn = widget.NewButton("Stats", func() {
 		showStatsDialog(a, videoStream)
 	})
@@ -336,6 +747,56 @@ func Gui() {
 	})
 	fullScreenBtn.Importance = widget.HighImportance
 
+	inviteBtn := widget.NewButtonWithIcon("Copy Invite", theme.ContentCopyIcon(), func() {
+		session := currentCode
+		if session == "" {
+			session = currentSessionID
+		}
+		link := signaling.Invite{Session: session, ServerURL: signalingServerURL}.String()
+		a.Clipboard().SetContent(link)
+		dialog.ShowInformation("Invite copied", fmt.Sprintf("Send this link, or the code %s, to people you want to invite:\n\n%s", session, link), videoWindow)
+	})
+	inviteBtn.Importance = widget.MediumImportance
+
+	// Profile changes made during a call are sent to everyone in it.
+	profileBtn := widget.NewButtonWithIcon("Profile", theme.AccountIcon(), func() {
+		showProfileDialog(videoWindow, func() {
+			refreshPauseProfile()
+			if signalingClient == nil {
+				return
+			}
+			if err := signalingClient.UpdateProfile(userProfile.Signaling()); err != nil {
+				log.Printf("Failed to update profile: %v", err)
+			}
+		})
+	})
+	profileBtn.Importance = widget.MediumImportance
+
+	var localVideoTrack *pwebrtc.TrackLocalStaticSample
+	var localAudioTrack *pwebrtc.TrackLocalStaticSample
+
+	// publishLocalTracks sends videoStream to every peer, swapping out the
+	// tracks of a previous stream so peers keep a single sender per kind.
+	publishLocalTracks := func() {
+		videoTrack, audioTrack, err := videoStream.CreateWebRTCTracks()
+		if err != nil {
+			log.Printf("Failed to create WebRTC tracks: %v", err)
+			return
+		}
+
+		if videoTrack != nil {
+			webrtcManager.ReplaceLocalTrack(localVideoTrack, videoTrack)
+			localVideoTrack = videoTrack
+		}
+		if audioTrack != nil {
+			webrtcManager.ReplaceLocalTrack(localAudioTrack, audioTrack)
+			localAudioTrack = audioTrack
+		} else if localAudioTrack != nil {
+			webrtcManager.RemoveLocalTrack(localAudioTrack)
+			localAudioTrack = nil
+		}
+	}
+
 	updateVideo := func(frame image.Image) {
 		fyne.Do(func() {
 			videoCanvas.Image = frame
@@ -350,7 +811,7 @@ func Gui() {
 			}
 			videoLabel.Show()
 			videoLabel.SetText("Switching camera...")
-			stream, err := camera.StartVideoStream(currentResolution, deviceID, updateVideo)
+			stream, err := camera.StartVideoStream(currentResolution, deviceID, mediaConfig, updateVideo)
 			if err != nil {
 				log.Printf("Failed to start camera: %v", err)
 				videoLabel.Show()
@@ -361,17 +822,7 @@ func Gui() {
 			videoLabel.Hide()
 
 			if webrtcManager != nil {
-				videoTrack, audioTrack, err := videoStream.CreateWebRTCTracks()
-				if err != nil {
-					log.Printf("Failed to create WebRTC tracks: %v", err)
-				} else {
-					if videoTrack != nil {
-						webrtcManager.AddLocalTrack(videoTrack)
-					}
-					if audioTrack != nil {
-						webrtcManager.AddLocalTrack(audioTrack)
-					}
-				}
+				publishLocalTracks()
 			}
 		})
 	})
@@ -393,7 +844,7 @@ func Gui() {
 				oldStream.Stop()
 
 				cameraDeviceID := ""
-				stream, err := camera.StartVideoStream(currentResolution, cameraDeviceID, updateVideo)
+				stream, err := camera.StartVideoStream(currentResolution, cameraDeviceID, mediaConfig, updateVideo)
 				if err != nil {
 					log.Printf("Failed to restart camera with new resolution: %v", err)
 					fyne.Do(func() {
@@ -416,17 +867,7 @@ func Gui() {
 				})
 
 				if webrtcManager != nil {
-					videoTrack, audioTrack, err := videoStream.CreateWebRTCTracks()
-					if err != nil {
-						log.Printf("Failed to create WebRTC tracks: %v", err)
-					} else {
-						if videoTrack != nil {
-							webrtcManager.AddLocalTrack(videoTrack)
-						}
-						if audioTrack != nil {
-							webrtcManager.AddLocalTrack(audioTrack)
-						}
-					}
+					publishLocalTracks()
 				}
 			}()
 		}
@@ -438,6 +879,301 @@ func Gui() {
 	statsBtn.Disable()
 	resolutionSelect.Disable()
 	fullScreenBtn.Disable()
+	lockBtn.Disable()
+	inviteBtn.Disable()
+
+	// chatSeen holds the IDs of the chat messages shown, since the history
+	// sent after a rejoin repeats them.
+	chatSeen := make(map[string]bool)
+	chatList := container.NewVBox()
+	chatScroll := container.NewVScroll(chatList)
+	chatHeader := widget.NewLabel("Chat")
+	chatHeader.TextStyle = fyne.TextStyle{Bold: true}
+
+	// chatRecipients maps the options of chatTo to peer IDs, "" being the
+	// whole session.
+	const chatEveryone = "Everyone"
+	chatRecipients := map[string]string{chatEveryone: ""}
+	chatTo := widget.NewSelect([]string{chatEveryone}, nil)
+	chatTo.SetSelected(chatEveryone)
+	chatEntry := widget.NewEntry()
+	chatEntry.SetPlaceHolder("Message")
+
+	sendChat := func() {
+		text := chatEntry.Text
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		to := chatRecipients[chatTo.Selected]
+
+		var err error
+		switch {
+		case webrtcManager != nil:
+			err = webrtcManager.SendChat(to, text)
+		case signalingClient != nil:
+			err = signalingClient.SendChat(to, text)
+		default:
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to send chat: %v", err)
+			dialog.ShowError(err, videoWindow)
+			return
+		}
+		chatEntry.SetText("")
+	}
+	chatEntry.OnSubmitted = func(string) { sendChat() }
+	chatSendBtn := widget.NewButtonWithIcon("", theme.MailSendIcon(), sendChat)
+
+	chatWidth := canvas.NewRectangle(color.Transparent)
+	chatWidth.SetMinSize(fyne.NewSize(280, 0))
+	chatPanel := container.NewStack(chatWidth, container.NewBorder(
+		chatHeader,
+		container.NewVBox(chatTo, container.NewBorder(nil, nil, nil, chatSendBtn, chatEntry)),
+		nil,
+		nil,
+		chatScroll,
+	))
+	chatPanel.Hide()
+
+	unreadChats := 0
+	chatBadgeText := canvas.NewText("", color.White)
+	chatBadgeText.TextSize = 11
+	chatBadgeText.TextStyle = fyne.TextStyle{Bold: true}
+	chatBadge := container.NewGridWrap(fyne.NewSize(20, 20), container.NewStack(
+		canvas.NewCircle(color.RGBA{R: 220, G: 38, B: 38, A: 255}),
+		container.NewCenter(chatBadgeText),
+	))
+	chatBadge.Hide()
+
+	// updateChatBadge must run on the Fyne thread.
+	updateChatBadge := func() {
+		if unreadChats == 0 {
+			chatBadge.Hide()
+			return
+		}
+		chatBadgeText.Text = fmt.Sprint(unreadChats)
+		if unreadChats > 99 {
+			chatBadgeText.Text = "99+"
+		}
+		chatBadgeText.Refresh()
+		chatBadge.Show()
+	}
+
+	// peerName names a chat participant, or "You" for the local peer.
+	peerName := func(peerID, username string) string {
+		if peerID == currentPeerID {
+			return "You"
+		}
+		if username != "" {
+			return username
+		}
+		if peer, ok := sessions.GetPeer(currentSessionID, peerID); ok {
+			return peer.Username
+		}
+		return fmt.Sprintf("User_%.8s", peerID)
+	}
+
+	// refreshChatRecipients lists the session's other peers as chat
+	// recipients, keeping the selected one if it is still there. It must
+	// run on the Fyne thread.
+	refreshChatRecipients := func() {
+		selectedPeer := chatRecipients[chatTo.Selected]
+
+		var peers []sessionmanager.Peer
+		if cached, err := sessions.GetPeersInSession(currentSessionID); err == nil {
+			for _, entry := range cached {
+				if peer, ok := sessions.GetPeer(currentSessionID, entry.PeerID); ok && peer.PeerID != currentPeerID {
+					peers = append(peers, peer)
+				}
+			}
+		}
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].Username < peers[j].Username
+		})
+
+		recipients := map[string]string{chatEveryone: ""}
+		options := []string{chatEveryone}
+		selected := chatEveryone
+		for _, peer := range peers {
+			option := peer.Username
+			if _, taken := recipients[option]; taken {
+				option = fmt.Sprintf("%s (%.8s)", peer.Username, peer.PeerID)
+			}
+			recipients[option] = peer.PeerID
+			options = append(options, option)
+			if peer.PeerID == selectedPeer {
+				selected = option
+			}
+		}
+		chatRecipients = recipients
+		chatTo.Options = options
+		chatTo.SetSelected(selected)
+	}
+
+	// appendChat shows a chat message, counting it as unread while the chat
+	// panel is closed. It must run on the Fyne thread.
+	appendChat := func(chat signaling.ChatPayload) {
+		if chatSeen[chat.ID] {
+			return
+		}
+		chatSeen[chat.ID] = true
+
+		heading := peerName(chat.From, chat.Username)
+		if chat.To != "" {
+			to := "you"
+			if chat.To != currentPeerID {
+				to = peerName(chat.To, "")
+			}
+			heading = fmt.Sprintf("%s to %s (private)", heading, to)
+		}
+		header := widget.NewLabel(fmt.Sprintf("%s · %s", heading, chat.SentAt.Local().Format("15:04")))
+		header.TextStyle = fyne.TextStyle{Bold: true}
+		text := widget.NewLabel(chat.Text)
+		text.Wrapping = fyne.TextWrapWord
+		chatList.Add(container.NewVBox(header, text))
+		chatScroll.ScrollToBottom()
+
+		if !chatPanel.Visible() && chat.From != currentPeerID {
+			unreadChats++
+			updateChatBadge()
+		}
+	}
+
+	clearChat := func() {
+		chatList.RemoveAll()
+		clear(chatSeen)
+		unreadChats = 0
+		updateChatBadge()
+		chatEntry.SetText("")
+		chatPanel.Hide()
+	}
+
+	chatBtn := widget.NewButtonWithIcon("Chat", theme.MailComposeIcon(), func() {
+		if chatPanel.Visible() {
+			chatPanel.Hide()
+			return
+		}
+		refreshChatRecipients()
+		chatPanel.Show()
+		unreadChats = 0
+		updateChatBadge()
+		chatScroll.ScrollToBottom()
+	})
+	chatBtn.Importance = widget.MediumImportance
+	chatBtn.Disable()
+
+	// transferRows maps transfer IDs to their rows in the files panel.
+	transferRows := make(map[string]*transferRow)
+	transferList := container.NewVBox()
+	transferScroll := container.NewVScroll(transferList)
+	filesHeader := widget.NewLabel("Files")
+	filesHeader.TextStyle = fyne.TextStyle{Bold: true}
+
+	// showSendFileDialog asks who to send a file to, then which file. The
+	// recipients are the chat's, without Everyone.
+	showSendFileDialog := func() {
+		refreshChatRecipients()
+		recipients := chatRecipients
+		var options []string
+		for _, option := range chatTo.Options {
+			if option != chatEveryone {
+				options = append(options, option)
+			}
+		}
+		if len(options) == 0 {
+			dialog.ShowInformation("Send File", "Nobody else is in the session yet.", videoWindow)
+			return
+		}
+
+		recipient := widget.NewSelect(options, nil)
+		recipient.SetSelected(options[0])
+		items := []*widget.FormItem{widget.NewFormItem("To", recipient)}
+		dialog.ShowForm("Send File", "Choose File…", "Cancel", items, func(confirmed bool) {
+			if !confirmed {
+				return
+			}
+			peerID := recipients[recipient.Selected]
+			dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+				if err != nil {
+					dialog.ShowError(err, videoWindow)
+					return
+				}
+				if reader == nil {
+					return
+				}
+				path := reader.URI().Path()
+				reader.Close()
+
+				manager := webrtcManager
+				if manager == nil {
+					return
+				}
+				// Hashing a large file takes a while.
+				go func() {
+					if _, err := manager.SendFile(peerID, path); err != nil {
+						log.Printf("Failed to send file: %v", err)
+						fyne.Do(func() {
+							dialog.ShowError(err, videoWindow)
+						})
+					}
+				}()
+			}, videoWindow)
+		}, videoWindow)
+	}
+
+	sendFileBtn := widget.NewButtonWithIcon("Send File…", theme.UploadIcon(), showSendFileDialog)
+	filesWidth := canvas.NewRectangle(color.Transparent)
+	filesWidth.SetMinSize(fyne.NewSize(280, 0))
+	filesPanel := container.NewStack(filesWidth, container.NewBorder(
+		filesHeader,
+		sendFileBtn,
+		nil,
+		nil,
+		transferScroll,
+	))
+	filesPanel.Hide()
+
+	// showTransfer adds or updates a transfer's row. It must run on the
+	// Fyne thread.
+	showTransfer := func(t webrtc.Transfer) {
+		// Reports from a closed manager arrive after the panel was cleared.
+		if webrtcManager == nil {
+			return
+		}
+		row, exists := transferRows[t.ID]
+		if !exists {
+			transferID := t.ID
+			row = newTransferRow(func() {
+				if webrtcManager == nil {
+					return
+				}
+				if err := webrtcManager.CancelTransfer(transferID); err != nil {
+					log.Printf("Failed to cancel transfer: %v", err)
+				}
+			})
+			transferRows[t.ID] = row
+			transferList.Add(row.box)
+			transferScroll.ScrollToBottom()
+		}
+		row.update(t, peerName(t.PeerID, ""))
+	}
+
+	clearTransfers := func() {
+		transferList.RemoveAll()
+		clear(transferRows)
+		filesPanel.Hide()
+	}
+
+	filesBtn := widget.NewButtonWithIcon("Files", theme.FolderIcon(), func() {
+		if filesPanel.Visible() {
+			filesPanel.Hide()
+			return
+		}
+		filesPanel.Show()
+	})
+	filesBtn.Importance = widget.MediumImportance
+	filesBtn.Disable()
 
 	resolutionLabel := widget.NewLabel("Resolution:")
 	resolutionContainer := container.NewHBox(resolutionLabel, resolutionSelect)
@@ -452,6 +1188,11 @@ func Gui() {
 		selectCameraBtn,
 		resolutionContainer,
 		fullScreenBtn,
+		lockBtn,
+		inviteBtn,
+		profileBtn,
+		container.NewStack(chatBtn, container.NewHBox(layout.NewSpacer(), container.NewVBox(chatBadge))),
+		filesBtn,
 		layout.NewSpacer(),
 		audioMeterContainer,
 	)
@@ -463,40 +1204,703 @@ func Gui() {
 
 	controlPanel := container.NewVBox(styledControls)
 
-	videoContainer := container.NewBorder(
-		nil,
-		controlPanel,
-		nil,
-		nil,
-		container.NewStack(
-			videoCanvas,
-			pauseOverlay,
-			videoLabel,
-		),
+	localVideo := container.NewStack(
+		videoCanvas,
+		pauseOverlay,
+		videoLabel,
 	)
-	videoWindow.SetContent(videoContainer)
 
-	videoWindow.SetCloseIntercept(func() {
-		if webrtcManager != nil {
-			webrtcManager.Close()
-			webrtcManager = nil
+	remoteTiles := make(map[string]*remoteTile)
+	remoteGrid := container.New(layout.NewAdaptiveGridLayout(1))
+	remoteSplit := container.NewHSplit(localVideo, container.NewVScroll(remoteGrid))
+	videoArea := container.NewStack(localVideo)
+
+	// refreshRemoteGrid must run on the Fyne thread.
+	refreshRemoteGrid := func() {
+		objects := make([]fyne.CanvasObject, 0, len(remoteTiles))
+		for _, tile := range remoteTiles {
+			objects = append(objects, tile.content)
 		}
-		if signalingClient != nil {
-			signalingClient.Disconnect()
-			signalingClient = nil
+		remoteGrid.Layout = layout.NewAdaptiveGridLayout(remoteGridColumns(len(objects)))
+		remoteGrid.Objects = objects
+		remoteGrid.Refresh()
+
+		if len(objects) == 0 {
+			videoArea.Objects = []fyne.CanvasObject{localVideo}
+		} else {
+			videoArea.Objects = []fyne.CanvasObject{remoteSplit}
 		}
-		if videoStream != nil {
-			videoStream.Stop()
+		videoArea.Refresh()
+	}
+
+	removeRemoteTile := func(peerID string) {
+		fyne.Do(func() {
+			tile, exists := remoteTiles[peerID]
+			if !exists {
+				return
+			}
+			if tile.video != nil {
+				tile.video.Stop()
+			}
+			delete(remoteTiles, peerID)
+			refreshRemoteGrid()
+		})
+	}
+
+	clearRemoteTiles := func() {
+		for peerID, tile := range remoteTiles {
+			if tile.video != nil {
+				tile.video.Stop()
+			}
+			delete(remoteTiles, peerID)
+		}
+		refreshRemoteGrid()
+	}
+
+	localRole := func() string {
+		if signalingClient == nil {
+			return ""
+		}
+		return signalingClient.GetRole()
+	}
+
+	// lobbyRows holds the admit panel's row for each waiting peer.
+	lobbyRows := make(map[string]fyne.CanvasObject)
+	lobbyList := container.NewVBox()
+	lobbyHeader := widget.NewLabel("Waiting room")
+	lobbyHeader.TextStyle = fyne.TextStyle{Bold: true}
+	lobbyPanel := container.NewBorder(lobbyHeader, nil, nil, nil, container.NewVScroll(lobbyList))
+	lobbyPanel.Hide()
+
+	// refreshLobbyPanel must run on the Fyne thread.
+	refreshLobbyPanel := func() {
+		objects := make([]fyne.CanvasObject, 0, len(lobbyRows))
+		for _, row := range lobbyRows {
+			objects = append(objects, row)
+		}
+		lobbyList.Objects = objects
+		lobbyList.Refresh()
+
+		if len(objects) == 0 {
+			lobbyPanel.Hide()
+		} else {
+			lobbyPanel.Show()
+		}
+	}
+
+	clearLobbyPanel := func() {
+		for peerID := range lobbyRows {
+			delete(lobbyRows, peerID)
+		}
+		refreshLobbyPanel()
+	}
+
+	// updateModeratorControls shows the room lock, admit panel and
+	// participant menus to hosts and co-hosts. It must run on the Fyne
+	// thread.
+	updateModeratorControls := func() {
+		role := localRole()
+		moderator := role == signaling.RoleHost || role == signaling.RoleCoHost
+		if moderator {
+			lockBtn.Enable()
+		} else {
+			lockBtn.Disable()
+			clearLobbyPanel()
+		}
+		for _, tile := range remoteTiles {
+			if moderator {
+				tile.menuBtn.Show()
+			} else {
+				tile.menuBtn.Hide()
+			}
+		}
+	}
+
+	// showPeerMenu opens the participant menu for peerID. Entries the local
+	// peer's role does not allow are disabled; the server checks them too.
+	showPeerMenu := func(peerID string, at fyne.Position) {
+		client := signalingClient
+		role := localRole()
+		if client == nil || (role != signaling.RoleHost && role != signaling.RoleCoHost) {
+			return
+		}
+		targetRole := sessions.GetPeerRole(currentSessionID, peerID)
+		username := peerID
+		if webrtcManager != nil {
+			username = webrtcManager.GetPeerUsername(peerID)
+		}
+
+		logErr := func(action string, err error) {
+			if err != nil {
+				log.Printf("Failed to %s %s: %v", action, peerID, err)
+			}
+		}
+
+		mute := fyne.NewMenuItem("Mute", func() {
+			logErr("mute", client.RequestMute(peerID, signaling.MediaAudio))
+		})
+		stopVideo := fyne.NewMenuItem("Turn Off Video", func() {
+			logErr("turn off video of", client.RequestMute(peerID, signaling.MediaVideo))
+		})
+		remove := fyne.NewMenuItem("Remove From Session", func() {
+			dialog.ShowConfirm("Remove participant",
+				fmt.Sprintf("Remove %s from the session? They will not be able to rejoin.", username),
+				func(confirmed bool) {
+					if confirmed {
+						logErr("remove", client.RemovePeer(peerID))
+					}
+				}, videoWindow)
+		})
+		allowed := canModerate(role, targetRole)
+		mute.Disabled = !allowed
+		stopVideo.Disabled = !allowed
+		remove.Disabled = !allowed
+		items := []*fyne.MenuItem{mute, stopVideo, remove}
+
+		if role == signaling.RoleHost {
+			newRole, label := signaling.RoleCoHost, "Make Co-host"
+			if targetRole == signaling.RoleCoHost {
+				newRole, label = signaling.RoleParticipant, "Make Participant"
+			}
+			items = append(items,
+				fyne.NewMenuItemSeparator(),
+				fyne.NewMenuItem(label, func() {
+					logErr("change role of", client.SetPeerRole(peerID, newRole))
+				}),
+				fyne.NewMenuItem("Make Host", func() {
+					dialog.ShowConfirm("Transfer host",
+						fmt.Sprintf("Make %s the host? You will become a co-host.", username),
+						func(confirmed bool) {
+							if confirmed {
+								logErr("hand host to", client.TransferHost(peerID))
+							}
+						}, videoWindow)
+				}),
+			)
+		}
+
+		widget.ShowPopUpMenuAtPosition(fyne.NewMenu(username, items...), videoWindow.Canvas(), at)
+	}
+
+	onRemoteTrack := func(peerID string, track *pwebrtc.TrackRemote, receiver *pwebrtc.RTPReceiver) {
+		log.Printf("Received remote track from peer %s: %s", peerID, track.Kind().String())
+		if track.Kind() != pwebrtc.RTPCodecTypeVideo {
+			return
+		}
+
+		username := peerID
+		if webrtcManager != nil {
+			username = webrtcManager.GetPeerUsername(peerID)
+		}
+
+		tile := newRemoteTile(peerID, username,
+			func(volume float64) {
+				if webrtcManager == nil {
+					return
+				}
+				if err := webrtcManager.SetPeerVolume(peerID, volume); err != nil {
+					log.Printf("Failed to set volume for peer %s: %v", peerID, err)
+				}
+			},
+			func(muted bool) {
+				if webrtcManager == nil {
+					return
+				}
+				if err := webrtcManager.SetPeerMuted(peerID, muted); err != nil {
+					log.Printf("Failed to mute peer %s: %v", peerID, err)
+				}
+			},
+			func(at fyne.Position) {
+				showPeerMenu(peerID, at)
+			},
+		)
+		remoteVideo, err := camera.StartRemoteVideo(track, func(frame image.Image) {
+			fyne.Do(func() {
+				tile.image.Image = frame
+				tile.image.Refresh()
+			})
+		})
+		if err != nil {
+			log.Printf("Failed to start remote video for peer %s: %v", peerID, err)
+			return
+		}
+		tile.video = remoteVideo
+
+		fyne.Do(func() {
+			if peer, ok := sessions.GetPeer(currentSessionID, peerID); ok {
+				tile.setProfile(username, peer.Color, peer.Avatar)
+			}
+			if existing, exists := remoteTiles[peerID]; exists && existing.video != nil {
+				existing.video.Stop()
+			}
+			remoteTiles[peerID] = tile
+			updateModeratorControls()
+			refreshRemoteGrid()
+		})
+	}
+
+	startAudioMixer := func() *playback.Mixer {
+		sink, err := playback.NewSink(cfg.Media.Audio.Output, cfg.Media.Audio.OutputFile)
+		if err != nil {
+			log.Printf("Invalid audio output config: %v", err)
+			sink = playback.NewNullSink()
+		}
+
+		mixer, err := playback.NewMixer(playback.MixerConfig{Sink: sink})
+		if err != nil {
+			log.Printf("Failed to start audio output, remote audio will be discarded: %v", err)
+			mixer, err = playback.NewMixer(playback.MixerConfig{Sink: playback.NewNullSink()})
+			if err != nil {
+				log.Printf("Failed to start audio mixer: %v", err)
+				return nil
+			}
+		}
+		return mixer
+	}
+
+	reconnectBanner := widget.NewLabel("Reconnecting to signaling server…")
+	reconnectBanner.Alignment = fyne.TextAlignCenter
+	reconnectBanner.Importance = widget.WarningImportance
+	reconnectBanner.Hide()
+
+	// endCall tears the call down once the server has ended our membership,
+	// leaving message on the video window.
+	endCall := func(message string) {
+		if webrtcManager != nil {
+			webrtcManager.Close()
+			webrtcManager = nil
+		}
+		if audioMixer != nil {
+			audioMixer.Close()
+			audioMixer = nil
+		}
+		clearRemoteTiles()
+		clearLobbyPanel()
+		lockBtn.Disable()
+		inviteBtn.Disable()
+		chatBtn.Disable()
+		filesBtn.Disable()
+		reconnectBanner.Hide()
+		lobbyOverlay.Hide()
+		videoLabel.Show()
+		videoLabel.SetText(fmt.Sprintf("Disconnected: %s", message))
+	}
+
+	// connectSignaling joins the current session with grant and starts the
+	// call on it. It is set once the message handlers below exist.
+	var connectSignaling func(grant *signaling.TokenResponse) error
+	// currentPasscode is sent with every join of the current session.
+	var currentPasscode string
+
+	// onSignalingFailed handles a server that will not take client back, as
+	// after a restart that lost our session or the key our token was signed
+	// with. The call ends; if only the token was refused, we join again as
+	// a new peer. It must run on the Fyne thread.
+	onSignalingFailed := func(client *signaling.Client) {
+		if client != signalingClient {
+			return
+		}
+		rejection := client.JoinRejection()
+		client.Disconnect()
+		signalingClient = nil
+
+		message := "the server refused to rejoin the session"
+		if rejection != nil {
+			message = rejection.Message
+		}
+		endCall(message)
+		if rejection == nil || !signaling.NeedsNewToken(rejection.Code) {
+			return
+		}
+
+		videoLabel.SetText("Rejoining session...")
+		sessionID, username := currentSessionID, currentUsername
+		go func() {
+			grant, err := signaling.RequestJoinToken(signalingServerURL, sessionID, username)
+			if err == nil {
+				err = connectSignaling(grant)
+			}
+			if err != nil {
+				log.Printf("Failed to rejoin session %s: %v", sessionID, err)
+				fyne.Do(func() {
+					videoLabel.SetText(fmt.Sprintf("Disconnected: could not rejoin: %v", err))
+				})
+				return
+			}
+			fyne.Do(videoLabel.Hide)
+		}()
+	}
+
+	onSignalingState := func(client *signaling.Client, state signaling.ConnectionState) {
+		fyne.Do(func() {
+			if state == signaling.StateReconnecting {
+				reconnectBanner.Show()
+			} else {
+				reconnectBanner.Hide()
+			}
+			if state == signaling.StateFailed {
+				onSignalingFailed(client)
+			}
+		})
+	}
+
+	// promptPasscode asks for the session passcode after the server turned
+	// a join down for lacking it, and joins again with it. It must run on
+	// the Fyne thread.
+	promptPasscode := func(wrong bool) {
+		client := signalingClient
+		if client == nil {
+			return
+		}
+		text := "This session needs a passcode."
+		if wrong {
+			text = "That passcode is not right. Try again."
+		}
+		codeEntry := widget.NewPasswordEntry()
+		items := []*widget.FormItem{
+			widget.NewFormItem("", widget.NewLabel(text)),
+			widget.NewFormItem("Passcode", codeEntry),
+		}
+		dialog.ShowForm("Passcode", "Join", "Cancel", items, func(confirmed bool) {
+			if !confirmed {
+				videoLabel.Show()
+				videoLabel.SetText("Could not join session: no passcode given")
+				return
+			}
+			currentPasscode = codeEntry.Text
+			client.SetPasscode(currentPasscode)
+			if err := client.Rejoin(); err != nil {
+				log.Printf("Failed to rejoin with passcode: %v", err)
+			}
+		}, videoWindow)
+	}
+
+	onSignalingError := func(msg *signaling.SignalingMessage) {
+		var payload signaling.ErrorPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal signaling error: %v", err)
+			return
+		}
+
+		log.Printf("Signaling error (%s): %s", payload.Code, payload.Message)
+		switch payload.Code {
+		case signaling.ErrorCodePasscodeRequired, signaling.ErrorCodeInvalidPasscode:
+			fyne.Do(func() {
+				promptPasscode(payload.Code == signaling.ErrorCodeInvalidPasscode)
+			})
+		case signaling.ErrorCodeAuthRequired, signaling.ErrorCodeInvalidToken,
+			signaling.ErrorCodeTokenExpired, signaling.ErrorCodePeerMismatch,
+			signaling.ErrorCodeSessionNotFound, signaling.ErrorCodePeerRemoved,
+			signaling.ErrorCodeRoomFull, signaling.ErrorCodeServerFull,
+			signaling.ErrorCodeRoomLocked:
+			fyne.Do(func() {
+				videoLabel.Show()
+				videoLabel.SetText(fmt.Sprintf("Could not join session: %s", payload.Message))
+			})
+		}
+	}
+
+	onSessionEnded := func(msg *signaling.SignalingMessage) {
+		var payload signaling.NoticePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal %s payload: %v", msg.Type, err)
+			return
+		}
+
+		fyne.Do(func() {
+			endCall(payload.Message)
+		})
+	}
+
+	onNotice := func(msg *signaling.SignalingMessage) {
+		var payload signaling.NoticePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal notice: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			dialog.ShowInformation("Notice", payload.Message, videoWindow)
+		})
+	}
+
+	// The server flags sessions that have outgrown a mesh. Without an SFU
+	// configured there is nothing to switch to, so just say so once.
+	sfuHintShown := false
+	onSessionInfo := func(msg *signaling.SignalingMessage) {
+		var payload signaling.SessionInfoPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal session info: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			refreshChatRecipients()
+			currentCode = payload.Code
+			roomLocked = payload.Locked
+			if roomLocked {
+				lockBtn.SetText("Unlock Room")
+			} else {
+				lockBtn.SetText("Lock Room")
+			}
+
+			if !payload.UseSFU || cfg.SFU.Enabled || sfuHintShown {
+				return
+			}
+			sfuHintShown = true
+			dialog.ShowInformation("Large session",
+				fmt.Sprintf("%d people are in this session. Calls this size work better through an SFU; quality may suffer on a direct mesh.", len(payload.Peers)),
+				videoWindow)
+		})
+	}
+
+	onRoleChanged := func(msg *signaling.SignalingMessage) {
+		fyne.Do(updateModeratorControls)
+	}
+
+	// onJoined also ends a wait in the lobby; it carries our first role.
+	onJoined := func(msg *signaling.SignalingMessage) {
+		fyne.Do(func() {
+			if signalingClient != nil {
+				currentUsername = signalingClient.GetUsername()
+			}
+			lobbyOverlay.Hide()
+			inviteBtn.Enable()
+			chatBtn.Enable()
+			filesBtn.Enable()
+			updateModeratorControls()
+		})
+	}
+
+	// onProfileUpdate shows a peer's new name, color and avatar. Our own
+	// update comes back too, with the name the server accepted.
+	onProfileUpdate := func(msg *signaling.SignalingMessage) {
+		var payload signaling.ProfileUpdatePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal profile update: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			update := payload.Profile
+			if payload.PeerID == currentPeerID {
+				currentUsername = update.DisplayName
+				refreshPauseProfile()
+				return
+			}
+			if tile, exists := remoteTiles[payload.PeerID]; exists {
+				tile.setProfile(update.DisplayName, update.Color, update.Avatar)
+			}
+			refreshChatRecipients()
+		})
+	}
+
+	onChat := func(msg *signaling.SignalingMessage) {
+		var payload signaling.ChatPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal chat: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			appendChat(payload)
+		})
+	}
+
+	onChatHistory := func(msg *signaling.SignalingMessage) {
+		var payload signaling.ChatHistoryPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal chat history: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			for _, chat := range payload.Messages {
+				appendChat(chat)
+			}
+		})
+	}
+
+	// onDataChannelChat receives messages sent peer to peer. A room-wide
+	// one may also come through the server's history, which appendChat
+	// skips by ID.
+	onDataChannelChat := func(chat signaling.ChatPayload) {
+		fyne.Do(func() {
+			appendChat(chat)
+		})
+	}
+
+	// onFileOffer asks whether to accept a file and where to save it.
+	onFileOffer := func(t webrtc.Transfer) {
+		fyne.Do(func() {
+			manager := webrtcManager
+			if manager == nil {
+				return
+			}
+			filesPanel.Show()
+			message := fmt.Sprintf("%s wants to send you %s (%s).", peerName(t.PeerID, ""), t.Name, formatBytes(t.Size))
+			dialog.ShowConfirm("Incoming file", message, func(accepted bool) {
+				if !accepted {
+					if err := manager.RejectFile(t.ID); err != nil {
+						log.Printf("Failed to decline file: %v", err)
+					}
+					return
+				}
+
+				save := dialog.NewFileSave(func(writer fyne.URIWriteCloser, err error) {
+					if err != nil {
+						dialog.ShowError(err, videoWindow)
+					}
+					if err != nil || writer == nil {
+						if err := manager.RejectFile(t.ID); err != nil {
+							log.Printf("Failed to decline file: %v", err)
+						}
+						return
+					}
+					path := writer.URI().Path()
+					writer.Close()
+
+					if err := manager.AcceptFile(t.ID, path); err != nil {
+						log.Printf("Failed to accept file: %v", err)
+						os.Remove(path)
+						dialog.ShowError(err, videoWindow)
+					}
+				}, videoWindow)
+				save.SetFileName(t.Name)
+				save.Show()
+			}, videoWindow)
+		})
+	}
+
+	onTransfer := func(t webrtc.Transfer) {
+		fyne.Do(func() {
+			showTransfer(t)
+		})
+	}
+
+	// onPeersChanged keeps the chat recipients in step with the session.
+	onPeersChanged := func(msg *signaling.SignalingMessage) {
+		fyne.Do(refreshChatRecipients)
+	}
+
+	onLobbyWaiting := func(msg *signaling.SignalingMessage) {
+		fyne.Do(lobbyOverlay.Show)
+	}
+
+	// onLobbyRequest adds a waiting peer to the admit panel. Only hosts and
+	// co-hosts are sent lobby requests.
+	onLobbyRequest := func(msg *signaling.SignalingMessage) {
+		var payload signaling.LobbyPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal lobby request: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			client := signalingClient
+			if client == nil {
+				return
+			}
+			peerID := payload.PeerID
+			name := widget.NewLabel(payload.Username)
+			name.Truncation = fyne.TextTruncateEllipsis
+			admit := widget.NewButtonWithIcon("Admit", theme.ConfirmIcon(), func() {
+				if err := client.Admit(peerID); err != nil {
+					log.Printf("Failed to admit %s: %v", peerID, err)
+				}
+			})
+			admit.Importance = widget.HighImportance
+			deny := widget.NewButtonWithIcon("Deny", theme.CancelIcon(), func() {
+				if err := client.Deny(peerID); err != nil {
+					log.Printf("Failed to deny %s: %v", peerID, err)
+				}
+			})
+			lobbyRows[peerID] = container.NewBorder(nil, nil, nil, container.NewHBox(admit, deny), name)
+			refreshLobbyPanel()
+		})
+	}
+
+	onLobbyLeft := func(msg *signaling.SignalingMessage) {
+		var payload signaling.LobbyPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal lobby left: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			delete(lobbyRows, payload.PeerID)
+			refreshLobbyPanel()
+		})
+	}
+
+	// onMuteRequest honours a host or co-host turning off our microphone or
+	// camera. Turning it back on is left to the user.
+	onMuteRequest := func(msg *signaling.SignalingMessage) {
+		var payload signaling.MuteRequestPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal mute request: %v", err)
+			return
+		}
+
+		fyne.Do(func() {
+			if payload.Media == signaling.MediaVideo {
+				setCameraEnabled(false)
+			} else {
+				setAudioEnabled(false)
+			}
+		})
+	}
+
+	onPeerDisconnect := func(peerID string) {
+		log.Printf("Peer disconnected: %s", peerID)
+		removeRemoteTile(peerID)
+	}
+
+	videoContainer := container.NewBorder(
+		reconnectBanner,
+		controlPanel,
+		nil,
+		container.NewHBox(lobbyPanel, chatPanel, filesPanel),
+		container.NewStack(videoArea, lobbyOverlay),
+	)
+	videoWindow.SetContent(videoContainer)
+
+	videoWindow.SetCloseIntercept(func() {
+		if webrtcManager != nil {
+			webrtcManager.Close()
+			webrtcManager = nil
+		}
+		localVideoTrack = nil
+		localAudioTrack = nil
+		if audioMixer != nil {
+			audioMixer.Close()
+			audioMixer = nil
+		}
+		if signalingClient != nil {
+			signalingClient.Disconnect()
+			signalingClient = nil
+		}
+		if videoStream != nil {
+			videoStream.Stop()
 			videoStream = nil
 		}
 		if currentSessionID != "" && currentPeerID != "" {
-			sessions.RemovePeerFromSession(currentSessionID, currentPeerID)
+			sessions.DeleteSession(currentSessionID)
 		}
 		cameraBtn.Disable()
 		audioBtn.Disable()
 		statsBtn.Disable()
 		resolutionSelect.Disable()
 		fullScreenBtn.Disable()
+		lockBtn.Disable()
+		lockBtn.SetText("Lock Room")
+		roomLocked = false
+		inviteBtn.Disable()
+		currentCode = ""
+		chatBtn.Disable()
+		clearChat()
+		filesBtn.Disable()
+		clearTransfers()
 		if isFullScreen {
 			videoWindow.SetFullScreen(false)
 			isFullScreen = false
@@ -508,33 +1912,136 @@ func Gui() {
 		cameraBtn.SetText("Camera On")
 		audioBtn.SetText("Audio On")
 		pauseOverlay.Hide()
+		reconnectBanner.Hide()
+		lobbyOverlay.Hide()
+		clearRemoteTiles()
+		clearLobbyPanel()
 		videoWindow.Hide()
 	})
 
 	startSession := widget.NewLabel("Zero App")
 	entry := widget.NewEntry()
+	lobbyCheck := widget.NewCheck("Waiting room: admit people to new sessions yourself", nil)
+	passcodeEntry := widget.NewPasswordEntry()
+	passcodeEntry.SetPlaceHolder("Optional")
 	form := &widget.Form{
 		Items: []*widget.FormItem{
-			{Text: "Session ID", Widget: entry},
+			{Text: "Name", Widget: nameEntry},
+			{Text: "Session ID", Widget: entry, HintText: "Session ID or meeting code"},
+			{Text: "Passcode", Widget: passcodeEntry, HintText: "Protects a new session, or joins a protected one"},
 		},
 	}
+
+	connectSignaling = func(grant *signaling.TokenResponse) error {
+		client := signaling.NewClient(signalingServerURL, currentSessionID, grant.PeerID, grant.Username)
+		client.SetJoinToken(grant.Token)
+		client.SetPasscode(currentPasscode)
+		client.SetProfile(userProfile.Signaling())
+		client.OnStateChange(func(state signaling.ConnectionState) {
+			onSignalingState(client, state)
+		})
+		sessions.Track(client)
+		client.On(signaling.MessageTypeError, onSignalingError)
+		client.On(signaling.MessageTypeKicked, onSessionEnded)
+		client.On(signaling.MessageTypeSessionClosed, onSessionEnded)
+		client.On(signaling.MessageTypeLobbyDenied, onSessionEnded)
+		client.On(signaling.MessageTypeNotice, onNotice)
+		client.On(signaling.MessageTypeSessionInfo, onSessionInfo)
+		client.On(signaling.MessageTypeJoined, onJoined)
+		client.On(signaling.MessageTypeRoleChanged, onRoleChanged)
+		client.On(signaling.MessageTypeMuteRequest, onMuteRequest)
+		client.On(signaling.MessageTypeLobbyWaiting, onLobbyWaiting)
+		client.On(signaling.MessageTypeLobbyRequest, onLobbyRequest)
+		client.On(signaling.MessageTypeLobbyLeft, onLobbyLeft)
+		client.On(signaling.MessageTypeProfileUpdate, onProfileUpdate)
+		client.On(signaling.MessageTypeChat, onChat)
+		client.On(signaling.MessageTypeChatHistory, onChatHistory)
+		client.On(signaling.MessageTypePeerJoined, onPeersChanged)
+		client.On(signaling.MessageTypePeerLeft, onPeersChanged)
+
+		currentPeerID = grant.PeerID
+		currentUsername = grant.Username
+		signalingClient = client
+		if err := client.Connect(); err != nil {
+			return err
+		}
+
+		audioMixer = startAudioMixer()
+		webrtcManager = webrtc.NewManager(webrtc.ManagerConfig{
+			WebRTCConfig:     webrtc.DefaultConfig(),
+			SignalingClient:  client,
+			OnRemoteTrack:    onRemoteTrack,
+			OnPeerDisconnect: onPeerDisconnect,
+			OnChat:           onDataChannelChat,
+			OnFileOffer:      onFileOffer,
+			OnTransfer:       onTransfer,
+			AudioMixer:       audioMixer,
+		})
+		publishLocalTracks()
+		return nil
+	}
+
+	// saveLoginName stores a name typed on the login window in the profile
+	// and returns the profile to join with.
+	saveLoginName := func() signaling.Profile {
+		name := strings.TrimSpace(nameEntry.Text)
+		if name != userProfile.DisplayName {
+			userProfile.DisplayName = name
+			if err := userProfile.Save(); err != nil {
+				log.Printf("Failed to save profile: %v", err)
+			}
+		}
+		return userProfile.Signaling()
+	}
+	editProfileBtn := widget.NewButtonWithIcon("Edit Profile", theme.AccountIcon(), func() {
+		saveLoginName()
+		showProfileDialog(w, func() {})
+	})
+
+	// An invite fills in the session; the server it names is shown since
+	// it replaces the configured one.
+	inviteLabel := widget.NewLabel("")
+	inviteLabel.Wrapping = fyne.TextWrapWord
+	inviteLabel.Hide()
+	if invite != nil {
+		entry.SetText(invite.Session)
+		inviteLabel.SetText(fmt.Sprintf("Invited to %s on %s. Press Connect to join.", invite.Session, signalingServerURL))
+		inviteLabel.Show()
+	}
 	w.SetContent(
 		container.NewVBox(
 			startSession,
+			inviteLabel,
 			form,
+			lobbyCheck,
 			container.NewHBox(
+				editProfileBtn,
 				widget.NewButton("Start New Session", func() {
 					log.Println("Creating new session....")
-					sessionID, username := sessions.CreateNewSession()
-					currentSessionID = sessionID
-					currentUsername = username
-					currentPeerID = uuid.New().String()
+					if nameEntry.Validate() != nil {
+						return
+					}
+					joinProfile := saveLoginName()
+					session, grant, err := sessions.CreateNewSession(signaling.CreateSessionRequest{
+						Lobby:    lobbyCheck.Checked,
+						Passcode: passcodeEntry.Text,
+						Username: joinProfile.DisplayName,
+					})
+					if err != nil {
+						log.Printf("Failed to create session: %v", err)
+						videoLabel.Show()
+						videoLabel.SetText(fmt.Sprintf("Session error: %v", err))
+						return
+					}
+					currentSessionID = session.SessionID
+					currentUsername = ""
+					currentPasscode = passcodeEntry.Text
 					videoLabel.Show()
 					videoLabel.SetText("Starting camera...")
 					videoWindow.Show()
 
 					go func() {
-						stream, err := camera.StartVideoStream(currentResolution, "", updateVideo)
+						stream, err := camera.StartVideoStream(currentResolution, "", mediaConfig, updateVideo)
 						if err != nil {
 							log.Printf("Failed to start camera: %v", err)
 							fyne.Do(func() {
@@ -550,8 +2057,7 @@ func Gui() {
 							videoLabel.SetText("Connecting to signaling server...")
 						})
 
-						signalingClient = signaling.NewClient(signalingServerURL, currentSessionID, currentPeerID, currentUsername)
-						if err := signalingClient.Connect(); err != nil {
+						if err := connectSignaling(grant); err != nil {
 							log.Printf("Failed to connect to signaling server: %v", err)
 							fyne.Do(func() {
 								videoLabel.SetText(fmt.Sprintf("Signaling error: %v\nCamera controls available", err))
@@ -572,30 +2078,6 @@ func Gui() {
 							return
 						}
 
-						webrtcConfig := webrtc.DefaultConfig()
-						webrtcManager = webrtc.NewManager(webrtc.ManagerConfig{
-							WebRTCConfig:    webrtcConfig,
-							SignalingClient: signalingClient,
-							OnRemoteTrack: func(peerID string, track *pwebrtc.TrackRemote, receiver *pwebrtc.RTPReceiver) {
-								log.Printf("Received remote track from peer %s: %s", peerID, track.Kind().String())
-							},
-							OnPeerDisconnect: func(peerID string) {
-								log.Printf("Peer disconnected: %s", peerID)
-							},
-						})
-
-						videoTrack, audioTrack, err := videoStream.CreateWebRTCTracks()
-						if err != nil {
-							log.Printf("Failed to create WebRTC tracks: %v", err)
-						} else {
-							if videoTrack != nil {
-								webrtcManager.AddLocalTrack(videoTrack)
-							}
-							if audioTrack != nil {
-								webrtcManager.AddLocalTrack(audioTrack)
-							}
-						}
-
 						fyne.Do(func() {
 							videoLabel.Hide()
 							cameraBtn.Enable()
@@ -622,26 +2104,28 @@ func Gui() {
 						log.Println("Please enter a session ID")
 						return
 					}
+					if nameEntry.Validate() != nil {
+						return
+					}
 
-					currentSessionID = sessionIDInput
-					currentPeerID = uuid.New().String()
-
-					peerID, username, err := sessions.JoinSession(currentSessionID)
+					session, err := sessions.JoinSession(sessionIDInput)
 					if err != nil {
 						log.Printf("Failed to join session: %v", err)
 						videoLabel.Show()
 						videoLabel.SetText(fmt.Sprintf("Join error: %v", err))
 						return
 					}
-					currentPeerID = peerID
-					currentUsername = username
+					currentSessionID = session.SessionID
+					currentUsername = ""
+					currentPasscode = passcodeEntry.Text
+					joinProfile := saveLoginName()
 
 					videoLabel.Show()
 					videoLabel.SetText("Starting camera...")
 					videoWindow.Show()
 
 					go func() {
-						stream, err := camera.StartVideoStream(currentResolution, "", updateVideo)
+						stream, err := camera.StartVideoStream(currentResolution, "", mediaConfig, updateVideo)
 						if err != nil {
 							log.Printf("Failed to start camera: %v", err)
 							fyne.Do(func() {
@@ -657,8 +2141,11 @@ func Gui() {
 							videoLabel.SetText("Connecting to signaling server...")
 						})
 
-						signalingClient = signaling.NewClient(signalingServerURL, currentSessionID, currentPeerID, currentUsername)
-						if err := signalingClient.Connect(); err != nil {
+						grant, err := signaling.RequestJoinToken(signalingServerURL, currentSessionID, joinProfile.DisplayName)
+						if err == nil {
+							err = connectSignaling(grant)
+						}
+						if err != nil {
 							log.Printf("Failed to connect to signaling server: %v", err)
 							fyne.Do(func() {
 								videoLabel.SetText(fmt.Sprintf("Signaling error: %v\nCamera controls available", err))
@@ -679,30 +2166,6 @@ func Gui() {
 							return
 						}
 
-						webrtcConfig := webrtc.DefaultConfig()
-						webrtcManager = webrtc.NewManager(webrtc.ManagerConfig{
-							WebRTCConfig:    webrtcConfig,
-							SignalingClient: signalingClient,
-							OnRemoteTrack: func(peerID string, track *pwebrtc.TrackRemote, receiver *pwebrtc.RTPReceiver) {
-								log.Printf("Received remote track from peer %s: %s", peerID, track.Kind().String())
-							},
-							OnPeerDisconnect: func(peerID string) {
-								log.Printf("Peer disconnected: %s", peerID)
-							},
-						})
-
-						videoTrack, audioTrack, err := videoStream.CreateWebRTCTracks()
-						if err != nil {
-							log.Printf("Failed to create WebRTC tracks: %v", err)
-						} else {
-							if videoTrack != nil {
-								webrtcManager.AddLocalTrack(videoTrack)
-							}
-							if audioTrack != nil {
-								webrtcManager.AddLocalTrack(audioTrack)
-							}
-						}
-
 						fyne.Do(func() {
 							videoLabel.Hide()
 							cameraBtn.Enable()
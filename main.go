@@ -1,9 +1,26 @@
 package main
 
 import (
+	"flag"
+	"log"
+
 	"github.com/javanhut/zero/gui"
+	"github.com/javanhut/zero/signaling"
 )
 
 func main() {
-	gui.Gui()
+	flag.Parse()
+
+	// The app is started with an invite link when one is opened.
+	var invite *signaling.Invite
+	if flag.NArg() > 0 {
+		parsed, err := signaling.ParseInvite(flag.Arg(0))
+		if err != nil {
+			log.Printf("Ignoring invite: %v", err)
+		} else {
+			invite = parsed
+		}
+	}
+
+	gui.Gui(invite)
 }
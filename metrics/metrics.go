@@ -0,0 +1,306 @@
+// Package metrics is a small collector that exposes counters, gauges and
+// histograms in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metrics and renders them for scraping.
+type Registry struct {
+	collectors []collector
+	mu         sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metrics: %s registered twice", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every registered metric, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.RUnlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].name() < collectors[j].name()
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.write(cw)
+	}
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if _, err := r.WriteTo(w); err != nil {
+			log.Printf("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Counter is a value that only goes up.
+type Counter struct {
+	metricName string
+	help       string
+	value      atomic.Uint64
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{metricName: name, help: help}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) name() string { return c.metricName }
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.metricName, c.Value())
+}
+
+// CounterVec is a family of counters told apart by the value of one label.
+type CounterVec struct {
+	metricName string
+	help       string
+	label      string
+	counters   map[string]*atomic.Uint64
+	mu         sync.RWMutex
+}
+
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		label:      label,
+		counters:   make(map[string]*atomic.Uint64),
+	}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValue string) {
+	c.mu.RLock()
+	counter, exists := c.counters[labelValue]
+	c.mu.RUnlock()
+
+	if !exists {
+		c.mu.Lock()
+		counter, exists = c.counters[labelValue]
+		if !exists {
+			counter = &atomic.Uint64{}
+			c.counters[labelValue] = counter
+		}
+		c.mu.Unlock()
+	}
+	counter.Add(1)
+}
+
+func (c *CounterVec) Value(labelValue string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counter, exists := c.counters[labelValue]
+	if !exists {
+		return 0
+	}
+	return counter.Load()
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.RLock()
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	c.mu.RUnlock()
+	sort.Strings(values)
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.metricName, c.label, labelEscaper.Replace(value), c.Value(value))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	metricName string
+	help       string
+	value      atomic.Int64
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{metricName: name, help: help}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+func (g *Gauge) name() string { return g.metricName }
+
+func (g *Gauge) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.metricName, g.Value())
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	metricName string
+	help       string
+	buckets    []float64
+	counts     []uint64
+	count      uint64
+	sum        float64
+	mu         sync.Mutex
+}
+
+// NewHistogram creates a histogram with the given upper bounds, which must
+// be sorted. A +Inf bucket is always added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		buckets:    append([]float64(nil), buckets...),
+		counts:     make([]uint64, len(buckets)),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations so far.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) name() string { return h.metricName }
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.metricName, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.metricName, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.metricName, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.metricName, count)
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerWritesTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("test_requests_total", "Requests by path.", "path")
+	registry.NewGauge("test_clients", "Open clients.").Set(3)
+	registry.NewCounter("test_errors_total", "Errors.\nBy kind.").Add(2)
+	latency := registry.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+
+	requests.Inc("/a")
+	requests.Inc("/a")
+	requests.Inc(`"b"`)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	ts := httptest.NewServer(registry.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := resp.Header.Get("Content-Type"); got != contentType {
+		t.Errorf("Content-Type = %q, want %q", got, contentType)
+	}
+
+	want := `# HELP test_clients Open clients.
+# TYPE test_clients gauge
+test_clients 3
+# HELP test_errors_total Errors.\nBy kind.
+# TYPE test_errors_total counter
+test_errors_total 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_requests_total Requests by path.
+# TYPE test_requests_total counter
+test_requests_total{path="\"b\""} 1
+test_requests_total{path="/a"} 2
+`
+	if string(body) != want {
+		t.Errorf("metrics output:\n%s\nwant:\n%s", body, want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	registry.NewGauge("test_total", "")
+}
@@ -0,0 +1,84 @@
+package playback
+
+/*
+#include <stdint.h>
+
+// Declared here instead of including <opus.h> so we only rely on the libopus
+// that pion/mediadevices already links into the binary.
+typedef struct OpusDecoder OpusDecoder;
+OpusDecoder *opus_decoder_create(int32_t Fs, int channels, int *error);
+int opus_decode(OpusDecoder *st, const unsigned char *data, int32_t len, int16_t *pcm, int frame_size, int decode_fec);
+void opus_decoder_destroy(OpusDecoder *st);
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	// Links libopus for the decoder functions declared above.
+	_ "github.com/pion/mediadevices/pkg/codec/opus"
+)
+
+// maxOpusFrameSize is 120ms at 48kHz, the longest frame Opus allows.
+const maxOpusFrameSize = 5760
+
+type opusDecoder struct {
+	engine   *C.OpusDecoder
+	channels int
+	pcm      []int16
+	mu       sync.Mutex
+}
+
+func newOpusDecoder(sampleRate, channels int) (*opusDecoder, error) {
+	var cerror C.int
+	engine := C.opus_decoder_create(C.int32_t(sampleRate), C.int(channels), &cerror)
+	if cerror != 0 || engine == nil {
+		return nil, fmt.Errorf("opus_decoder_create failed: %d", int(cerror))
+	}
+
+	return &opusDecoder{
+		engine:   engine,
+		channels: channels,
+		pcm:      make([]int16, maxOpusFrameSize*channels),
+	}, nil
+}
+
+// decode returns interleaved samples for one Opus packet. The returned slice
+// is only valid until the next call.
+func (d *opusDecoder) decode(packet []byte) ([]int16, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.engine == nil {
+		return nil, fmt.Errorf("opus decoder closed")
+	}
+	if len(packet) == 0 {
+		return nil, nil
+	}
+
+	n := C.opus_decode(
+		d.engine,
+		(*C.uchar)(unsafe.Pointer(&packet[0])),
+		C.int32_t(len(packet)),
+		(*C.int16_t)(unsafe.Pointer(&d.pcm[0])),
+		C.int(maxOpusFrameSize),
+		0,
+	)
+	if n < 0 {
+		return nil, fmt.Errorf("opus_decode failed: %d", int(n))
+	}
+
+	return d.pcm[:int(n)*d.channels], nil
+}
+
+func (d *opusDecoder) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.engine != nil {
+		C.opus_decoder_destroy(d.engine)
+		d.engine = nil
+	}
+}
@@ -0,0 +1,284 @@
+package playback
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	SampleRate = 48000
+	Channels   = 2
+
+	// FrameSize is the number of frames per 20ms mixing period.
+	FrameSize = SampleRate / 50
+
+	// maxBufferedSamples caps each peer's jitter buffer at 200ms so a
+	// stalled sink cannot make playback drift further and further behind.
+	maxBufferedSamples = SampleRate / 5 * Channels
+)
+
+type peerSource struct {
+	peerID  string
+	track   *webrtc.TrackRemote
+	decoder *opusDecoder
+	buffer  []int16
+	done    chan struct{}
+}
+
+type peerSettings struct {
+	volume float64
+	muted  bool
+}
+
+type Mixer struct {
+	sink    Sink
+	sources map[string]*peerSource
+	// settings outlive sources, so a peer's volume and mute survive
+	// renegotiation and can be set before its audio arrives.
+	settings map[string]*peerSettings
+	// acc is Mix's accumulator, kept between calls so the audio callback
+	// does not allocate.
+	acc    []float64
+	mu     sync.Mutex
+	closed bool
+}
+
+type MixerConfig struct {
+	Sink Sink
+}
+
+func NewMixer(config MixerConfig) (*Mixer, error) {
+	sink := config.Sink
+	if sink == nil {
+		sink = NewNullSink()
+	}
+
+	m := &Mixer{
+		sink:     sink,
+		sources:  make(map[string]*peerSource),
+		settings: make(map[string]*peerSettings),
+	}
+
+	if err := sink.Start(m); err != nil {
+		return nil, fmt.Errorf("failed to start audio sink: %w", err)
+	}
+
+	log.Printf("Started audio mixer (%s)", sink.Name())
+	return m, nil
+}
+
+// AddTrack decodes an Opus track from peerID into the mix. A second track
+// from the same peer replaces the first.
+func (m *Mixer) AddTrack(peerID string, track *webrtc.TrackRemote) error {
+	mimeType := track.Codec().MimeType
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+		return fmt.Errorf("unsupported remote audio codec: %s", mimeType)
+	}
+
+	decoder, err := newOpusDecoder(SampleRate, Channels)
+	if err != nil {
+		return err
+	}
+
+	source := &peerSource{
+		peerID:  peerID,
+		track:   track,
+		decoder: decoder,
+		done:    make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		decoder.close()
+		return fmt.Errorf("mixer closed")
+	}
+	old := m.sources[peerID]
+	m.sources[peerID] = source
+	m.mu.Unlock()
+
+	if old != nil {
+		close(old.done)
+	}
+
+	go m.readTrack(source)
+
+	log.Printf("Added remote audio from peer %s to mixer", peerID)
+	return nil
+}
+
+func (m *Mixer) readTrack(source *peerSource) {
+	defer source.decoder.close()
+
+	for {
+		select {
+		case <-source.done:
+			return
+		default:
+		}
+
+		packet, _, err := source.track.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Remote audio from peer %s ended: %v", source.peerID, err)
+			}
+			m.removeSource(source)
+			return
+		}
+
+		pcm, err := source.decoder.decode(packet.Payload)
+		if err != nil {
+			log.Printf("Failed to decode audio from peer %s: %v", source.peerID, err)
+			continue
+		}
+
+		m.mu.Lock()
+		source.buffer = append(source.buffer, pcm...)
+		if overflow := len(source.buffer) - maxBufferedSamples; overflow > 0 {
+			source.buffer = source.buffer[overflow:]
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Mixer) removeSource(source *peerSource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sources[source.peerID] == source {
+		delete(m.sources, source.peerID)
+	}
+}
+
+// RemovePeer stops mixing peerID's audio. Its volume and mute are kept for
+// when it comes back.
+func (m *Mixer) RemovePeer(peerID string) {
+	m.mu.Lock()
+	source, exists := m.sources[peerID]
+	delete(m.sources, peerID)
+	m.mu.Unlock()
+
+	if exists {
+		close(source.done)
+		log.Printf("Removed remote audio from peer %s", peerID)
+	}
+}
+
+// settingsLocked returns peerID's settings, creating the defaults if it
+// has none yet.
+func (m *Mixer) settingsLocked(peerID string) *peerSettings {
+	settings, exists := m.settings[peerID]
+	if !exists {
+		settings = &peerSettings{volume: 1.0}
+		m.settings[peerID] = settings
+	}
+	return settings
+}
+
+// SetVolume sets peerID's volume, also before its audio has arrived.
+func (m *Mixer) SetVolume(peerID string, volume float64) error {
+	if volume < 0 {
+		volume = 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settingsLocked(peerID).volume = volume
+	return nil
+}
+
+func (m *Mixer) GetVolume(peerID string) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if settings, exists := m.settings[peerID]; exists {
+		return settings.volume, nil
+	}
+	return 1.0, nil
+}
+
+func (m *Mixer) SetMuted(peerID string, muted bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settingsLocked(peerID).muted = muted
+	return nil
+}
+
+func (m *Mixer) IsMuted(peerID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	settings, exists := m.settings[peerID]
+	return exists && settings.muted
+}
+
+// Mix fills out with the next len(out)/Channels frames of interleaved audio,
+// summing every peer at its volume. Peers without enough buffered audio
+// contribute silence for the missing part.
+func (m *Mixer) Mix(out []int16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cap(m.acc) < len(out) {
+		m.acc = make([]float64, len(out))
+	}
+	acc := m.acc[:len(out)]
+	clear(acc)
+
+	for peerID, source := range m.sources {
+		n := min(len(out), len(source.buffer))
+
+		volume, muted := 1.0, false
+		if settings := m.settings[peerID]; settings != nil {
+			volume, muted = settings.volume, settings.muted
+		}
+		if !muted && volume > 0 {
+			for i := 0; i < n; i++ {
+				acc[i] += float64(source.buffer[i]) * volume
+			}
+		}
+
+		source.buffer = source.buffer[n:]
+	}
+
+	for i, v := range acc {
+		out[i] = int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, v)))
+	}
+}
+
+func (m *Mixer) GetPeers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peerIDs := make([]string, 0, len(m.sources))
+	for peerID := range m.sources {
+		peerIDs = append(peerIDs, peerID)
+	}
+	return peerIDs
+}
+
+func (m *Mixer) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	sources := m.sources
+	m.sources = make(map[string]*peerSource)
+	m.mu.Unlock()
+
+	for _, source := range sources {
+		close(source.done)
+	}
+
+	log.Println("Stopped audio mixer")
+	return m.sink.Close()
+}
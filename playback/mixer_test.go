@@ -0,0 +1,187 @@
+package playback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addTestSource puts buffered audio for peerID straight into the mix, as if
+// it had been decoded from a track.
+func addTestSource(m *Mixer, peerID string, samples []int16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sources[peerID] = &peerSource{peerID: peerID, buffer: samples, done: make(chan struct{})}
+}
+
+func constantSamples(value int16, n int) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = value
+	}
+	return samples
+}
+
+func TestMixSumsPeersAtTheirVolume(t *testing.T) {
+	m, err := NewMixer(MixerConfig{Sink: NewNullSink()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// Stop the sink pulling audio, so the test is the only reader.
+	m.sink.Close()
+
+	addTestSource(m, "a", constantSamples(1000, 8))
+	addTestSource(m, "b", constantSamples(3000, 4))
+	if err := m.SetVolume("a", 0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]int16, 8)
+	m.Mix(out)
+	for i, sample := range out {
+		want := int16(500)
+		if i < 4 {
+			want += 3000
+		}
+		if sample != want {
+			t.Fatalf("sample %d = %d, want %d", i, sample, want)
+		}
+	}
+
+	if err := m.SetMuted("a", true); err != nil {
+		t.Fatal(err)
+	}
+	addTestSource(m, "a", constantSamples(1000, 8))
+	m.Mix(out)
+	for i, sample := range out {
+		if sample != 0 {
+			t.Fatalf("sample %d = %d with the only peer muted", i, sample)
+		}
+	}
+}
+
+func TestMixClipsToInt16(t *testing.T) {
+	m, err := NewMixer(MixerConfig{Sink: NewNullSink()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sink.Close()
+
+	addTestSource(m, "a", constantSamples(30000, 2))
+	addTestSource(m, "b", constantSamples(30000, 2))
+
+	out := make([]int16, 2)
+	m.Mix(out)
+	if out[0] != 32767 || out[1] != 32767 {
+		t.Fatalf("mix = %v, want clipped to 32767", out)
+	}
+}
+
+func TestMixDoesNotAllocate(t *testing.T) {
+	m, err := NewMixer(MixerConfig{Sink: NewNullSink()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.sink.Close()
+
+	addTestSource(m, "a", constantSamples(1000, FrameSize*Channels*10))
+	out := make([]int16, FrameSize*Channels)
+	m.Mix(out)
+
+	if allocs := testing.AllocsPerRun(5, func() { m.Mix(out) }); allocs != 0 {
+		t.Fatalf("Mix allocated %v times per call", allocs)
+	}
+}
+
+func TestSettingsOutliveSources(t *testing.T) {
+	m, err := NewMixer(MixerConfig{Sink: NewNullSink()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Before the peer's first track.
+	if err := m.SetVolume("a", 0.25); err != nil {
+		t.Fatalf("SetVolume before audio: %v", err)
+	}
+	if err := m.SetMuted("a", true); err != nil {
+		t.Fatalf("SetMuted before audio: %v", err)
+	}
+
+	addTestSource(m, "a", nil)
+	m.RemovePeer("a")
+
+	volume, err := m.GetVolume("a")
+	if err != nil || volume != 0.25 {
+		t.Fatalf("volume after RemovePeer = %v, %v; want 0.25", volume, err)
+	}
+	if !m.IsMuted("a") {
+		t.Fatal("mute lost after RemovePeer")
+	}
+}
+
+func TestWAVSinkRecordsMix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mix.wav")
+	m, err := NewMixer(MixerConfig{Sink: NewWAVSink(path)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestSource(m, "a", constantSamples(1234, FrameSize*Channels))
+
+	// Wait until the first frame, which holds all of the source, is mixed.
+	for {
+		m.mu.Lock()
+		drained := len(m.sources["a"].buffer) == 0
+		m.mu.Unlock()
+		if drained {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < wavHeaderSize+FrameSize*Channels*2 {
+		t.Fatalf("wav file is %d bytes, want at least one frame", len(data))
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" || string(data[36:40]) != "data" {
+		t.Fatalf("bad wav header: %q", data[:wavHeaderSize])
+	}
+	dataSize := binary.LittleEndian.Uint32(data[40:])
+	if int(dataSize) != len(data)-wavHeaderSize {
+		t.Fatalf("header data size %d, file holds %d", dataSize, len(data)-wavHeaderSize)
+	}
+	if channels := binary.LittleEndian.Uint16(data[22:]); channels != Channels {
+		t.Fatalf("header channels = %d", channels)
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:]); rate != SampleRate {
+		t.Fatalf("header sample rate = %d", rate)
+	}
+
+	samples := make([]int16, (len(data)-wavHeaderSize)/2)
+	binary.Read(bytes.NewReader(data[wavHeaderSize:]), binary.LittleEndian, samples)
+	// Frames mixed before the source was added are silent.
+	start := 0
+	for start < len(samples) && samples[start] == 0 {
+		start++
+	}
+	if len(samples)-start < FrameSize*Channels {
+		t.Fatalf("recorded %d samples of the source, want %d", len(samples)-start, FrameSize*Channels)
+	}
+	for i, sample := range samples[start : start+FrameSize*Channels] {
+		if sample != 1234 {
+			t.Fatalf("sample %d = %d, want 1234", i, sample)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package playback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gen2brain/malgo"
+)
+
+// Sink is where the mixer's output ends up. Start is called once by
+// NewMixer; the sink then pulls audio from the mixer at its own pace.
+type Sink interface {
+	Name() string
+	Start(m *Mixer) error
+	Close() error
+}
+
+// NewSink builds a sink from its config name: "device" (the default),
+// "null", or "wav" writing to path.
+func NewSink(name, path string) (Sink, error) {
+	switch name {
+	case "", "device":
+		return NewDeviceSink(), nil
+	case "null":
+		return NewNullSink(), nil
+	case "wav":
+		if path == "" {
+			return nil, fmt.Errorf("wav audio output needs a file path")
+		}
+		return NewWAVSink(path), nil
+	default:
+		return nil, fmt.Errorf("unknown audio output: %s", name)
+	}
+}
+
+// DeviceSink plays the mix on the default output device through miniaudio.
+type DeviceSink struct {
+	ctx    *malgo.AllocatedContext
+	device *malgo.Device
+	buffer []int16
+	mu     sync.Mutex
+}
+
+func NewDeviceSink() *DeviceSink {
+	return &DeviceSink{}
+}
+
+func (s *DeviceSink) Name() string {
+	return "device"
+}
+
+func (s *DeviceSink) Start(m *Mixer) error {
+	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to init audio context: %w", err)
+	}
+
+	deviceConfig := malgo.DefaultDeviceConfig(malgo.Playback)
+	deviceConfig.Playback.Format = malgo.FormatS16
+	deviceConfig.Playback.Channels = Channels
+	deviceConfig.SampleRate = SampleRate
+
+	device, err := malgo.InitDevice(ctx.Context, deviceConfig, malgo.DeviceCallbacks{
+		Data: func(output, input []byte, frameCount uint32) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			samples := int(frameCount) * Channels
+			if cap(s.buffer) < samples {
+				s.buffer = make([]int16, samples)
+			}
+			s.buffer = s.buffer[:samples]
+
+			m.Mix(s.buffer)
+			for i, sample := range s.buffer {
+				binary.LittleEndian.PutUint16(output[i*2:], uint16(sample))
+			}
+		},
+	})
+	if err != nil {
+		ctx.Uninit()
+		ctx.Free()
+		return fmt.Errorf("failed to init playback device: %w", err)
+	}
+
+	if err := device.Start(); err != nil {
+		device.Uninit()
+		ctx.Uninit()
+		ctx.Free()
+		return fmt.Errorf("failed to start playback device: %w", err)
+	}
+
+	s.ctx = ctx
+	s.device = device
+	return nil
+}
+
+func (s *DeviceSink) Close() error {
+	if s.device != nil {
+		s.device.Uninit()
+		s.device = nil
+	}
+	if s.ctx != nil {
+		s.ctx.Uninit()
+		s.ctx.Free()
+		s.ctx = nil
+	}
+	return nil
+}
+
+// tickerSink drives the mixer from a 20ms ticker for sinks that have no
+// hardware clock of their own.
+type tickerSink struct {
+	write    func([]int16) error
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+func (t *tickerSink) start(m *Mixer) {
+	t.stopChan = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(time.Second * FrameSize / SampleRate)
+		defer ticker.Stop()
+
+		frame := make([]int16, FrameSize*Channels)
+		for {
+			select {
+			case <-t.stopChan:
+				return
+			case <-ticker.C:
+				m.Mix(frame)
+				if err := t.write(frame); err != nil {
+					log.Printf("Failed to write audio frame: %v", err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (t *tickerSink) stop() {
+	if t.stopChan == nil {
+		return
+	}
+	close(t.stopChan)
+	<-t.done
+	t.stopChan = nil
+}
+
+// NullSink consumes the mix in real time and discards it.
+type NullSink struct {
+	tickerSink
+}
+
+func NewNullSink() *NullSink {
+	s := &NullSink{}
+	s.write = func([]int16) error { return nil }
+	return s
+}
+
+func (s *NullSink) Name() string {
+	return "null"
+}
+
+func (s *NullSink) Start(m *Mixer) error {
+	s.start(m)
+	return nil
+}
+
+func (s *NullSink) Close() error {
+	s.stop()
+	return nil
+}
+
+// WAVSink records the mix to a 16-bit PCM WAV file.
+type WAVSink struct {
+	tickerSink
+	path         string
+	file         *os.File
+	bytesWritten uint32
+}
+
+const wavHeaderSize = 44
+
+func NewWAVSink(path string) *WAVSink {
+	s := &WAVSink{path: path}
+	s.write = s.writeFrame
+	return s
+}
+
+func (s *WAVSink) Name() string {
+	return fmt.Sprintf("wav:%s", s.path)
+}
+
+func (s *WAVSink) Start(m *Mixer) error {
+	file, err := os.Create(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to create wav file: %w", err)
+	}
+
+	s.file = file
+	if err := s.writeHeader(); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(wavHeaderSize, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek wav file: %w", err)
+	}
+
+	s.start(m)
+	return nil
+}
+
+func (s *WAVSink) writeFrame(frame []int16) error {
+	if err := binary.Write(s.file, binary.LittleEndian, frame); err != nil {
+		return err
+	}
+	s.bytesWritten += uint32(len(frame) * 2)
+	return nil
+}
+
+func (s *WAVSink) writeHeader() error {
+	const bitsPerSample = 16
+	blockAlign := Channels * bitsPerSample / 8
+
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 36+s.bytesWritten)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1)
+	binary.LittleEndian.PutUint16(header[22:], Channels)
+	binary.LittleEndian.PutUint32(header[24:], SampleRate)
+	binary.LittleEndian.PutUint32(header[28:], uint32(SampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], bitsPerSample)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], s.bytesWritten)
+
+	if _, err := s.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("failed to write wav header: %w", err)
+	}
+	return nil
+}
+
+func (s *WAVSink) Close() error {
+	s.stop()
+
+	if s.file == nil {
+		return nil
+	}
+
+	// Rewrite the header now that the data size is known.
+	headerErr := s.writeHeader()
+	closeErr := s.file.Close()
+	s.file = nil
+
+	if headerErr != nil {
+		return headerErr
+	}
+	return closeErr
+}
@@ -0,0 +1,175 @@
+// Package profile keeps the local user's display name, color and avatar in
+// the user's config directory.
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/javanhut/zero/signaling"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	dirName    = "zero"
+	fileName   = "profile.yaml"
+	avatarName = "avatar.jpg"
+
+	// AvatarSize is the width and height avatars are scaled to.
+	AvatarSize = 64
+)
+
+type Profile struct {
+	DisplayName string `yaml:"display_name"`
+	// Color is the accent shown around the user's tile, as #rrggbb.
+	Color string `yaml:"color"`
+	// Avatar is a JPEG image, stored next to the profile.
+	Avatar []byte `yaml:"-"`
+}
+
+// Dir returns the directory profiles are stored in.
+func Dir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config directory: %w", err)
+	}
+	return filepath.Join(dir, dirName), nil
+}
+
+// Load reads the saved profile, returning an empty one if none was saved.
+func Load() (*Profile, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	var profile Profile
+	data, err := os.ReadFile(filepath.Join(dir, fileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &profile, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse profile: %w", err)
+	}
+
+	avatar, err := os.ReadFile(filepath.Join(dir, avatarName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read avatar: %w", err)
+	}
+	profile.Avatar = avatar
+	return &profile, nil
+}
+
+// Save writes the profile, removing the stored avatar if it has none.
+func (p *Profile) Save() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create profile directory: %w", err)
+	}
+
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal profile: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, fileName), data, 0o600); err != nil {
+		return fmt.Errorf("failed to write profile: %w", err)
+	}
+
+	avatarPath := filepath.Join(dir, avatarName)
+	if len(p.Avatar) == 0 {
+		if err := os.Remove(avatarPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove avatar: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(avatarPath, p.Avatar, 0o600); err != nil {
+		return fmt.Errorf("failed to write avatar: %w", err)
+	}
+	return nil
+}
+
+// SetAvatarFromFile loads a PNG or JPEG image, crops it to a square and
+// scales it down to AvatarSize, small enough to send to every peer.
+func (p *Profile) SetAvatarFromFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open avatar: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode avatar: %w", err)
+	}
+	if img.Bounds().Empty() {
+		return fmt.Errorf("avatar image is empty")
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleSquare(img, AvatarSize), &jpeg.Options{Quality: 85}); err != nil {
+		return fmt.Errorf("failed to encode avatar: %w", err)
+	}
+	if buf.Len() > signaling.MaxAvatarSize {
+		return fmt.Errorf("avatar is larger than %d bytes after scaling", signaling.MaxAvatarSize)
+	}
+	p.Avatar = buf.Bytes()
+	return nil
+}
+
+// scaleSquare crops the center square of img and box-filters it to
+// size x size.
+func scaleSquare(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := range size {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		sy1 = max(sy1, sy0+1)
+		for x := range size {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			sx1 = max(sx1, sx0+1)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// Signaling returns the profile as it is sent to the signaling server.
+func (p *Profile) Signaling() signaling.Profile {
+	return signaling.Profile{
+		DisplayName: p.DisplayName,
+		Color:       p.Color,
+		Avatar:      p.Avatar,
+	}
+}
@@ -1,19 +1,24 @@
 package sessionmanager
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/javanhut/zero/signaling"
 )
 
 type Peer struct {
 	PeerID    string
 	Username  string
+	Role      string
 	Connected bool
 	JoinedAt  time.Time
+	// Color and Avatar come from the peer's profile and may be empty.
+	Color  string
+	Avatar []byte
 }
 
 type SessionInfo struct {
@@ -21,16 +26,36 @@ type SessionInfo struct {
 	Peers     map[string]*Peer
 	CreatedAt time.Time
 	Active    int
+	// MaxPeers is the session's capacity, or zero if unlimited.
+	MaxPeers int
+	// UseSFU is set by the server once the session is too big for a mesh.
+	UseSFU bool
+	// Locked is set while the session refuses new peers.
+	Locked bool
+	// Lobby is set if new participants wait for a host to admit them.
+	Lobby bool
+	// PasscodeRequired is set if joining takes the session's passcode.
+	PasscodeRequired bool
+	// Code is the session's meeting code, or empty once it has expired.
+	Code          string
+	CodeExpiresAt time.Time
 }
 
+// SessionManager is a local cache of sessions held by the signaling server.
+// Sessions are created and looked up through the server, and Track keeps the
+// cache in step with the server's presence events.
 type SessionManager struct {
-	sessions map[string]*SessionInfo
-	mu       sync.RWMutex
+	serverURL string
+	sessions  map[string]*SessionInfo
+	mu        sync.RWMutex
 }
 
-func New() *SessionManager {
+// New returns a cache backed by the signaling server at serverURL, its
+// websocket URL.
+func New(serverURL string) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*SessionInfo),
+		serverURL: serverURL,
+		sessions:  make(map[string]*SessionInfo),
 	}
 }
 
@@ -63,46 +88,156 @@ func (sm *SessionManager) GetUsername(sessionID string) string {
 	return "Unknown User"
 }
 
-func (sm *SessionManager) CreateNewSession() (string, string) {
+// CreateNewSession creates an empty session on the server with the given
+// options and caches it. The returned token joins it as its host.
+func (sm *SessionManager) CreateNewSession(options signaling.CreateSessionRequest) (*SessionInfo, *signaling.TokenResponse, error) {
+	info, err := signaling.CreateSession(sm.serverURL, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session := sm.store(&info.SessionInfoPayload)
+	log.Printf("Created new session with id: %s", session.SessionID)
+	return session, &info.Host, nil
+}
+
+// JoinSession looks a session up on the server by its ID or meeting code,
+// so sessions created on any machine can be joined, and caches the result.
+// The actual join happens over signaling with a join token, for the
+// SessionID of the result. The server only says who is in the session once
+// joined, when Track fills the peers in.
+func (sm *SessionManager) JoinSession(sessionIDOrCode string) (*SessionInfo, error) {
+	lookup, err := signaling.LookupSession(sm.serverURL, sessionIDOrCode)
+	if err != nil {
+		return nil, err
+	}
+
+	session := sm.store(&signaling.SessionInfoPayload{
+		SessionID:        lookup.SessionID,
+		Locked:           lookup.Locked,
+		Lobby:            lookup.Lobby,
+		PasscodeRequired: lookup.PasscodeRequired,
+	})
+	log.Printf("Found session %s", session.SessionID)
+	return session, nil
+}
+
+// Track keeps the cached entry for client's session in sync with the
+// server's session_info, peer_joined, peer_left, role_changed and
+// profile_update messages.
+func (sm *SessionManager) Track(client *signaling.Client) {
+	client.On(signaling.MessageTypeSessionInfo, func(msg *signaling.SignalingMessage) {
+		var payload signaling.SessionInfoPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal session info: %v", err)
+			return
+		}
+		sm.store(&payload)
+	})
+
+	client.On(signaling.MessageTypePeerJoined, func(msg *signaling.SignalingMessage) {
+		var payload signaling.PeerJoinedPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal peer joined payload: %v", err)
+			return
+		}
+		if err := sm.AddPeerToSession(msg.SessionID, payload.PeerID, payload.Username); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+		if err := sm.SetPeerRole(msg.SessionID, payload.PeerID, payload.Role); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+		profile := signaling.Profile{DisplayName: payload.Username, Color: payload.Color, Avatar: payload.Avatar}
+		if err := sm.SetPeerProfile(msg.SessionID, payload.PeerID, profile); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+	})
+
+	client.On(signaling.MessageTypeProfileUpdate, func(msg *signaling.SignalingMessage) {
+		var payload signaling.ProfileUpdatePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal profile update payload: %v", err)
+			return
+		}
+		if err := sm.SetPeerProfile(msg.SessionID, payload.PeerID, payload.Profile); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+	})
+
+	client.On(signaling.MessageTypeRoleChanged, func(msg *signaling.SignalingMessage) {
+		var payload signaling.RoleChangedPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal role changed payload: %v", err)
+			return
+		}
+		if err := sm.SetPeerRole(msg.SessionID, payload.PeerID, payload.Role); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+	})
+
+	client.On(signaling.MessageTypePeerLeft, func(msg *signaling.SignalingMessage) {
+		var payload signaling.PeerLeftPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			log.Printf("Failed to unmarshal peer left payload: %v", err)
+			return
+		}
+		if err := sm.RemovePeerFromSession(msg.SessionID, payload.PeerID); err != nil {
+			log.Printf("Session cache out of sync: %v", err)
+		}
+	})
+}
+
+func (sm *SessionManager) store(info *signaling.SessionInfoPayload) *SessionInfo {
+	session := fromPayload(info)
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	sm.sessions[session.SessionID] = session
+	return session
+}
 
-	sessionID := uuid.New().String()
-	peerID := uuid.New().String()
-	username := fmt.Sprintf("User_%s", peerID[:8])
-
+func fromPayload(info *signaling.SessionInfoPayload) *SessionInfo {
 	session := &SessionInfo{
-		SessionID: sessionID,
-		Peers:     make(map[string]*Peer),
-		CreatedAt: time.Now(),
-		Active:    1,
+		SessionID: info.SessionID,
+		Peers:     make(map[string]*Peer, len(info.Peers)),
+		CreatedAt: info.CreatedAt,
+		Active:    len(info.Peers),
+		MaxPeers:  info.MaxPeers,
+		UseSFU:    info.UseSFU,
+		Locked:    info.Locked,
+		Lobby:     info.Lobby,
+
+		PasscodeRequired: info.PasscodeRequired,
+		Code:             info.Code,
+		CodeExpiresAt:    info.CodeExpiresAt,
 	}
 
-	session.Peers[peerID] = &Peer{
-		PeerID:    peerID,
-		Username:  username,
-		Connected: true,
-		JoinedAt:  time.Now(),
+	for _, peer := range info.Peers {
+		session.Peers[peer.PeerID] = &Peer{
+			PeerID:    peer.PeerID,
+			Username:  peer.Username,
+			Role:      peer.Role,
+			Connected: true,
+			JoinedAt:  peer.JoinedAt,
+			Color:     peer.Color,
+			Avatar:    peer.Avatar,
+		}
 	}
-
-	sm.sessions[sessionID] = session
-	sessionString := fmt.Sprintf("Created new session with id: %s for user: %s (peer: %s)", sessionID, username, peerID)
-	log.Println(sessionString)
-
-	return sessionID, username
+	return session
 }
 
-func (sm *SessionManager) JoinSession(sessionID string) (string, string, error) {
+func (sm *SessionManager) AddPeerToSession(sessionID, peerID, username string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
 	session, ok := sm.sessions[sessionID]
 	if !ok {
-		return "", "", fmt.Errorf("session %s not found", sessionID)
+		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	peerID := uuid.New().String()
-	username := fmt.Sprintf("User_%s", peerID[:8])
+	if _, exists := session.Peers[peerID]; exists {
+		return fmt.Errorf("peer %s already in session", peerID)
+	}
 
 	session.Peers[peerID] = &Peer{
 		PeerID:    peerID,
@@ -112,12 +247,11 @@ func (sm *SessionManager) JoinSession(sessionID string) (string, string, error)
 	}
 
 	session.Active = len(session.Peers)
-	log.Printf("User %s (peer: %s) joined session %s", username, peerID, sessionID)
-
-	return peerID, username, nil
+	log.Printf("Added peer %s (%s) to session %s", peerID, username, sessionID)
+	return nil
 }
 
-func (sm *SessionManager) AddPeerToSession(sessionID, peerID, username string) error {
+func (sm *SessionManager) SetPeerRole(sessionID, peerID, role string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -126,22 +260,67 @@ func (sm *SessionManager) AddPeerToSession(sessionID, peerID, username string) e
 		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	if _, exists := session.Peers[peerID]; exists {
-		return fmt.Errorf("peer %s already in session", peerID)
+	peer, ok := session.Peers[peerID]
+	if !ok {
+		return fmt.Errorf("peer %s not in session", peerID)
 	}
+	peer.Role = role
+	return nil
+}
 
-	session.Peers[peerID] = &Peer{
-		PeerID:    peerID,
-		Username:  username,
-		Connected: true,
-		JoinedAt:  time.Now(),
+// SetPeerProfile updates the cached name, color and avatar of peerID.
+func (sm *SessionManager) SetPeerProfile(sessionID, peerID string, profile signaling.Profile) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	session, ok := sm.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	session.Active = len(session.Peers)
-	log.Printf("Added peer %s (%s) to session %s", peerID, username, sessionID)
+	peer, ok := session.Peers[peerID]
+	if !ok {
+		return fmt.Errorf("peer %s not in session", peerID)
+	}
+	if profile.DisplayName != "" {
+		peer.Username = profile.DisplayName
+	}
+	peer.Color = profile.Color
+	peer.Avatar = profile.Avatar
 	return nil
 }
 
+// GetPeer returns a copy of the cached entry for peerID.
+func (sm *SessionManager) GetPeer(sessionID, peerID string) (Peer, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.sessions[sessionID]
+	if !ok {
+		return Peer{}, false
+	}
+	peer, ok := session.Peers[peerID]
+	if !ok {
+		return Peer{}, false
+	}
+	return *peer, true
+}
+
+// GetPeerRole returns the cached role of peerID, or "" if it is unknown.
+func (sm *SessionManager) GetPeerRole(sessionID, peerID string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.sessions[sessionID]
+	if !ok {
+		return ""
+	}
+	if peer, ok := session.Peers[peerID]; ok {
+		return peer.Role
+	}
+	return ""
+}
+
 func (sm *SessionManager) RemovePeerFromSession(sessionID, peerID string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -208,16 +387,41 @@ func (sm *SessionManager) DeleteSession(sessionID string) {
 	log.Println(deletedStr)
 }
 
-func (sm *SessionManager) GetAllSessions() []*SessionInfo {
+// GetAllSessions returns the sessions the server lists for anyone to join,
+// followed by the ones this client created or joined that it does not list.
+// Cached entries are used where they exist, since they know the peers.
+func (sm *SessionManager) GetAllSessions() ([]*SessionInfo, error) {
+	lookups, err := signaling.ListSessions(sm.serverURL)
+	if err != nil {
+		return nil, err
+	}
+
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	sessions := make([]*SessionInfo, 0, len(sm.sessions))
+	sessions := make([]*SessionInfo, 0, len(lookups)+len(sm.sessions))
+	listed := make(map[string]bool, len(lookups))
+	for _, lookup := range lookups {
+		listed[lookup.SessionID] = true
+		if session, ok := sm.sessions[lookup.SessionID]; ok {
+			sessions = append(sessions, session)
+			continue
+		}
+		sessions = append(sessions, fromPayload(&signaling.SessionInfoPayload{
+			SessionID:        lookup.SessionID,
+			CreatedAt:        lookup.CreatedAt,
+			Locked:           lookup.Locked,
+			Lobby:            lookup.Lobby,
+			PasscodeRequired: lookup.PasscodeRequired,
+		}))
+	}
 	for _, session := range sm.sessions {
-		sessions = append(sessions, session)
+		if !listed[session.SessionID] {
+			sessions = append(sessions, session)
+		}
 	}
 
-	return sessions
+	return sessions, nil
 }
 
 func (sm *SessionManager) UpdatePeerConnection(sessionID, peerID string, connected bool) error {
@@ -0,0 +1,307 @@
+package signaling
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// NoticeRequest is the body of a POST to /admin/sessions/{id}/notice.
+type NoticeRequest struct {
+	Message string `json:"message"`
+}
+
+// LockRequest is the body of a PUT to /admin/sessions/{id}/lock.
+type LockRequest struct {
+	Locked bool `json:"locked"`
+}
+
+// LobbyRequest is the body of a PUT to /admin/sessions/{id}/lobby.
+type LobbyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// requireAdmin only lets requests carrying the admin token through. The
+// admin API is disabled altogether when no token is configured.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeJSONError(w, http.StatusNotFound, ErrorCodeBadRequest, "admin API is disabled")
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// HandleAdminListSessions lists every session with its peers.
+func (s *Server) HandleAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	infos := make([]SessionInfoPayload, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, s.sessionInfo(session).withoutAvatars())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// HandleAdminGetSession describes one session, found by its ID or meeting
+// code, with its peers.
+func (s *Server) HandleAdminGetSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	session := s.findSession(sessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeSessionNotFound, fmt.Sprintf("session %s not found", sessionID))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.sessionInfo(session).withoutAvatars())
+}
+
+// HandleAdminKickPeer removes a peer from a session and keeps it from
+// rejoining.
+func (s *Server) HandleAdminKickPeer(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.adminSession(w, r)
+	if !ok {
+		return
+	}
+	peerID := r.PathValue("peerID")
+
+	session.mu.RLock()
+	_, local := session.clients[peerID]
+	_, remote := session.remote[peerID]
+	session.mu.RUnlock()
+
+	if !local && !remote {
+		writeJSONError(w, http.StatusNotFound, ErrorCodePeerNotFound, fmt.Sprintf("peer %s not found in session", peerID))
+		return
+	}
+
+	// Every node bans the peer; the one it is connected to removes it.
+	s.kickPeer(session, peerID)
+	s.publish(clusterEvent{Kind: eventKick, SessionID: session.id, PeerID: peerID})
+
+	log.Printf("Admin kicked %s from session %s", peerID, session.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kickPeer bans peerID from the session and removes it if it is connected
+// here. A kicked user can get a new peer ID from /token, so the session is
+// also guarded: while a host or co-host is there, new participants wait
+// for one of them to admit them.
+func (s *Server) kickPeer(session *Session, peerID string) {
+	session.mu.Lock()
+	session.removed[peerID] = true
+	guardAdded := !session.guarded && !session.lobby
+	session.guarded = true
+	client, exists := session.clients[peerID]
+	if exists && client.expiry != nil {
+		client.expiry.Stop()
+	}
+	session.mu.Unlock()
+
+	if exists {
+		if s.removeClient(client) {
+			s.notifyPeerLeft(session.id, peerID)
+		}
+		s.sendNotice(client, MessageTypeKicked, "you were removed from the session")
+		client.closeAfterFlush(websocket.CloseNormalClosure, "removed from session")
+	}
+	if guardAdded {
+		s.sendSessionInfoToAll(session, "")
+	}
+}
+
+// HandleAdminCloseSession ends a session for everyone in it.
+func (s *Server) HandleAdminCloseSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	if !s.closeSession(sessionID) {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeSessionNotFound, fmt.Sprintf("session %s not found", sessionID))
+		return
+	}
+	s.publish(clusterEvent{Kind: eventSessionClosed, SessionID: sessionID})
+
+	log.Printf("Admin closed session %s", sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// closeSession deletes the session and disconnects its peers on this node.
+func (s *Server) closeSession(sessionID string) bool {
+	s.mu.Lock()
+	session, exists := s.sessions[sessionID]
+	delete(s.sessions, sessionID)
+	if exists {
+		s.forgetMeetingCode(session)
+	}
+	s.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+	s.metrics.SessionClosed()
+
+	session.mu.Lock()
+	clients := make([]*ServerClient, 0, len(session.clients))
+	for _, client := range session.clients {
+		if client.expiry != nil {
+			client.expiry.Stop()
+		}
+		clients = append(clients, client)
+	}
+	session.clients = make(map[string]*ServerClient)
+	session.remote = make(map[string]remotePeer)
+	session.mu.Unlock()
+	s.peerCount.Add(-int64(len(clients)))
+
+	for _, client := range clients {
+		s.sendNotice(client, MessageTypeSessionClosed, "the session was closed")
+		client.closeAfterFlush(websocket.CloseNormalClosure, "session closed")
+	}
+	s.closeLobby(session, "the session was closed")
+	return true
+}
+
+// HandleAdminNotice broadcasts a system notice to everyone in a session.
+func (s *Server) HandleAdminNotice(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.adminSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req NoticeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Message == "" {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "message is required")
+		return
+	}
+
+	s.sendNoticeToSession(session, req.Message)
+	s.publish(clusterEvent{Kind: eventNotice, SessionID: session.id, Message: req.Message})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminLock locks or unlocks a session.
+func (s *Server) HandleAdminLock(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.adminSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req LockRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "invalid lock request")
+		return
+	}
+
+	s.setLocked(session, req.Locked)
+	s.publish(clusterEvent{Kind: eventRoomLocked, SessionID: session.id, Locked: req.Locked})
+
+	log.Printf("Admin set session %s locked: %v", session.id, req.Locked)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminLobby turns a session's lobby on or off. Turning it off lets
+// in everyone waiting and lifts the lobby a kick put up.
+func (s *Server) HandleAdminLobby(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.adminSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req LobbyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "invalid lobby request")
+		return
+	}
+
+	s.setLobby(session, req.Enabled)
+	s.publish(clusterEvent{Kind: eventLobbyChanged, SessionID: session.id, Lobby: req.Enabled})
+
+	log.Printf("Admin set session %s lobby: %v", session.id, req.Enabled)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAdminAdmit lets a peer waiting in a session's lobby in.
+func (s *Server) HandleAdminAdmit(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.adminSession(w, r)
+	if !ok {
+		return
+	}
+	peerID := r.PathValue("peerID")
+
+	if err := s.resolveWaiting(session, peerID, true); err != nil {
+		switch {
+		case errors.Is(err, errNotWaiting):
+			writeJSONError(w, http.StatusNotFound, ErrorCodePeerNotFound, fmt.Sprintf("peer %s is not waiting in the lobby", peerID))
+		case errors.Is(err, errRoomFull):
+			writeJSONError(w, http.StatusConflict, ErrorCodeRoomFull, err.Error())
+		case errors.Is(err, errServerFull):
+			writeJSONError(w, http.StatusServiceUnavailable, ErrorCodeServerFull, err.Error())
+		default:
+			writeJSONError(w, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+		}
+		return
+	}
+
+	log.Printf("Admin admitted %s to session %s", peerID, session.id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) sendNoticeToSession(session *Session, message string) {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	for _, client := range session.clients {
+		s.sendNotice(client, MessageTypeNotice, message)
+	}
+}
+
+func (s *Server) adminSession(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	sessionID := r.PathValue("id")
+
+	session := s.getSession(sessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeSessionNotFound, fmt.Sprintf("session %s not found", sessionID))
+		return nil, false
+	}
+	return session, true
+}
+
+func (s *Server) sendNotice(client *ServerClient, msgType MessageType, message string) {
+	payload, err := json.Marshal(NoticePayload{Message: message})
+	if err != nil {
+		log.Printf("Failed to marshal %s payload: %v", msgType, err)
+		return
+	}
+
+	s.sendMessage(client, &SignalingMessage{
+		Type:      msgType,
+		SessionID: client.sessionID,
+		PeerID:    client.peerID,
+		Payload:   payload,
+	})
+}
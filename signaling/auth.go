@@ -0,0 +1,240 @@
+package signaling
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	RoleHost        = "host"
+	RoleCoHost      = "cohost"
+	RoleParticipant = "participant"
+
+	defaultTokenTTL = time.Hour
+)
+
+// httpClient is used for requests to the signaling server's HTTP endpoints.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	ErrTokenMissing = errors.New("join token missing")
+	ErrTokenInvalid = errors.New("join token invalid")
+	ErrTokenExpired = errors.New("join token expired")
+)
+
+// JoinClaims is the identity a join token grants.
+type JoinClaims struct {
+	SessionID string    `json:"session_id"`
+	PeerID    string    `json:"peer_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenIssuer signs and verifies join tokens with HMAC-SHA256. A token is
+// the base64url encoded claims JSON and its signature, joined by a dot.
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+type TokenIssuerConfig struct {
+	// Secret is the HMAC key. A random one is generated if empty, which
+	// means tokens stop verifying when the server restarts. Servers that
+	// share a backplane must all use the same one.
+	Secret []byte
+	// TTL is how long issued tokens are valid. Defaults to one hour.
+	TTL time.Duration
+}
+
+func NewTokenIssuer(config TokenIssuerConfig) (*TokenIssuer, error) {
+	secret := config.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate token secret: %w", err)
+		}
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+
+	return &TokenIssuer{secret: secret, ttl: ttl}, nil
+}
+
+// Issue signs claims, setting ExpiresAt from the issuer's TTL if it is zero.
+func (t *TokenIssuer) Issue(claims JoinClaims) (string, error) {
+	if claims.ExpiresAt.IsZero() {
+		claims.ExpiresAt = time.Now().Add(t.ttl)
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(body)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.sign(encoded)), nil
+}
+
+func (t *TokenIssuer) Verify(token string) (*JoinClaims, error) {
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, t.sign(encoded)) {
+		return nil, ErrTokenInvalid
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims JoinClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	if time.Now().After(claims.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
+
+func (t *TokenIssuer) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// TokenRequest is the body of a POST to the server's /token endpoint.
+type TokenRequest struct {
+	SessionID string `json:"session_id"`
+	Username  string `json:"username"`
+}
+
+// TokenResponse carries a join token and the peer ID it was issued for.
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	PeerID    string    `json:"peer_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RequestJoinToken asks the signaling server at serverURL (its websocket
+// URL) for a token to join sessionID as username.
+func RequestJoinToken(serverURL, sessionID, username string) (*TokenResponse, error) {
+	var tokenResp TokenResponse
+	err := httpJSON(http.MethodPost, serverURL, "/token", TokenRequest{SessionID: sessionID, Username: username}, &tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get join token: %w", err)
+	}
+	return &tokenResp, nil
+}
+
+// httpJSON sends body (if non-nil) as JSON to path on the signaling server
+// at serverURL and decodes the response into out. Error responses are
+// returned as *RequestError.
+func httpJSON(method, serverURL, path string, body, out any) error {
+	target, err := httpURL(serverURL, path)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reqErr := &RequestError{Status: resp.StatusCode}
+		var errPayload ErrorPayload
+		if err := json.NewDecoder(resp.Body).Decode(&errPayload); err == nil {
+			reqErr.Code = errPayload.Code
+			reqErr.Message = errPayload.Message
+		}
+		if reqErr.Message == "" {
+			reqErr.Message = resp.Status
+		}
+		return reqErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// RequestError is an error response from one of the server's HTTP
+// endpoints.
+type RequestError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// httpURL turns a ws:// or wss:// URL into the http(s) URL for path on the
+// same host.
+func httpURL(wsURL, path string) (string, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path
+	u.RawQuery = ""
+	return u.String(), nil
+}
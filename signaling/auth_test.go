@@ -0,0 +1,74 @@
+package signaling
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenIssuerVerify(t *testing.T) {
+	issuer, err := NewTokenIssuer(TokenIssuerConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTokenIssuer(TokenIssuerConfig{Secret: []byte("other secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := JoinClaims{SessionID: "session", PeerID: "peer", Username: "alice", Role: RoleParticipant}
+	issue := func(issuer *TokenIssuer, claims JoinClaims) string {
+		token, err := issuer.Issue(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	good := issue(issuer, claims)
+	body, signature, _ := strings.Cut(good, ".")
+
+	// A body naming another peer, signed by nobody.
+	forged := claims
+	forged.PeerID = "someone else"
+	forgedBody, _, _ := strings.Cut(issue(other, forged), ".")
+
+	// The signature with its first byte changed.
+	sig, _ := base64.RawURLEncoding.DecodeString(signature)
+	sig[0] ^= 0xff
+	tamperedSignature := base64.RawURLEncoding.EncodeToString(sig)
+
+	expired := claims
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"good token", good, nil},
+		{"empty", "", ErrTokenMissing},
+		{"missing dot", body + signature, ErrTokenInvalid},
+		{"tampered body", forgedBody + "." + signature, ErrTokenInvalid},
+		{"tampered signature", body + "." + tamperedSignature, ErrTokenInvalid},
+		{"signature not base64", body + ".!!!", ErrTokenInvalid},
+		{"wrong secret", issue(other, claims), ErrTokenInvalid},
+		{"expired", issue(issuer, expired), ErrTokenExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := issuer.Verify(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if got.SessionID != claims.SessionID || got.PeerID != claims.PeerID || got.Username != claims.Username || got.Role != claims.Role {
+				t.Fatalf("Verify() = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package signaling
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// Backplane carries events between signaling server instances so a session
+// can have peers connected to different nodes. Every node publishes and
+// subscribes to the same stream, and each subscriber must see a given
+// node's events in the order that node published them.
+type Backplane interface {
+	// Publish must not block on subscribers, since handlers publish too.
+	Publish(data []byte) error
+	// Subscribe calls handler for every event published by any node,
+	// including this one. Handler calls are never concurrent.
+	Subscribe(handler func(data []byte)) error
+	Close() error
+}
+
+var errBackplaneClosed = errors.New("backplane closed")
+
+// MemoryBackplane connects servers running in the same process. A single
+// server uses one by default, which makes the backplane a no-op.
+type MemoryBackplane struct {
+	subscribers []*memorySubscriber
+	mu          sync.RWMutex
+	closed      bool
+}
+
+// memorySubscriber queues events without bound so Publish never waits on a
+// handler, and delivers them in order on its own goroutine.
+type memorySubscriber struct {
+	queue   [][]byte
+	wake    chan struct{}
+	handler func(data []byte)
+	mu      sync.Mutex
+	closed  bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+func (b *MemoryBackplane) Publish(data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return errBackplaneClosed
+	}
+	for _, sub := range b.subscribers {
+		sub.push(data)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(data []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBackplaneClosed
+	}
+
+	sub := &memorySubscriber{
+		wake:    make(chan struct{}, 1),
+		handler: handler,
+	}
+	b.subscribers = append(b.subscribers, sub)
+	go sub.run()
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, sub := range b.subscribers {
+		sub.close()
+	}
+	b.subscribers = nil
+	log.Println("Closed in-memory backplane")
+	return nil
+}
+
+func (sub *memorySubscriber) push(data []byte) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, data)
+	sub.mu.Unlock()
+
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *memorySubscriber) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *memorySubscriber) run() {
+	for range sub.wake {
+		for {
+			sub.mu.Lock()
+			if sub.closed {
+				sub.mu.Unlock()
+				return
+			}
+			if len(sub.queue) == 0 {
+				sub.mu.Unlock()
+				break
+			}
+			data := sub.queue[0]
+			sub.queue[0] = nil
+			sub.queue = sub.queue[1:]
+			sub.mu.Unlock()
+
+			sub.handler(data)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package signaling
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRedisChannel = "zero:signaling"
+
+// RedisBackplane connects servers through Redis pub/sub, or anything that
+// speaks the same protocol. It uses one connection for PUBLISH and another
+// for the subscription, and redials either when it fails. Publish only
+// queues; a writer goroutine sends the queue over the publish connection.
+// Events published while either connection is down, or while the queue is
+// full, are lost.
+type RedisBackplane struct {
+	addr         string
+	password     string
+	channel      string
+	dialTimeout  time.Duration
+	pingInterval time.Duration
+
+	queue chan []byte
+	// dropped counts events lost to a full queue or a down connection, and
+	// dropping is set while the queue is overflowing.
+	dropped  atomic.Uint64
+	dropping atomic.Bool
+
+	// pub is only used by the writer; pubMu guards the pointer so Close
+	// can interrupt a blocked PUBLISH.
+	pub        *redisConn
+	pubMu      sync.Mutex
+	sub        *redisConn
+	subMu      sync.Mutex
+	subscribed bool
+	closed     bool
+	done       chan struct{}
+}
+
+type RedisBackplaneConfig struct {
+	// Addr is the host:port of the Redis server.
+	Addr     string
+	Password string
+	// Channel is the pub/sub channel shared by all nodes. Defaults to
+	// "zero:signaling".
+	Channel string
+	// DialTimeout bounds connecting and each command. Defaults to 5s.
+	DialTimeout time.Duration
+	// QueueSize is how many events may wait to be published. Defaults to
+	// 1024.
+	QueueSize int
+	// PingInterval is how often the subscription connection is checked
+	// with PING. It is dropped and redialled when no reply arrives within
+	// DialTimeout. Defaults to 15s.
+	PingInterval time.Duration
+}
+
+func NewRedisBackplane(config RedisBackplaneConfig) (*RedisBackplane, error) {
+	if config.Addr == "" {
+		return nil, fmt.Errorf("redis address is required")
+	}
+
+	b := &RedisBackplane{
+		addr:         config.Addr,
+		password:     config.Password,
+		channel:      config.Channel,
+		dialTimeout:  config.DialTimeout,
+		pingInterval: config.PingInterval,
+		done:         make(chan struct{}),
+	}
+	if b.channel == "" {
+		b.channel = defaultRedisChannel
+	}
+	if b.dialTimeout <= 0 {
+		b.dialTimeout = 5 * time.Second
+	}
+	if b.pingInterval <= 0 {
+		b.pingInterval = 15 * time.Second
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+	b.queue = make(chan []byte, queueSize)
+
+	pub, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.pub = pub
+	go b.write()
+
+	log.Printf("Connected to Redis backplane at %s, channel %s", b.addr, b.channel)
+	return b, nil
+}
+
+func (b *RedisBackplane) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", b.addr, b.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", b.addr, err)
+	}
+	conn := newRedisConn(netConn, b.dialTimeout)
+
+	if b.password != "" {
+		if _, err := conn.do("AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate with redis: %w", err)
+		}
+	}
+	if _, err := conn.do("PING"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ping redis: %w", err)
+	}
+	return conn, nil
+}
+
+// Publish queues data for the writer and never waits for Redis. When the
+// queue is full the event is dropped and counted in Dropped.
+func (b *RedisBackplane) Publish(data []byte) error {
+	select {
+	case <-b.done:
+		return errBackplaneClosed
+	default:
+	}
+
+	select {
+	case b.queue <- data:
+	default:
+		b.dropped.Add(1)
+		if !b.dropping.Swap(true) {
+			log.Printf("Redis publish queue is full, dropping events")
+		}
+	}
+	return nil
+}
+
+// Dropped returns how many events have been lost without reaching Redis.
+func (b *RedisBackplane) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// write publishes queued events in order until the backplane is closed.
+// When the connection fails it is redialled with backoff, and events
+// taken from the queue meanwhile are dropped.
+func (b *RedisBackplane) write() {
+	delay := 500 * time.Millisecond
+	var retry time.Time
+
+	for {
+		var data []byte
+		select {
+		case <-b.done:
+			return
+		case data = <-b.queue:
+		}
+		if len(b.queue) == 0 && b.dropping.Swap(false) {
+			log.Printf("Redis publish queue drained, %d events dropped so far", b.dropped.Load())
+		}
+
+		b.pubMu.Lock()
+		pub := b.pub
+		b.pubMu.Unlock()
+
+		if pub == nil {
+			if time.Now().Before(retry) {
+				b.dropped.Add(1)
+				continue
+			}
+			var err error
+			if pub, err = b.dial(); err != nil {
+				log.Printf("Failed to reconnect to Redis: %v", err)
+				b.dropped.Add(1)
+				retry = time.Now().Add(delay)
+				delay = min(delay*2, 30*time.Second)
+				continue
+			}
+			b.pubMu.Lock()
+			if b.closed {
+				b.pubMu.Unlock()
+				pub.Close()
+				return
+			}
+			b.pub = pub
+			b.pubMu.Unlock()
+			log.Printf("Reconnected to Redis at %s", b.addr)
+			delay = 500 * time.Millisecond
+		}
+
+		if _, err := pub.do("PUBLISH", b.channel, string(data)); err != nil {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			log.Printf("Failed to publish to redis: %v", err)
+			b.dropped.Add(1)
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				// The connection is in an unknown state; start over.
+				pub.Close()
+				b.pubMu.Lock()
+				b.pub = nil
+				b.pubMu.Unlock()
+			}
+		}
+	}
+}
+
+// Subscribe starts the subscription. Only one handler is supported.
+func (b *RedisBackplane) Subscribe(handler func(data []byte)) error {
+	b.subMu.Lock()
+	if b.closed {
+		b.subMu.Unlock()
+		return errBackplaneClosed
+	}
+	if b.subscribed {
+		b.subMu.Unlock()
+		return fmt.Errorf("already subscribed")
+	}
+	b.subscribed = true
+	b.subMu.Unlock()
+
+	conn, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go b.receive(conn, handler)
+	return nil
+}
+
+func (b *RedisBackplane) subscribe() (*redisConn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("SUBSCRIBE", b.channel); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", b.channel, err)
+	}
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	if b.closed {
+		conn.Close()
+		return nil, errBackplaneClosed
+	}
+	b.sub = conn
+	return conn, nil
+}
+
+// receive delivers messages from conn to handler, resubscribing with
+// backoff whenever the connection drops, until the backplane is closed.
+func (b *RedisBackplane) receive(conn *redisConn, handler func(data []byte)) {
+	for {
+		err := b.readMessages(conn, handler)
+		conn.Close()
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		log.Printf("Lost Redis subscription: %v", err)
+
+		delay := 500 * time.Millisecond
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-time.After(delay):
+			}
+
+			conn, err = b.subscribe()
+			if err == nil {
+				log.Printf("Resubscribed to Redis channel %s", b.channel)
+				break
+			}
+			if errors.Is(err, errBackplaneClosed) {
+				return
+			}
+			log.Printf("Failed to resubscribe to Redis: %v", err)
+			delay = min(delay*2, 30*time.Second)
+		}
+	}
+}
+
+// readMessages returns when conn fails. It pings the server every
+// pingInterval, so a connection that has silently died is noticed when a
+// read goes longer than that without a reply.
+func (b *RedisBackplane) readMessages(conn *redisConn, handler func(data []byte)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.ping(conn, stop)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(b.pingInterval + b.dialTimeout))
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+
+		// Pushed messages are ["message", channel, payload].
+		parts, ok := reply.([]any)
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		kind, _ := parts[0].([]byte)
+		payload, _ := parts[2].([]byte)
+		if string(kind) != "message" || payload == nil {
+			continue
+		}
+		handler(payload)
+	}
+}
+
+// ping sends PING on the subscribed conn until stop is closed. The reply,
+// ["pong", ""], is skipped by readMessages.
+func (b *RedisBackplane) ping(conn *redisConn, stop chan struct{}) {
+	ticker := time.NewTicker(b.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		conn.SetWriteDeadline(time.Now().Add(b.dialTimeout))
+		if err := conn.writeCommand("PING"); err != nil {
+			// Unblock the read, which reports the failure.
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (b *RedisBackplane) Close() error {
+	b.pubMu.Lock()
+	b.subMu.Lock()
+	defer b.pubMu.Unlock()
+	defer b.subMu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+
+	if b.pub != nil {
+		b.pub.Close()
+	}
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	return nil
+}
+
+// redisConn speaks just enough RESP for AUTH, PING, PUBLISH and SUBSCRIBE.
+type redisConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func newRedisConn(conn net.Conn, timeout time.Duration) *redisConn {
+	return &redisConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+}
+
+// do sends a command and reads its reply within the connection's timeout.
+// It must not be used on a connection that is subscribed, whose replies
+// arrive unprompted.
+func (c *redisConn) do(args ...string) (any, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	defer c.SetDeadline(time.Time{})
+
+	if err := c.writeCommand(args...); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) writeCommand(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// readReply returns a string, int64, []byte (nil for a null bulk string) or
+// []any, or a redisError for an error reply.
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", line)
+		}
+		if size < 0 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", line)
+		}
+		if count < 0 {
+			return []any(nil), nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			items[i], err = c.readReply()
+			if err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+				items[i] = redisErr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed redis reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
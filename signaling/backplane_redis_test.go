@@ -0,0 +1,313 @@
+package signaling
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in Redis server that handles AUTH, PING, PUBLISH and
+// SUBSCRIBE on one channel, which is all RedisBackplane sends.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu          sync.Mutex
+	conns       map[net.Conn]struct{}
+	subscribers map[net.Conn]*sync.Mutex
+	subscribes  int
+	// silent stops the server answering subscribed connections' pings.
+	silent bool
+	// stalled stops the server answering PUBLISH.
+	stalled bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		listener:    listener,
+		password:    password,
+		conns:       make(map[net.Conn]struct{}),
+		subscribers: make(map[net.Conn]*sync.Mutex),
+	}
+	t.Cleanup(r.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns[conn] = struct{}{}
+			r.mu.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) close() {
+	r.listener.Close()
+	r.dropConnections()
+}
+
+// dropConnections closes every client connection, as a Redis restart would.
+func (r *fakeRedis) dropConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func (r *fakeRedis) subscribeCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subscribes
+}
+
+func (r *fakeRedis) setSilent(silent bool) {
+	r.mu.Lock()
+	r.silent = silent
+	r.mu.Unlock()
+}
+
+func (r *fakeRedis) setStalled(stalled bool) {
+	r.mu.Lock()
+	r.stalled = stalled
+	r.mu.Unlock()
+}
+
+func (r *fakeRedis) serve(netConn net.Conn) {
+	// Commands arrive as arrays of bulk strings, which readReply parses.
+	conn := newRedisConn(netConn, time.Minute)
+	writeMu := &sync.Mutex{}
+	write := func(reply string) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		netConn.Write([]byte(reply))
+	}
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, netConn)
+		delete(r.subscribers, netConn)
+		r.mu.Unlock()
+		netConn.Close()
+	}()
+
+	authed := r.password == ""
+	for {
+		request, err := conn.readReply()
+		if err != nil {
+			return
+		}
+		args, _ := request.([]any)
+		if len(args) == 0 {
+			write("-ERR bad request\r\n")
+			continue
+		}
+		command, _ := args[0].([]byte)
+
+		if string(command) == "AUTH" {
+			if len(args) == 2 && string(args[1].([]byte)) == r.password {
+				authed = true
+				write("+OK\r\n")
+			} else {
+				write("-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authed {
+			write("-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		switch string(command) {
+		case "PING":
+			r.mu.Lock()
+			_, subscribed := r.subscribers[netConn]
+			silent := r.silent
+			r.mu.Unlock()
+			switch {
+			case subscribed && silent:
+			case subscribed:
+				write("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+			default:
+				write("+PONG\r\n")
+			}
+		case "SUBSCRIBE":
+			channel := args[1].([]byte)
+			r.mu.Lock()
+			r.subscribers[netConn] = writeMu
+			r.subscribes++
+			r.mu.Unlock()
+			write("*3\r\n$9\r\nsubscribe\r\n" + bulk(channel) + ":1\r\n")
+		case "PUBLISH":
+			channel, payload := args[1].([]byte), args[2].([]byte)
+			message := "*3\r\n$7\r\nmessage\r\n" + bulk(channel) + bulk(payload)
+			r.mu.Lock()
+			if r.stalled {
+				r.mu.Unlock()
+				continue
+			}
+			for sub, subMu := range r.subscribers {
+				subMu.Lock()
+				sub.Write([]byte(message))
+				subMu.Unlock()
+			}
+			count := len(r.subscribers)
+			r.mu.Unlock()
+			write(":" + strconv.Itoa(count) + "\r\n")
+		default:
+			write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func bulk(data []byte) string {
+	return "$" + strconv.Itoa(len(data)) + "\r\n" + string(data) + "\r\n"
+}
+
+func newTestRedisBackplane(t *testing.T, r *fakeRedis, config RedisBackplaneConfig) *RedisBackplane {
+	t.Helper()
+	config.Addr = r.addr()
+	b, err := NewRedisBackplane(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// receiveEvent waits for an event on events.
+func receiveEvent(t *testing.T, events chan string) string {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return ""
+	}
+}
+
+// waitFor polls condition until it holds or the test times out.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func subscribeEvents(t *testing.T, b *RedisBackplane) chan string {
+	t.Helper()
+	events := make(chan string, 16)
+	if err := b.Subscribe(func(data []byte) { events <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestRedisBackplanePublishSubscribe(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+	a := newTestRedisBackplane(t, r, RedisBackplaneConfig{Password: "secret"})
+	b := newTestRedisBackplane(t, r, RedisBackplaneConfig{Password: "secret"})
+	eventsA := subscribeEvents(t, a)
+	eventsB := subscribeEvents(t, b)
+	waitFor(t, "both subscriptions", func() bool { return r.subscribeCount() == 2 })
+
+	if err := a.Publish([]byte("hello\r\nworld")); err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range []chan string{eventsA, eventsB} {
+		if event := receiveEvent(t, events); event != "hello\r\nworld" {
+			t.Fatalf("received %q", event)
+		}
+	}
+}
+
+func TestRedisBackplaneWrongPassword(t *testing.T) {
+	r := newFakeRedis(t, "secret")
+	if _, err := NewRedisBackplane(RedisBackplaneConfig{Addr: r.addr(), Password: "wrong"}); err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+}
+
+func TestRedisBackplaneReconnects(t *testing.T) {
+	r := newFakeRedis(t, "")
+	b := newTestRedisBackplane(t, r, RedisBackplaneConfig{})
+	events := subscribeEvents(t, b)
+	waitFor(t, "subscription", func() bool { return r.subscribeCount() == 1 })
+
+	r.dropConnections()
+	waitFor(t, "resubscription", func() bool { return r.subscribeCount() == 2 })
+
+	// Events published before the publish connection is redialled are
+	// lost, and later ones get through.
+	waitFor(t, "published event", func() bool {
+		if err := b.Publish([]byte("back")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-events:
+			return event == "back"
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	})
+}
+
+func TestRedisBackplaneDetectsSilentSubscription(t *testing.T) {
+	r := newFakeRedis(t, "")
+	b := newTestRedisBackplane(t, r, RedisBackplaneConfig{
+		DialTimeout:  100 * time.Millisecond,
+		PingInterval: 50 * time.Millisecond,
+	})
+	subscribeEvents(t, b)
+	waitFor(t, "subscription", func() bool { return r.subscribeCount() == 1 })
+
+	// A few pings answered keep the subscription.
+	time.Sleep(300 * time.Millisecond)
+	if count := r.subscribeCount(); count != 1 {
+		t.Fatalf("resubscribed %d times while the server answered pings", count-1)
+	}
+
+	r.setSilent(true)
+	waitFor(t, "resubscription", func() bool { return r.subscribeCount() > 1 })
+}
+
+func TestRedisBackplanePublishDoesNotBlock(t *testing.T) {
+	r := newFakeRedis(t, "")
+	b := newTestRedisBackplane(t, r, RedisBackplaneConfig{QueueSize: 4})
+	r.setStalled(true)
+
+	// The writer waits on the first event, four more fill the queue, and
+	// the rest are dropped at once.
+	start := time.Now()
+	for range 20 {
+		if err := b.Publish([]byte("event")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publishing to a stalled server took %v", elapsed)
+	}
+	if dropped := b.Dropped(); dropped < 15 {
+		t.Fatalf("dropped %d events, want at least 15", dropped)
+	}
+}
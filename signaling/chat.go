@@ -0,0 +1,187 @@
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxChatLength is the longest chat message in bytes.
+	MaxChatLength = 4096
+	// chatHistorySize is how many room-wide messages a session keeps for
+	// peers that join later.
+	chatHistorySize = 100
+)
+
+// ValidateChatText checks the text of an outgoing chat message.
+func ValidateChatText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("chat message is empty")
+	}
+	if len(text) > MaxChatLength {
+		return fmt.Errorf("chat message is longer than %d bytes", MaxChatLength)
+	}
+	if !utf8.ValidString(text) {
+		return fmt.Errorf("chat message is not valid UTF-8")
+	}
+	return nil
+}
+
+// handleChat stamps a chat message with an ID, time and sender and delivers
+// it: to the target and back to the sender for a direct message, or to the
+// whole session, sender included, for a room-wide one. Only room-wide
+// messages are kept in the session's history.
+//
+// A room-wide message the sender already sent over data channels carries
+// its own ID and the peers it reached. It keeps that ID and goes only to
+// the peers it did not reach.
+func (s *Server) handleChat(client *ServerClient, msg *SignalingMessage) {
+	var payload ChatPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, "invalid chat payload")
+		return
+	}
+	if err := ValidateChatText(payload.Text); err != nil {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if msg.TargetPeerID == client.peerID {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, "cannot send a chat message to yourself")
+		return
+	}
+	if payload.ID != "" && (msg.TargetPeerID != "" || uuid.Validate(payload.ID) != nil) {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, "only room-wide chat messages may carry an id, which must be a UUID")
+		return
+	}
+
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.RLock()
+	username := client.username
+	session.mu.RUnlock()
+
+	chat := ChatPayload{
+		ID:       uuid.NewString(),
+		From:     client.peerID,
+		Username: username,
+		To:       msg.TargetPeerID,
+		Text:     payload.Text,
+		SentAt:   time.Now().UTC(),
+	}
+	var delivered []string
+	if payload.ID != "" {
+		chat.ID = payload.ID
+		delivered = append(payload.Delivered, client.peerID)
+	}
+	data := chatMessage(session.id, chat)
+
+	if chat.To != "" {
+		if !s.sendToPeer(session.id, chat.To, data) {
+			s.sendError(client, session.id, ErrorCodePeerNotFound, fmt.Sprintf("peer %s not found in session", chat.To))
+			return
+		}
+		s.sendLocal(session.id, client.peerID, data)
+		return
+	}
+
+	s.recordChat(session, chat)
+	s.relayChat(session, data, delivered)
+	s.publish(clusterEvent{Kind: eventChat, SessionID: session.id, Chat: &chat, Delivered: delivered})
+}
+
+// remoteChat delivers a room-wide message sent on another node.
+func (s *Server) remoteChat(session *Session, chat ChatPayload, delivered []string) {
+	s.recordChat(session, chat)
+	s.relayChat(session, chatMessage(session.id, chat), delivered)
+}
+
+// relayChat sends a room-wide message to the session's peers on this node
+// that are not in delivered.
+func (s *Server) relayChat(session *Session, data []byte, delivered []string) {
+	if len(delivered) == 0 {
+		s.broadcastLocal(session.id, "", data)
+		return
+	}
+
+	session.mu.RLock()
+	var peerIDs []string
+	for peerID := range session.clients {
+		if !slices.Contains(delivered, peerID) {
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, peerID := range peerIDs {
+		s.sendLocal(session.id, peerID, data)
+	}
+}
+
+// recordChat adds chat to the session's history, dropping the oldest
+// message once it holds chatHistorySize.
+func (s *Server) recordChat(session *Session, chat ChatPayload) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if len(session.chat) >= chatHistorySize {
+		session.chat = append(session.chat[:0], session.chat[len(session.chat)-chatHistorySize+1:]...)
+	}
+	session.chat = append(session.chat, chat)
+}
+
+// sendChatHistory sends client the session's history, if it has any.
+func (s *Server) sendChatHistory(client *ServerClient) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.RLock()
+	messages := append([]ChatPayload(nil), session.chat...)
+	session.mu.RUnlock()
+
+	if len(messages) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(ChatHistoryPayload{Messages: messages})
+	if err != nil {
+		log.Printf("Failed to marshal chat history: %v", err)
+		return
+	}
+
+	s.sendMessage(client, &SignalingMessage{
+		Type:      MessageTypeChatHistory,
+		SessionID: client.sessionID,
+		PeerID:    client.peerID,
+		Payload:   payload,
+	})
+}
+
+func chatMessage(sessionID string, chat ChatPayload) []byte {
+	payload, _ := json.Marshal(chat)
+
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:         MessageTypeChat,
+		SessionID:    sessionID,
+		PeerID:       chat.From,
+		TargetPeerID: chat.To,
+		Username:     chat.Username,
+		Payload:      payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal chat message: %v", err)
+		return nil
+	}
+	return msgBytes
+}
@@ -1,9 +1,13 @@
 package signaling
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"sync"
 	"time"
 
@@ -13,109 +17,482 @@ import (
 
 type MessageHandler func(*SignalingMessage)
 
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+	// StateFailed means the server turned the join down, for example for an
+	// expired token, and the client has stopped reconnecting.
+	StateFailed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type StateChangeHandler func(ConnectionState)
+
+const (
+	maxReconnectInterval = 30 * time.Second
+
+	// maxOutboxSize bounds the messages kept while reconnecting. The oldest
+	// are dropped first.
+	maxOutboxSize = 256
+)
+
 type Client struct {
-	conn              *websocket.Conn
-	serverURL         string
-	sessionID         string
-	peerID            string
-	username          string
-	mu                sync.RWMutex
-	messageHandlers   map[MessageType][]MessageHandler
-	reconnectInterval time.Duration
-	done              chan struct{}
-	connected         bool
+	conn                 *websocket.Conn
+	serverURL            string
+	sessionID            string
+	peerID               string
+	username             string
+	role                 string
+	joinToken            string
+	passcode             string
+	profile              *Profile
+	resumeToken          string
+	mu                   sync.RWMutex
+	writeMu              sync.Mutex
+	dispatcher           *Dispatcher
+	stateHandlers        []StateChangeHandler
+	state                ConnectionState
+	outbox               []*SignalingMessage
+	reconnectInterval    time.Duration
+	maxReconnectInterval time.Duration
+	heartbeat            HeartbeatConfig
+	rtt                  rttMeter
+	done                 chan struct{}
+	closed               bool
+	// ended is set once the server has removed this client from the
+	// session, after which a dropped connection is not redialled.
+	ended bool
+	// failed is set along with ended when the server rejected the join,
+	// with the error it gave in rejection.
+	failed    bool
+	rejection *ErrorPayload
+	// joining is set from sending a join until the server answers it.
+	joining bool
+	// reconnectHint is the delay a shutting down server asked for before
+	// the next reconnect.
+	reconnectHint time.Duration
+	// tokenRefreshAt is when to ask for a new join token, halfway through
+	// the current one's life. Zero while a refresh is outstanding.
+	tokenRefreshAt time.Time
 }
 
 func NewClient(serverURL, sessionID, peerID, username string) *Client {
-	return &Client{
-		serverURL:         serverURL,
-		sessionID:         sessionID,
-		peerID:            peerID,
-		username:          username,
-		messageHandlers:   make(map[MessageType][]MessageHandler),
-		reconnectInterval: 5 * time.Second,
-		done:              make(chan struct{}),
-		connected:         false,
+	c := &Client{
+		serverURL:            serverURL,
+		sessionID:            sessionID,
+		peerID:               peerID,
+		username:             username,
+		dispatcher:           NewDispatcher(DispatcherConfig{}),
+		state:                StateDisconnected,
+		reconnectInterval:    500 * time.Millisecond,
+		maxReconnectInterval: maxReconnectInterval,
+		heartbeat:            DefaultHeartbeatConfig(),
+		done:                 make(chan struct{}),
+	}
+
+	c.dispatcher.On(MessageTypeJoined, c.handleJoined)
+	c.dispatcher.On(MessageTypeProfileUpdate, c.handleProfileUpdate)
+	c.dispatcher.On(MessageTypeToken, c.handleToken)
+	return c
+}
+
+// SetJoinToken sets the token sent with every join. It must be issued for
+// this client's session and peer ID; see RequestJoinToken. Once joined, the
+// client keeps it renewed with tokens from the server.
+func (c *Client) SetJoinToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.joinToken = token
+}
+
+// SetPasscode sets the session passcode sent with every join.
+func (c *Client) SetPasscode(passcode string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.passcode = passcode
+}
+
+// Rejoin sends a fresh join on the current connection, for use after the
+// server turned a join down, for example for a missing or wrong passcode.
+func (c *Client) Rejoin() error {
+	c.mu.RLock()
+	conn := c.conn
+	msg, err := c.joinMessage()
+	c.mu.RUnlock()
+
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.joining = true
+	c.mu.Unlock()
+	if err := c.writeMessage(conn, msg); err != nil {
+		return fmt.Errorf("failed to send join message: %w", err)
+	}
+	return nil
+}
+
+// SetProfile sets the profile sent with every join. Use UpdateProfile to
+// change it once joined.
+func (c *Client) SetProfile(profile Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = &profile
+}
+
+// UpdateProfile asks the server to change this peer's profile for everyone
+// in the session. An empty display name keeps the current one. The change
+// takes effect when the server echoes it back as profile_update.
+func (c *Client) UpdateProfile(profile Profile) error {
+	msg, err := NewProfileUpdateMessage(c.sessionID, c.peerID, profile)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// handleProfileUpdate keeps the username and the profile sent on rejoins in
+// step with our own accepted profile updates.
+func (c *Client) handleProfileUpdate(msg *SignalingMessage) {
+	var payload ProfileUpdatePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.PeerID != c.peerID {
+		return
 	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = payload.Profile.DisplayName
+	c.profile = &payload.Profile
+}
+
+// joinMessage builds the join for the current credentials. The caller must
+// hold c.mu.
+func (c *Client) joinMessage() (*SignalingMessage, error) {
+	return NewJoinMessage(c.sessionID, c.peerID, JoinPayload{
+		Username:    c.username,
+		Token:       c.joinToken,
+		ResumeToken: c.resumeToken,
+		Passcode:    c.passcode,
+		Profile:     c.profile,
+	})
+}
+
+// SetHeartbeatConfig changes the keepalive settings used by connections
+// opened after the call. Zero fields use DefaultHeartbeatConfig.
+func (c *Client) SetHeartbeatConfig(heartbeat HeartbeatConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heartbeat = heartbeat.withDefaults()
+}
+
+// GetRTT returns the last measured round-trip time to the signaling server,
+// or zero if none has been measured yet.
+func (c *Client) GetRTT() time.Duration {
+	return c.rtt.get()
 }
 
 func (c *Client) Connect() error {
+	c.setState(StateConnecting)
+
+	if err := c.dial(); err != nil {
+		c.setState(c.stoppedState())
+		return err
+	}
+
+	log.Printf("Connected to signaling server: %s", c.serverURL)
+	return nil
+}
+
+// dial opens a new connection and joins the session on it, resuming the
+// previous membership if the server issued a resume token. Messages queued
+// while offline are sent right after the join.
+func (c *Client) dial() error {
 	conn, _, err := websocket.DefaultDialer.Dial(c.serverURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect to signaling server: %w", err)
 	}
 
 	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("client closed")
+	}
 	c.conn = conn
-	c.connected = true
+	c.joining = true
+	msg, err := c.joinMessage()
+	heartbeat := c.heartbeat
 	c.mu.Unlock()
 
-	log.Printf("Connected to signaling server: %s", c.serverURL)
-
-	go c.readMessages()
+	startHeartbeat(conn, heartbeat, &c.rtt)
+	go c.readMessages(conn, heartbeat)
 
-	if err := c.sendJoin(); err != nil {
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := c.writeMessage(conn, msg); err != nil {
+		conn.Close()
 		return fmt.Errorf("failed to send join message: %w", err)
 	}
 
+	// Flush until the queue is empty, then switch to connected under the
+	// same lock so no message can be queued after the last flush.
+	sent := 0
+	for {
+		c.mu.Lock()
+		if c.conn != conn {
+			c.mu.Unlock()
+			return fmt.Errorf("connection lost while joining")
+		}
+		outbox := c.outbox
+		c.outbox = nil
+		if len(outbox) == 0 {
+			handlers := c.setStateLocked(StateConnected)
+			c.mu.Unlock()
+			c.notifyState(StateConnected, handlers)
+			break
+		}
+		c.mu.Unlock()
+
+		for i, queued := range outbox {
+			if err := c.writeMessage(conn, queued); err != nil {
+				c.mu.Lock()
+				c.outbox = append(outbox[i:], c.outbox...)
+				c.mu.Unlock()
+				conn.Close()
+				return fmt.Errorf("failed to send queued message: %w", err)
+			}
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("Sent %d messages queued while offline", sent)
+	}
+
 	return nil
 }
 
 func (c *Client) Disconnect() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if !c.connected {
+	if c.closed {
+		c.mu.Unlock()
 		return
 	}
-
+	c.closed = true
 	close(c.done)
-	c.sendLeave()
+	conn := c.conn
+	wasConnected := c.state == StateConnected
+	c.outbox = nil
+	c.mu.Unlock()
 
-	if c.conn != nil {
-		c.conn.Close()
+	if conn != nil {
+		if wasConnected {
+			c.writeMessage(conn, NewLeaveMessage(c.sessionID, c.peerID))
+		}
+		conn.Close()
 	}
 
-	c.connected = false
+	c.dispatcher.Close()
+	c.setState(StateDisconnected)
 	log.Println("Disconnected from signaling server")
 }
 
 func (c *Client) IsConnected() bool {
+	return c.GetState() == StateConnected
+}
+
+func (c *Client) GetState() ConnectionState {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.connected
+	return c.state
+}
+
+// OnStateChange registers handler to be called whenever the connection
+// state changes. Handlers run on the goroutine that changed the state and
+// must not block.
+func (c *Client) OnStateChange(handler StateChangeHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stateHandlers = append(c.stateHandlers, handler)
+}
+
+func (c *Client) setState(state ConnectionState) {
+	c.mu.Lock()
+	handlers := c.setStateLocked(state)
+	c.mu.Unlock()
+
+	c.notifyState(state, handlers)
+}
+
+// setStateLocked must be called with c.mu held. It returns the handlers to
+// notify, or nil if the state did not change.
+func (c *Client) setStateLocked(state ConnectionState) []StateChangeHandler {
+	if c.state == state || (c.closed && state != StateDisconnected) {
+		return nil
+	}
+	c.state = state
+
+	log.Printf("Signaling connection %s", state)
+	if len(c.stateHandlers) == 0 {
+		return nil
+	}
+	return append([]StateChangeHandler(nil), c.stateHandlers...)
 }
 
+func (c *Client) notifyState(state ConnectionState, handlers []StateChangeHandler) {
+	for _, handler := range handlers {
+		handler(state)
+	}
+}
+
+// On registers handler for msgType. Handlers for messages from the same
+// peer run one at a time in arrival order; see Dispatcher.
 func (c *Client) On(msgType MessageType, handler MessageHandler) {
+	c.dispatcher.On(msgType, handler)
+}
+
+// Subscribe is a channel-based alternative to On. The channel is closed when
+// ctx is done or the client disconnects.
+func (c *Client) Subscribe(ctx context.Context, types ...MessageType) <-chan *SignalingMessage {
+	return c.dispatcher.Subscribe(ctx, types...)
+}
+
+func (c *Client) handleJoined(msg *SignalingMessage) {
+	var payload JoinedPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		log.Printf("Failed to unmarshal joined payload: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	hadToken := c.resumeToken != ""
+	c.resumeToken = payload.ResumeToken
+	c.role = payload.Role
+	if payload.Username != "" {
+		c.username = payload.Username
+	}
+	if payload.Token != "" {
+		c.setJoinTokenLocked(payload.Token, payload.TokenExpiresAt)
+	}
+	c.mu.Unlock()
+
+	if hadToken && !payload.Resumed {
+		log.Printf("Could not resume session %s, rejoined as a new peer", c.sessionID)
+	}
+}
+
+func (c *Client) handleToken(msg *SignalingMessage) {
+	var payload TokenPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Token == "" {
+		log.Printf("Failed to unmarshal token payload: %v", err)
+		return
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.setJoinTokenLocked(payload.Token, payload.ExpiresAt)
+}
 
-	c.messageHandlers[msgType] = append(c.messageHandlers[msgType], handler)
+// setJoinTokenLocked stores a token from the server and schedules its
+// renewal. The caller must hold c.mu.
+func (c *Client) setJoinTokenLocked(token string, expiresAt time.Time) {
+	c.joinToken = token
+	c.tokenRefreshAt = time.Time{}
+	if !expiresAt.IsZero() {
+		c.tokenRefreshAt = time.Now().Add(time.Until(expiresAt) / 2)
+	}
 }
 
-func (c *Client) sendJoin() error {
-	msg, err := NewJoinMessage(c.sessionID, c.peerID, c.username)
-	if err != nil {
-		return err
+// refreshTokenIfDue asks the server on conn for a new join token once the
+// current one is halfway to expiring.
+func (c *Client) refreshTokenIfDue(conn *websocket.Conn) {
+	c.mu.Lock()
+	if c.tokenRefreshAt.IsZero() || time.Now().Before(c.tokenRefreshAt) || c.state != StateConnected {
+		c.mu.Unlock()
+		return
+	}
+	c.tokenRefreshAt = time.Time{}
+	c.mu.Unlock()
+
+	if err := c.writeMessage(conn, NewRefreshTokenMessage(c.sessionID, c.peerID)); err != nil {
+		log.Printf("Failed to request a new join token: %v", err)
 	}
-	return c.SendMessage(msg)
 }
 
-func (c *Client) sendLeave() error {
-	msg := NewLeaveMessage(c.sessionID, c.peerID)
-	return c.SendMessage(msg)
+// joinRejected reports whether an error in answer to a join means the
+// server will not take this client back, so redialling is pointless. After
+// a server restart, for example, the session or the key that signed the
+// token may be gone.
+func joinRejected(code ErrorCode) bool {
+	switch code {
+	case ErrorCodeSessionNotFound, ErrorCodePeerRemoved, ErrorCodeTooManyAttempts:
+		return true
+	}
+	return NeedsNewToken(code)
+}
+
+// NeedsNewToken reports whether a join rejected with code may succeed as a
+// new peer with a fresh token from RequestJoinToken.
+func NeedsNewToken(code ErrorCode) bool {
+	switch code {
+	case ErrorCodeInvalidToken, ErrorCodeTokenExpired, ErrorCodePeerMismatch:
+		return true
+	}
+	return false
+}
+
+// JoinRejection returns the error the server turned the join down with, once
+// the client is in StateFailed, or nil.
+func (c *Client) JoinRejection() *ErrorPayload {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rejection
 }
 
 func (c *Client) SendOffer(sdp webrtc.SessionDescription) error {
-	msg, err := NewOfferMessage(c.sessionID, c.peerID, sdp)
+	return c.SendOfferTo("", sdp)
+}
+
+func (c *Client) SendOfferTo(targetPeerID string, sdp webrtc.SessionDescription) error {
+	msg, err := NewOfferMessage(c.sessionID, c.peerID, targetPeerID, sdp)
 	if err != nil {
 		return err
 	}
+	msg.Username = c.GetUsername()
 	return c.SendMessage(msg)
 }
 
 func (c *Client) SendAnswer(sdp webrtc.SessionDescription) error {
-	msg, err := NewAnswerMessage(c.sessionID, c.peerID, sdp)
+	return c.SendAnswerTo("", sdp)
+}
+
+func (c *Client) SendAnswerTo(targetPeerID string, sdp webrtc.SessionDescription) error {
+	msg, err := NewAnswerMessage(c.sessionID, c.peerID, targetPeerID, sdp)
 	if err != nil {
 		return err
 	}
@@ -123,28 +500,55 @@ func (c *Client) SendAnswer(sdp webrtc.SessionDescription) error {
 }
 
 func (c *Client) SendCandidate(candidate webrtc.ICECandidateInit) error {
-	msg, err := NewCandidateMessage(c.sessionID, c.peerID, candidate)
+	return c.SendCandidateTo("", candidate)
+}
+
+func (c *Client) SendCandidateTo(targetPeerID string, candidate webrtc.ICECandidateInit) error {
+	msg, err := NewCandidateMessage(c.sessionID, c.peerID, targetPeerID, candidate)
 	if err != nil {
 		return err
 	}
 	return c.SendMessage(msg)
 }
 
+// SendMessage sends msg to the server. While the client is reconnecting the
+// message is queued and sent once the connection is back.
 func (c *Client) SendMessage(msg *SignalingMessage) error {
-	c.mu.RLock()
+	c.mu.Lock()
 	conn := c.conn
-	connected := c.connected
-	c.mu.RUnlock()
+	state := c.state
+	if state == StateReconnecting {
+		if len(c.outbox) >= maxOutboxSize {
+			log.Printf("Offline queue full, dropping queued %s message", c.outbox[0].Type)
+			c.outbox = c.outbox[1:]
+		}
+		c.outbox = append(c.outbox, msg)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
 
-	if !connected || conn == nil {
+	if state != StateConnected || conn == nil {
 		return fmt.Errorf("not connected to signaling server")
 	}
 
+	return c.writeMessage(conn, msg)
+}
+
+func (c *Client) writeMessage(conn *websocket.Conn, msg *SignalingMessage) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
+	c.mu.RLock()
+	writeTimeout := c.heartbeat.WriteTimeout
+	c.mu.RUnlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
@@ -152,57 +556,186 @@ func (c *Client) SendMessage(msg *SignalingMessage) error {
 	return nil
 }
 
-func (c *Client) readMessages() {
-	defer func() {
-		c.mu.Lock()
-		c.connected = false
-		c.mu.Unlock()
-	}()
+func (c *Client) readMessages(conn *websocket.Conn, heartbeat HeartbeatConfig) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.keepAlive(conn, heartbeat, stop)
 
 	for {
-		select {
-		case <-c.done:
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Signaling server silent for %v, dropping connection", heartbeat.readTimeout())
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			c.connectionLost(conn)
 			return
-		default:
-			c.mu.RLock()
-			conn := c.conn
-			c.mu.RUnlock()
+		}
+		extendReadDeadline(conn, heartbeat)
 
-			if conn == nil {
-				return
-			}
+		var msg SignalingMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
 
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket error: %v", err)
+		switch msg.Type {
+		case MessageTypeJoined, MessageTypeLobbyWaiting:
+			c.mu.Lock()
+			c.joining = false
+			c.mu.Unlock()
+		case MessageTypeError:
+			var payload ErrorPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err == nil {
+				c.mu.Lock()
+				rejected := c.joining && joinRejected(payload.Code)
+				if rejected {
+					c.ended, c.failed = true, true
+					c.rejection = &payload
+				}
+				c.mu.Unlock()
+				if rejected {
+					log.Printf("Server rejected the join to session %s: %s", c.sessionID, payload.Message)
+					// Reading on stops at the closed connection, which
+					// ends the client in StateFailed.
+					conn.Close()
 				}
-				return
 			}
-
-			var msg SignalingMessage
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Printf("Failed to unmarshal message: %v", err)
-				continue
+		case MessageTypeKicked, MessageTypeSessionClosed, MessageTypeLobbyDenied:
+			c.mu.Lock()
+			c.ended = true
+			c.mu.Unlock()
+			log.Printf("Removed from session %s by the server (%s)", c.sessionID, msg.Type)
+		case MessageTypeServerShutdown:
+			var payload ShutdownPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err == nil {
+				c.mu.Lock()
+				c.reconnectHint = time.Duration(payload.ReconnectAfterMs) * time.Millisecond
+				c.mu.Unlock()
 			}
+			log.Printf("Signaling server is shutting down: %s", payload.Reason)
+		case MessageTypeRoleChanged:
+			var payload RoleChangedPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err == nil && payload.PeerID == c.peerID {
+				c.mu.Lock()
+				c.role = payload.Role
+				c.mu.Unlock()
+				log.Printf("Role in session %s is now %s", c.sessionID, payload.Role)
+			}
+		}
 
-			c.handleMessage(&msg)
+		if !c.dispatcher.Dispatch(&msg) {
+			return
 		}
 	}
 }
 
-func (c *Client) handleMessage(msg *SignalingMessage) {
-	c.mu.RLock()
-	handlers, exists := c.messageHandlers[msg.Type]
-	c.mu.RUnlock()
+// keepAlive pings the server until stop is closed. A failed ping closes the
+// connection, which ends readMessages and triggers a reconnect.
+func (c *Client) keepAlive(conn *websocket.Conn, heartbeat HeartbeatConfig, stop chan struct{}) {
+	ticker := time.NewTicker(heartbeat.PingInterval)
+	defer ticker.Stop()
 
-	if !exists {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := sendPing(conn, heartbeat); err != nil {
+				log.Printf("Failed to ping signaling server: %v", err)
+				conn.Close()
+				return
+			}
+			c.refreshTokenIfDue(conn)
+		}
+	}
+}
+
+// connectionLost starts reconnecting unless conn was closed on purpose,
+// has already been replaced, or the server ended the session for us.
+func (c *Client) connectionLost(conn *websocket.Conn) {
+	c.mu.Lock()
+	if c.closed || c.conn != conn {
+		c.mu.Unlock()
 		return
 	}
+	c.conn = nil
+	if c.state != StateConnected {
+		// dial is still joining on conn and fails when it sees it gone.
+		c.mu.Unlock()
+		return
+	}
+	ended := c.ended
+	c.mu.Unlock()
 
-	for _, handler := range handlers {
-		go handler(msg)
+	conn.Close()
+	if ended {
+		c.setState(c.stoppedState())
+		return
 	}
+	c.setState(StateReconnecting)
+	go c.reconnect()
+}
+
+// reconnect redials with exponential backoff and jitter until it succeeds
+// or the client is disconnected.
+func (c *Client) reconnect() {
+	delay := c.reconnectInterval
+
+	c.mu.Lock()
+	hint := c.reconnectHint
+	c.reconnectHint = 0
+	c.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		// Wait between 50% and 100% of the delay so clients dropped at the
+		// same moment don't all come back at once.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if attempt == 1 && hint > 0 {
+			// Spread clients of a restarting server over the 50% after
+			// the delay it asked for.
+			wait = hint + time.Duration(rand.Int63n(int64(hint/2)+1))
+		}
+		log.Printf("Reconnecting to signaling server in %v (attempt %d)", wait.Round(time.Millisecond), attempt)
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+
+		if err := c.dial(); err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+			c.mu.RLock()
+			ended := c.ended
+			c.mu.RUnlock()
+			if ended {
+				c.setState(c.stoppedState())
+				return
+			}
+			delay *= 2
+			if delay > c.maxReconnectInterval {
+				delay = c.maxReconnectInterval
+			}
+			continue
+		}
+
+		log.Printf("Reconnected to signaling server after %d attempts", attempt)
+		return
+	}
+}
+
+// stoppedState is the state to settle in once the client stops
+// reconnecting: StateFailed if the server rejected the join.
+func (c *Client) stoppedState() ConnectionState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.failed {
+		return StateFailed
+	}
+	return StateDisconnected
 }
 
 func (c *Client) GetSessionID() string {
@@ -214,5 +747,88 @@ func (c *Client) GetPeerID() string {
 }
 
 func (c *Client) GetUsername() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.username
 }
+
+// GetRole returns this peer's current role in the session, or "" before it
+// has joined.
+func (c *Client) GetRole() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.role
+}
+
+// RequestMute asks targetPeerID to turn off its microphone (MediaAudio) or
+// camera (MediaVideo). Only hosts and co-hosts may send it.
+func (c *Client) RequestMute(targetPeerID, media string) error {
+	msg, err := NewMuteRequestMessage(c.sessionID, c.peerID, targetPeerID, media)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// SendChat sends a chat message through the server, to targetPeerID only
+// or to the whole session if it is empty. The server echoes it back with
+// its ID and time.
+func (c *Client) SendChat(targetPeerID, text string) error {
+	if err := ValidateChatText(text); err != nil {
+		return err
+	}
+	msg, err := NewChatMessage(c.sessionID, c.peerID, targetPeerID, text)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// RecordChat gives the server a room-wide message already sent over data
+// channels to the delivered peers. The server keeps it in the history and
+// relays it to everyone else, but not back to this client.
+func (c *Client) RecordChat(chat ChatPayload, delivered []string) error {
+	msg, err := NewRecordedChatMessage(c.sessionID, c.peerID, chat, delivered)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// RemovePeer removes targetPeerID from the session for good.
+func (c *Client) RemovePeer(targetPeerID string) error {
+	return c.SendMessage(NewRemovePeerMessage(c.sessionID, c.peerID, targetPeerID))
+}
+
+// LockRoom stops or allows new peers joining the session.
+func (c *Client) LockRoom(locked bool) error {
+	msg, err := NewLockRoomMessage(c.sessionID, c.peerID, locked)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// SetPeerRole makes targetPeerID a co-host or participant. Host only.
+func (c *Client) SetPeerRole(targetPeerID, role string) error {
+	msg, err := NewSetRoleMessage(c.sessionID, c.peerID, targetPeerID, role)
+	if err != nil {
+		return err
+	}
+	return c.SendMessage(msg)
+}
+
+// TransferHost makes targetPeerID the host, leaving this peer a co-host.
+func (c *Client) TransferHost(targetPeerID string) error {
+	return c.SendMessage(NewTransferHostMessage(c.sessionID, c.peerID, targetPeerID))
+}
+
+// Admit lets targetPeerID in from the lobby.
+func (c *Client) Admit(targetPeerID string) error {
+	return c.SendMessage(NewAdmitMessage(c.sessionID, c.peerID, targetPeerID, true))
+}
+
+// Deny turns targetPeerID away from the lobby.
+func (c *Client) Deny(targetPeerID string) error {
+	return c.SendMessage(NewAdmitMessage(c.sessionID, c.peerID, targetPeerID, false))
+}
@@ -0,0 +1,363 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+type clusterEventKind string
+
+const (
+	eventSessionCreated clusterEventKind = "session_created"
+	eventSessionClosed  clusterEventKind = "session_closed"
+	eventPeerJoined     clusterEventKind = "peer_joined"
+	eventPeerLeft       clusterEventKind = "peer_left"
+	eventMessage        clusterEventKind = "message"
+	eventKick           clusterEventKind = "kick"
+	eventNotice         clusterEventKind = "notice"
+	eventSyncRequest    clusterEventKind = "sync_request"
+	eventNodeDown       clusterEventKind = "node_down"
+	eventRoleChanged    clusterEventKind = "role_changed"
+	eventRoomLocked     clusterEventKind = "room_locked"
+	eventLobbyRequest   clusterEventKind = "lobby_request"
+	eventLobbyLeft      clusterEventKind = "lobby_left"
+	eventAdmit          clusterEventKind = "admit"
+	eventDeny           clusterEventKind = "deny"
+	eventProfileUpdated clusterEventKind = "profile_updated"
+	eventChat           clusterEventKind = "chat"
+	eventLobbyChanged   clusterEventKind = "lobby_changed"
+)
+
+// clusterEvent is what nodes exchange over the backplane.
+type clusterEvent struct {
+	Kind      clusterEventKind `json:"kind"`
+	Node      string           `json:"node"`
+	SessionID string           `json:"session_id,omitempty"`
+	CreatedAt time.Time        `json:"created_at,omitzero"`
+	MaxPeers  int              `json:"max_peers,omitempty"`
+	Locked    bool             `json:"locked,omitempty"`
+	Lobby     bool             `json:"lobby,omitempty"`
+	Guarded   bool             `json:"guarded,omitempty"`
+	Listed    bool             `json:"listed,omitempty"`
+	// Passcode is the session's passcode hash, never the passcode.
+	Passcode      string    `json:"passcode,omitempty"`
+	Code          string    `json:"code,omitempty"`
+	CodeExpiresAt time.Time `json:"code_expires_at,omitzero"`
+	Creator       string    `json:"creator,omitempty"`
+	Peer          *PeerInfo `json:"peer,omitempty"`
+	PeerID        string    `json:"peer_id,omitempty"`
+	Role          string    `json:"role,omitempty"`
+	// From and To select the recipients of a relayed message: everyone
+	// but From, or only To.
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+	// Chat is a room-wide chat message, which every node keeps in its
+	// copy of the session's history. It is not relayed to the sender or
+	// the peers in Delivered.
+	Chat      *ChatPayload `json:"chat,omitempty"`
+	Delivered []string     `json:"delivered,omitempty"`
+}
+
+// remotePeer is a session member connected to another node.
+type remotePeer struct {
+	info PeerInfo
+	node string
+	// expiry removes the peer if its node went down and it does not
+	// rejoin elsewhere in time.
+	expiry *time.Timer
+}
+
+func (s *Server) publish(event clusterEvent) {
+	event.Node = s.nodeID
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", event.Kind, err)
+		return
+	}
+	if err := s.backplane.Publish(data); err != nil {
+		log.Printf("Failed to publish %s event: %v", event.Kind, err)
+	}
+}
+
+func (s *Server) handleClusterEvent(data []byte) {
+	var event clusterEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Failed to unmarshal cluster event: %v", err)
+		return
+	}
+	if event.Node == s.nodeID {
+		return
+	}
+
+	switch event.Kind {
+	case eventSessionCreated:
+		session := s.addSession(event.SessionID, event.CreatedAt, event.sessionOptions())
+		if event.Locked {
+			s.setLocked(session, true)
+		}
+
+	case eventSessionClosed:
+		s.closeSession(event.SessionID)
+
+	case eventPeerJoined:
+		if event.Peer != nil {
+			s.remotePeerJoined(event)
+		}
+
+	case eventPeerLeft:
+		s.remotePeerLeft(event.SessionID, event.PeerID, event.Node)
+
+	case eventMessage:
+		if event.To != "" {
+			s.sendLocal(event.SessionID, event.To, event.Data)
+		} else {
+			s.broadcastLocal(event.SessionID, event.From, event.Data)
+		}
+
+	case eventKick:
+		if session := s.getSession(event.SessionID); session != nil {
+			s.kickPeer(session, event.PeerID)
+		}
+
+	case eventNotice:
+		if session := s.getSession(event.SessionID); session != nil {
+			s.sendNoticeToSession(session, event.Message)
+		}
+
+	case eventSyncRequest:
+		s.announceState()
+
+	case eventNodeDown:
+		s.remoteNodeDown(event.Node)
+
+	case eventRoleChanged:
+		if session := s.getSession(event.SessionID); session != nil && s.setRole(session, event.PeerID, event.Role) {
+			s.broadcastLocal(session.id, "", roleChangedMessage(session.id, event.PeerID, event.Role))
+			s.admitIfLobbyOpen(session)
+		}
+
+	case eventRoomLocked:
+		if session := s.getSession(event.SessionID); session != nil {
+			s.setLocked(session, event.Locked)
+		}
+
+	case eventLobbyChanged:
+		if session := s.getSession(event.SessionID); session != nil {
+			s.setLobby(session, event.Lobby)
+		}
+
+	case eventLobbyRequest:
+		if session := s.getSession(event.SessionID); session != nil && event.Peer != nil {
+			s.remoteLobbyRequest(session, *event.Peer, event.Node)
+		}
+
+	case eventLobbyLeft:
+		if session := s.getSession(event.SessionID); session != nil {
+			s.remoteLobbyLeft(session, event.PeerID, event.Node)
+		}
+
+	case eventAdmit, eventDeny:
+		if session := s.getSession(event.SessionID); session != nil {
+			if err := s.resolveLocalWaiting(session, event.PeerID, event.Kind == eventAdmit); err != nil && !errors.Is(err, errNotWaiting) {
+				log.Printf("Failed to %s %s: %v", event.Kind, event.PeerID, err)
+			}
+		}
+
+	case eventProfileUpdated:
+		if session := s.getSession(event.SessionID); session != nil && event.Peer != nil {
+			s.remoteProfileUpdate(session, *event.Peer, event.Node)
+		}
+
+	case eventChat:
+		if session := s.getSession(event.SessionID); session != nil && event.Chat != nil {
+			s.remoteChat(session, *event.Chat, event.Delivered)
+		}
+
+	default:
+		log.Printf("Unknown cluster event: %s", event.Kind)
+	}
+}
+
+// event describes session for other nodes, so whichever event reaches a
+// node first can create the session there. session.mu must not be held.
+func (session *Session) event(kind clusterEventKind) clusterEvent {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	return clusterEvent{
+		Kind:          kind,
+		SessionID:     session.id,
+		CreatedAt:     session.createdAt,
+		MaxPeers:      session.maxPeers,
+		Lobby:         session.lobby,
+		Guarded:       session.guarded,
+		Listed:        session.listed,
+		Passcode:      session.passcode,
+		Code:          session.code,
+		CodeExpiresAt: session.codeExpiresAt,
+		Creator:       session.creator,
+	}
+}
+
+func (event clusterEvent) sessionOptions() CreateSessionRequest {
+	return CreateSessionRequest{
+		MaxPeers:      event.MaxPeers,
+		Lobby:         event.Lobby,
+		guarded:       event.Guarded,
+		Listed:        event.Listed,
+		passcodeHash:  event.Passcode,
+		code:          event.Code,
+		codeExpiresAt: event.CodeExpiresAt,
+		creator:       event.Creator,
+	}
+}
+
+// remotePeerJoined records a peer that joined on another node and tells
+// the local peers. A suspended local connection for the same peer means it
+// reconnected through the other node, so that connection is dropped without
+// a peer_left.
+func (s *Server) remotePeerJoined(event clusterEvent) {
+	session := s.addSession(event.SessionID, event.CreatedAt, event.sessionOptions())
+	peer := *event.Peer
+
+	session.mu.Lock()
+	if client, exists := session.clients[peer.PeerID]; exists {
+		if client.expiry == nil {
+			// Still connected here; keep the local connection.
+			session.mu.Unlock()
+			log.Printf("Peer %s joined on node %s while connected here", peer.PeerID, event.Node)
+			return
+		}
+		client.expiry.Stop()
+		delete(session.clients, peer.PeerID)
+		s.peerCount.Add(-1)
+		log.Printf("Peer %s moved to node %s", peer.PeerID, event.Node)
+	}
+	existing, known := session.remote[peer.PeerID]
+	if known && existing.expiry != nil {
+		existing.expiry.Stop()
+	}
+	session.remote[peer.PeerID] = remotePeer{info: peer, node: event.Node}
+	if peer.Role != "" {
+		session.roles[peer.PeerID] = peer.Role
+	}
+	session.mu.Unlock()
+
+	// Sync replays of a peer we already know about are not news.
+	if known && existing.node == event.Node {
+		return
+	}
+	s.broadcastLocal(session.id, peer.PeerID, peerJoinedMessage(session.id, peer))
+	s.checkMeshThreshold(session, "")
+}
+
+// remotePeerLeft removes a peer that left on node, unless it has since
+// moved to another node.
+func (s *Server) remotePeerLeft(sessionID, peerID, node string) {
+	session := s.getSession(sessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.Lock()
+	peer, exists := session.remote[peerID]
+	if !exists || peer.node != node {
+		session.mu.Unlock()
+		return
+	}
+	if peer.expiry != nil {
+		peer.expiry.Stop()
+	}
+	delete(session.remote, peerID)
+	session.mu.Unlock()
+
+	s.broadcastLocal(sessionID, peerID, peerLeftMessage(sessionID, peerID))
+	if session.size() == 0 {
+		s.deleteSessionIfEmpty(session)
+		return
+	}
+	s.admitIfLobbyOpen(session)
+}
+
+// remoteNodeDown gives the peers of a node that shut down resumeGracePeriod
+// to rejoin through another node before they are reported as gone.
+func (s *Server) remoteNodeDown(node string) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	for _, session := range sessions {
+		session.mu.Lock()
+		// Lobby connections die with their node.
+		var gone []PeerInfo
+		for peerID, waiting := range session.waiting {
+			if waiting.node == node {
+				delete(session.waiting, peerID)
+				gone = append(gone, waiting.info)
+			}
+		}
+		for peerID, peer := range session.remote {
+			if peer.node != node || peer.expiry != nil {
+				continue
+			}
+			sessionID := session.id
+			peer.expiry = time.AfterFunc(resumeGracePeriod, func() {
+				s.remotePeerLeft(sessionID, peerID, node)
+			})
+			session.remote[peerID] = peer
+		}
+		session.mu.Unlock()
+
+		for _, peer := range gone {
+			s.sendToModerators(session, lobbyMessage(MessageTypeLobbyLeft, session.id, peer))
+		}
+	}
+	log.Printf("Node %s went down, holding its peers for %v", node, resumeGracePeriod)
+}
+
+// announceState publishes this node's sessions and connected peers, for a
+// node that just started.
+func (s *Server) announceState() {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	for _, session := range sessions {
+		session.mu.RLock()
+		locked := session.locked
+		peers := make([]PeerInfo, 0, len(session.clients))
+		for _, client := range session.clients {
+			peers = append(peers, client.info())
+		}
+		var waiting []PeerInfo
+		for _, peer := range session.waiting {
+			if peer.client != nil {
+				waiting = append(waiting, peer.info)
+			}
+		}
+		session.mu.RUnlock()
+
+		created := session.event(eventSessionCreated)
+		created.Locked = locked
+		s.publish(created)
+		for _, peer := range peers {
+			event := session.event(eventPeerJoined)
+			event.Peer = &peer
+			s.publish(event)
+		}
+		for _, peer := range waiting {
+			s.publish(clusterEvent{Kind: eventLobbyRequest, SessionID: session.id, Peer: &peer})
+		}
+	}
+}
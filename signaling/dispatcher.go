@@ -0,0 +1,274 @@
+package signaling
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDispatchQueueSize = 64
+
+	// dispatchIdleTimeout is how long a peer's worker waits for another
+	// message before it exits. A new worker is started on the next message.
+	dispatchIdleTimeout = 30 * time.Second
+
+	// dispatchFullTimeout is how long Dispatch waits on a full queue before
+	// dropping a message that is not part of a negotiation. It is well
+	// under the client's read deadline, so a busy handler cannot stop pongs
+	// from being read.
+	dispatchFullTimeout = 2 * time.Second
+)
+
+// Dispatcher delivers incoming messages to handlers and subscribers. Messages
+// from the same peer are delivered one at a time in arrival order, while
+// messages from different peers are handled concurrently. Each peer has a
+// bounded queue; Dispatch blocks when it is full, which in turn stops the
+// client from reading further messages off the socket.
+//
+// Offers, answers and candidates wait for as long as it takes, since losing
+// one leaves the peer connection stuck half negotiated. If that outlasts the
+// read deadline the client reconnects and the negotiation starts over. Other
+// messages wait up to dispatchFullTimeout and are then dropped and counted.
+type Dispatcher struct {
+	queueSize     int
+	idleTimeout   time.Duration
+	fullTimeout   time.Duration
+	handlers      map[MessageType][]MessageHandler
+	queues        map[string]*peerQueue
+	subscriptions map[*subscription]struct{}
+	done          chan struct{}
+	closed        bool
+	dropped       atomic.Uint64
+	mu            sync.RWMutex
+}
+
+type DispatcherConfig struct {
+	// QueueSize is the number of messages buffered per peer. Defaults to 64.
+	QueueSize int
+}
+
+type peerQueue struct {
+	peerID   string
+	messages chan *SignalingMessage
+	// pending counts queued and in-flight messages, guarded by Dispatcher.mu.
+	pending int
+}
+
+type subscription struct {
+	types    map[MessageType]bool
+	messages chan *SignalingMessage
+	ctx      context.Context
+	senders  sync.WaitGroup
+}
+
+func NewDispatcher(config DispatcherConfig) *Dispatcher {
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultDispatchQueueSize
+	}
+
+	return &Dispatcher{
+		queueSize:     queueSize,
+		idleTimeout:   dispatchIdleTimeout,
+		fullTimeout:   dispatchFullTimeout,
+		handlers:      make(map[MessageType][]MessageHandler),
+		queues:        make(map[string]*peerQueue),
+		subscriptions: make(map[*subscription]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (d *Dispatcher) On(msgType MessageType, handler MessageHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers[msgType] = append(d.handlers[msgType], handler)
+}
+
+// Subscribe returns a channel that receives messages of the given types, or
+// of every type if none are given. Delivery follows the same per-peer
+// ordering as handlers, and a slow reader holds up that peer's queue. The
+// channel is closed once ctx is done or the dispatcher is closed.
+func (d *Dispatcher) Subscribe(ctx context.Context, types ...MessageType) <-chan *SignalingMessage {
+	sub := &subscription{
+		messages: make(chan *SignalingMessage, d.queueSize),
+		ctx:      ctx,
+	}
+	if len(types) > 0 {
+		sub.types = make(map[MessageType]bool, len(types))
+		for _, msgType := range types {
+			sub.types[msgType] = true
+		}
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		close(sub.messages)
+		return sub.messages
+	}
+	d.subscriptions[sub] = struct{}{}
+	d.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-d.done:
+		}
+
+		d.mu.Lock()
+		delete(d.subscriptions, sub)
+		d.mu.Unlock()
+
+		// No new sends can start once the subscription is removed, so the
+		// channel can be closed after the in-flight ones finish.
+		sub.senders.Wait()
+		close(sub.messages)
+	}()
+
+	return sub.messages
+}
+
+func (s *subscription) wants(msgType MessageType) bool {
+	return s.types == nil || s.types[msgType]
+}
+
+// Dispatch queues msg behind earlier messages from the same peer. While that
+// peer's queue is full it waits, for a negotiation message until there is
+// room and otherwise up to dispatchFullTimeout before dropping msg. It
+// returns false only if the dispatcher was closed.
+func (d *Dispatcher) Dispatch(msg *SignalingMessage) bool {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return false
+	}
+	queue, exists := d.queues[msg.PeerID]
+	if !exists {
+		queue = &peerQueue{
+			peerID:   msg.PeerID,
+			messages: make(chan *SignalingMessage, d.queueSize),
+		}
+		d.queues[msg.PeerID] = queue
+		go d.runQueue(queue)
+	}
+	queue.pending++
+	d.mu.Unlock()
+
+	select {
+	case queue.messages <- msg:
+		return true
+	default:
+	}
+
+	log.Printf("Dispatch queue for peer %s is full, waiting", msg.PeerID)
+
+	var expired <-chan time.Time
+	if !isNegotiation(msg.Type) {
+		timer := time.NewTimer(d.fullTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case queue.messages <- msg:
+		return true
+	case <-expired:
+		d.mu.Lock()
+		queue.pending--
+		d.mu.Unlock()
+		d.dropped.Add(1)
+		log.Printf("Dropped %s message from peer %s: dispatch queue full", msg.Type, msg.PeerID)
+		return true
+	case <-d.done:
+		d.mu.Lock()
+		queue.pending--
+		d.mu.Unlock()
+		return false
+	}
+}
+
+func isNegotiation(msgType MessageType) bool {
+	return msgType == MessageTypeOffer || msgType == MessageTypeAnswer || msgType == MessageTypeCandidate
+}
+
+// Dropped returns how many messages were dropped because their peer's
+// queue stayed full.
+func (d *Dispatcher) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+func (d *Dispatcher) runQueue(queue *peerQueue) {
+	idle := time.NewTimer(d.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case msg := <-queue.messages:
+			d.deliver(msg)
+
+			d.mu.Lock()
+			queue.pending--
+			d.mu.Unlock()
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(d.idleTimeout)
+		case <-idle.C:
+			d.mu.Lock()
+			if queue.pending == 0 {
+				delete(d.queues, queue.peerID)
+				d.mu.Unlock()
+				return
+			}
+			d.mu.Unlock()
+			idle.Reset(d.idleTimeout)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(msg *SignalingMessage) {
+	d.mu.RLock()
+	handlers := d.handlers[msg.Type]
+	var subs []*subscription
+	for sub := range d.subscriptions {
+		if sub.wants(msg.Type) {
+			sub.senders.Add(1)
+			subs = append(subs, sub)
+		}
+	}
+	d.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+
+	for _, sub := range subs {
+		select {
+		case sub.messages <- msg:
+		case <-sub.ctx.Done():
+		case <-d.done:
+		}
+		sub.senders.Done()
+	}
+}
+
+// Close stops all workers and closes every subscription channel. Messages
+// still queued are discarded. It does not wait for running handlers, so it
+// is safe to call from inside one.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.closed = true
+	close(d.done)
+}
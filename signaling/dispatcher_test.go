@@ -0,0 +1,242 @@
+package signaling
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dispatchMessage(msgType MessageType, peerID string, n int) *SignalingMessage {
+	return &SignalingMessage{Type: msgType, PeerID: peerID, Payload: []byte(strconv.Itoa(n))}
+}
+
+// dispatchAsync runs Dispatch on its own goroutine, reporting on the
+// returned channel when it returns.
+func dispatchAsync(d *Dispatcher, msg *SignalingMessage) chan bool {
+	done := make(chan bool, 1)
+	go func() { done <- d.Dispatch(msg) }()
+	return done
+}
+
+func TestDispatcherKeepsPeerOrder(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{QueueSize: 4})
+	defer d.Close()
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	d.On(MessageTypeCandidate, func(msg *SignalingMessage) {
+		mu.Lock()
+		received[msg.PeerID] = append(received[msg.PeerID], string(msg.Payload))
+		mu.Unlock()
+	})
+
+	const count = 200
+	for i := range count {
+		for _, peerID := range []string{"a", "b"} {
+			if !d.Dispatch(dispatchMessage(MessageTypeCandidate, peerID, i)) {
+				t.Fatal("Dispatch failed on an open dispatcher")
+			}
+		}
+	}
+
+	waitFor(t, "every message", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["a"]) == count && len(received["b"]) == count
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for peerID, payloads := range received {
+		for i, payload := range payloads {
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("peer %s message %d was %s", peerID, i, payload)
+			}
+		}
+	}
+}
+
+func TestDispatcherPeersProgressIndependently(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{})
+	defer d.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	handled := make(chan string, 1)
+	d.On(MessageTypeOffer, func(msg *SignalingMessage) {
+		if msg.PeerID == "slow" {
+			<-release
+			return
+		}
+		handled <- msg.PeerID
+	})
+
+	d.Dispatch(dispatchMessage(MessageTypeOffer, "slow", 0))
+	d.Dispatch(dispatchMessage(MessageTypeOffer, "fast", 0))
+
+	select {
+	case peerID := <-handled:
+		if peerID != "fast" {
+			t.Fatalf("handled %s", peerID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a blocked peer held up another peer's messages")
+	}
+}
+
+func TestDispatcherFullQueue(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{QueueSize: 1})
+	d.fullTimeout = 50 * time.Millisecond
+	defer d.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var mu sync.Mutex
+	var handled []MessageType
+	handler := func(msg *SignalingMessage) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		handled = append(handled, msg.Type)
+		mu.Unlock()
+	}
+	d.On(MessageTypeChat, handler)
+	d.On(MessageTypeAnswer, handler)
+
+	// One message is being handled and one fills the queue.
+	d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 0))
+	<-started
+	d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 1))
+
+	// A chat message gives up after the timeout and is dropped.
+	start := time.Now()
+	if !d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 2)) {
+		t.Fatal("Dispatch failed on an open dispatcher")
+	}
+	if elapsed := time.Since(start); elapsed < d.fullTimeout {
+		t.Fatalf("Dispatch returned after %v, before the timeout", elapsed)
+	}
+	if dropped := d.Dropped(); dropped != 1 {
+		t.Fatalf("dropped %d messages, want 1", dropped)
+	}
+
+	// An answer waits for room however long it takes.
+	answered := dispatchAsync(d, dispatchMessage(MessageTypeAnswer, "peer", 3))
+	select {
+	case <-answered:
+		t.Fatal("answer was not held back by the full queue")
+	case <-time.After(4 * d.fullTimeout):
+	}
+	close(release)
+	if ok := <-answered; !ok {
+		t.Fatal("Dispatch of the answer failed")
+	}
+
+	waitFor(t, "queued messages", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 3
+	})
+	if handled[2] != MessageTypeAnswer || d.Dropped() != 1 {
+		t.Fatalf("handled %v with %d dropped, want the answer last and one drop", handled, d.Dropped())
+	}
+}
+
+func TestDispatcherCloseReleasesBlockedDispatch(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{QueueSize: 1})
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	d.On(MessageTypeOffer, func(msg *SignalingMessage) {
+		if string(msg.Payload) == "0" {
+			close(started)
+		}
+		<-release
+	})
+
+	d.Dispatch(dispatchMessage(MessageTypeOffer, "peer", 0))
+	<-started
+	d.Dispatch(dispatchMessage(MessageTypeOffer, "peer", 1))
+	blocked := dispatchAsync(d, dispatchMessage(MessageTypeOffer, "peer", 2))
+
+	d.Close()
+	select {
+	case ok := <-blocked:
+		if ok {
+			t.Fatal("Dispatch succeeded on a closed dispatcher")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release a blocked Dispatch")
+	}
+	if d.Dispatch(dispatchMessage(MessageTypeOffer, "peer", 3)) {
+		t.Fatal("Dispatch succeeded after Close")
+	}
+}
+
+func TestDispatcherIdleWorkerExits(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{})
+	d.idleTimeout = 20 * time.Millisecond
+	defer d.Close()
+
+	handled := make(chan string, 2)
+	d.On(MessageTypeChat, func(msg *SignalingMessage) {
+		handled <- string(msg.Payload)
+	})
+	queues := func() int {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return len(d.queues)
+	}
+
+	d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 0))
+	<-handled
+	waitFor(t, "idle worker to exit", func() bool { return queues() == 0 })
+
+	// The next message starts a new worker.
+	d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 1))
+	if payload := <-handled; payload != "1" {
+		t.Fatalf("handled %s", payload)
+	}
+}
+
+func TestDispatcherSubscribe(t *testing.T) {
+	d := NewDispatcher(DispatcherConfig{})
+	defer d.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	offers := d.Subscribe(ctx, MessageTypeOffer)
+	all := d.Subscribe(context.Background())
+
+	d.Dispatch(dispatchMessage(MessageTypeChat, "peer", 0))
+	d.Dispatch(dispatchMessage(MessageTypeOffer, "peer", 1))
+
+	if msg := <-offers; msg.Type != MessageTypeOffer {
+		t.Fatalf("offer subscription received %s", msg.Type)
+	}
+	for _, want := range []MessageType{MessageTypeChat, MessageTypeOffer} {
+		if msg := <-all; msg.Type != want {
+			t.Fatalf("subscription received %s, want %s", msg.Type, want)
+		}
+	}
+
+	// Cancelling the context closes only that subscription.
+	cancel()
+	for range offers {
+		t.Fatal("offer subscription received a message after cancel")
+	}
+
+	// Closing the dispatcher closes the rest, and later subscriptions start
+	// closed.
+	d.Close()
+	for range all {
+		t.Fatal("subscription received a message after Close")
+	}
+	if _, ok := <-d.Subscribe(context.Background()); ok {
+		t.Fatal("subscription on a closed dispatcher received a message")
+	}
+}
@@ -0,0 +1,96 @@
+package signaling
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HeartbeatConfig controls websocket keepalive. Both ends ping at
+// PingInterval, and a connection that has received nothing, not even a ping
+// or pong, for PingInterval+PongTimeout is treated as dead.
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// WriteTimeout bounds every write, pings included.
+	WriteTimeout time.Duration
+}
+
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		PingInterval: 15 * time.Second,
+		PongTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+func (h HeartbeatConfig) withDefaults() HeartbeatConfig {
+	defaults := DefaultHeartbeatConfig()
+	if h.PingInterval <= 0 {
+		h.PingInterval = defaults.PingInterval
+	}
+	if h.PongTimeout <= 0 {
+		h.PongTimeout = defaults.PongTimeout
+	}
+	if h.WriteTimeout <= 0 {
+		h.WriteTimeout = defaults.WriteTimeout
+	}
+	return h
+}
+
+func (h HeartbeatConfig) readTimeout() time.Duration {
+	return h.PingInterval + h.PongTimeout
+}
+
+// rttMeter measures round-trip time from pings that carry their send time
+// and the pongs echoing it back.
+type rttMeter struct {
+	rtt atomic.Int64
+}
+
+func (m *rttMeter) get() time.Duration {
+	return time.Duration(m.rtt.Load())
+}
+
+func (m *rttMeter) observe(appData string) {
+	if len(appData) != 8 {
+		return
+	}
+	sent := int64(binary.BigEndian.Uint64([]byte(appData)))
+	if rtt := time.Now().UnixNano() - sent; rtt >= 0 {
+		m.rtt.Store(rtt)
+	}
+}
+
+// startHeartbeat arms conn's read deadline and keeps extending it whenever a
+// ping or pong arrives. Call extendReadDeadline after every message read.
+func startHeartbeat(conn *websocket.Conn, h HeartbeatConfig, meter *rttMeter) {
+	extendReadDeadline(conn, h)
+
+	conn.SetPongHandler(func(appData string) error {
+		meter.observe(appData)
+		return extendReadDeadline(conn, h)
+	})
+	conn.SetPingHandler(func(appData string) error {
+		if err := extendReadDeadline(conn, h); err != nil {
+			return err
+		}
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(h.WriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+}
+
+func extendReadDeadline(conn *websocket.Conn, h HeartbeatConfig) error {
+	return conn.SetReadDeadline(time.Now().Add(h.readTimeout()))
+}
+
+func sendPing(conn *websocket.Conn, h HeartbeatConfig) error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	return conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(h.WriteTimeout))
+}
@@ -0,0 +1,63 @@
+package signaling
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// InviteScheme is the URI scheme of invite links.
+const InviteScheme = "zero"
+
+// Invite is a link to a session, written as
+// zero://join/<code>?server=<signaling websocket URL>. The session may be
+// named by its meeting code or, once that has expired, its ID.
+type Invite struct {
+	Session   string
+	ServerURL string
+}
+
+// String formats the invite as a zero:// URI.
+func (i Invite) String() string {
+	u := url.URL{
+		Scheme: InviteScheme,
+		Host:   "join",
+		Path:   "/" + i.Session,
+	}
+	if i.ServerURL != "" {
+		u.RawQuery = url.Values{"server": {i.ServerURL}}.Encode()
+	}
+	return u.String()
+}
+
+// ParseInvite parses a zero://join/ URI. The server is optional, leaving
+// the choice to the client's configuration, but must be a ws:// or wss://
+// URL if given.
+func ParseInvite(uri string) (*Invite, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %w", err)
+	}
+	if u.Scheme != InviteScheme || u.Host != "join" {
+		return nil, fmt.Errorf("invalid invite: not a %s://join/ link", InviteScheme)
+	}
+
+	session := strings.Trim(u.Path, "/")
+	if code, ok := NormalizeMeetingCode(session); ok {
+		session = code
+	} else if _, err := uuid.Parse(session); err != nil {
+		return nil, fmt.Errorf("invalid invite: %q is not a meeting code or session ID", session)
+	}
+
+	serverURL := u.Query().Get("server")
+	if serverURL != "" {
+		server, err := url.Parse(serverURL)
+		if err != nil || (server.Scheme != "ws" && server.Scheme != "wss") || server.Host == "" {
+			return nil, fmt.Errorf("invalid invite: server %q is not a ws:// or wss:// URL", serverURL)
+		}
+	}
+
+	return &Invite{Session: session, ServerURL: serverURL}, nil
+}
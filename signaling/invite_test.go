@@ -0,0 +1,56 @@
+package signaling
+
+import "testing"
+
+func TestParseInvite(t *testing.T) {
+	const sessionID = "550e8400-e29b-41d4-a716-446655440000"
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    Invite
+		wantErr bool
+	}{
+		{"code", "zero://join/bok-dame-rit", Invite{Session: "bok-dame-rit"}, false},
+		{"code typed loosely", " zero://join/BOKDAMERIT ", Invite{Session: "bok-dame-rit"}, false},
+		{"session ID", "zero://join/" + sessionID, Invite{Session: sessionID}, false},
+		{"with server", "zero://join/bok-dame-rit?server=wss%3A%2F%2Fzero.example%2Fws", Invite{Session: "bok-dame-rit", ServerURL: "wss://zero.example/ws"}, false},
+		{"wrong scheme", "https://join/bok-dame-rit", Invite{}, true},
+		{"wrong host", "zero://call/bok-dame-rit", Invite{}, true},
+		{"missing session", "zero://join/", Invite{}, true},
+		{"invalid session", "zero://join/not-a-code!", Invite{}, true},
+		{"server not websocket", "zero://join/bok-dame-rit?server=https%3A%2F%2Fzero.example", Invite{}, true},
+		{"server without host", "zero://join/bok-dame-rit?server=ws%3A%2F%2F", Invite{}, true},
+		{"not a URI", "zero://join/%zz", Invite{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseInvite(tt.uri)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseInvite(%q) = %+v, want an error", tt.uri, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseInvite(%q): %v", tt.uri, err)
+			}
+			if *got != tt.want {
+				t.Fatalf("ParseInvite(%q) = %+v, want %+v", tt.uri, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInviteRoundTrip(t *testing.T) {
+	invite := Invite{Session: "bok-dame-rit", ServerURL: "wss://zero.example/ws?room=1"}
+
+	got, err := ParseInvite(invite.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != invite {
+		t.Fatalf("ParseInvite(%q) = %+v, want %+v", invite.String(), *got, invite)
+	}
+}
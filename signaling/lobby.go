@@ -0,0 +1,335 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitingPeer is a peer in a session's lobby. client is nil for peers
+// waiting on another node.
+type waitingPeer struct {
+	info   PeerInfo
+	client *ServerClient
+	node   string
+}
+
+var errNotWaiting = errors.New("peer is not waiting in the lobby")
+
+// needsAdmission reports whether client has to wait in the lobby. Hosts and
+// co-hosts go straight in, as do members rejoining under their peer ID.
+func (s *Server) needsAdmission(session *Session, client *ServerClient) bool {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if !session.lobbyActiveLocked() || roleRank(client.role) > 0 {
+		return false
+	}
+	_, member := session.clients[client.peerID]
+	_, remote := session.remote[client.peerID]
+	return !member && !remote
+}
+
+// enterLobby parks client in the session's lobby and asks the hosts and
+// co-hosts on every node to admit it.
+func (s *Server) enterLobby(session *Session, client *ServerClient) error {
+	session.mu.Lock()
+	if session.removed[client.peerID] {
+		session.mu.Unlock()
+		return errPeerRemoved
+	}
+	if session.locked {
+		session.mu.Unlock()
+		return errRoomLocked
+	}
+	info := client.info()
+	session.waiting[client.peerID] = waitingPeer{info: info, client: client, node: s.nodeID}
+	session.mu.Unlock()
+
+	s.sendMessage(client, &SignalingMessage{
+		Type:      MessageTypeLobbyWaiting,
+		SessionID: session.id,
+		PeerID:    client.peerID,
+	})
+	s.sendToModerators(session, lobbyMessage(MessageTypeLobbyRequest, session.id, info))
+	s.publish(clusterEvent{Kind: eventLobbyRequest, SessionID: session.id, Peer: &info})
+
+	log.Printf("Client %s is waiting to be admitted to session %s", client.peerID, session.id)
+	return nil
+}
+
+// lobbyActiveLocked reports whether new participants have to wait: the
+// session has a lobby, or a peer was kicked and someone can admit them.
+// session.mu must be held.
+func (session *Session) lobbyActiveLocked() bool {
+	if session.lobby {
+		return true
+	}
+	if !session.guarded {
+		return false
+	}
+	for _, client := range session.clients {
+		if roleRank(client.role) > 0 {
+			return true
+		}
+	}
+	for _, peer := range session.remote {
+		if roleRank(peer.info.Role) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// admitIfLobbyOpen lets in everyone waiting on this node once nothing
+// holds them back, as when the lobby is turned off or the last host of a
+// guarded session leaves.
+func (s *Server) admitIfLobbyOpen(session *Session) {
+	session.mu.RLock()
+	var peerIDs []string
+	if !session.lobbyActiveLocked() {
+		for peerID, waiting := range session.waiting {
+			if waiting.client != nil {
+				peerIDs = append(peerIDs, peerID)
+			}
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, peerID := range peerIDs {
+		if err := s.resolveLocalWaiting(session, peerID, true); err != nil && !errors.Is(err, errNotWaiting) {
+			log.Printf("Failed to admit %s to session %s: %v", peerID, session.id, err)
+		}
+	}
+}
+
+// setLobby turns the session's lobby on or off. Turning it off also lifts
+// the guard a kick put up, and lets in everyone waiting.
+func (s *Server) setLobby(session *Session, lobby bool) {
+	session.mu.Lock()
+	changed := session.lobby != lobby || (!lobby && session.guarded)
+	session.lobby = lobby
+	if !lobby {
+		session.guarded = false
+	}
+	session.mu.Unlock()
+
+	if changed {
+		s.sendSessionInfoToAll(session, "")
+	}
+	s.admitIfLobbyOpen(session)
+}
+
+func (s *Server) isWaiting(client *ServerClient) bool {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return false
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return session.waiting[client.peerID].client == client
+}
+
+// leaveLobby takes client out of the lobby if it is waiting there, and
+// reports whether it was.
+func (s *Server) leaveLobby(client *ServerClient) bool {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return false
+	}
+
+	session.mu.Lock()
+	waiting, exists := session.waiting[client.peerID]
+	if !exists || waiting.client != client {
+		session.mu.Unlock()
+		return false
+	}
+	delete(session.waiting, client.peerID)
+	session.mu.Unlock()
+
+	s.lobbyResolved(session, waiting.info)
+	log.Printf("Client %s gave up waiting for session %s", client.peerID, session.id)
+	return true
+}
+
+// resolveWaiting admits or denies peerID, handing the decision to the node
+// the peer is connected to if it is not this one.
+func (s *Server) resolveWaiting(session *Session, peerID string, admit bool) error {
+	session.mu.RLock()
+	waiting, exists := session.waiting[peerID]
+	session.mu.RUnlock()
+
+	if !exists {
+		return errNotWaiting
+	}
+	if waiting.client == nil {
+		kind := eventDeny
+		if admit {
+			kind = eventAdmit
+		}
+		s.publish(clusterEvent{Kind: kind, SessionID: session.id, PeerID: peerID})
+		return nil
+	}
+	return s.resolveLocalWaiting(session, peerID, admit)
+}
+
+// resolveLocalWaiting admits or denies a peer waiting on this node. An
+// admitted peer joins as if it had just sent its join; if the session has
+// no room for it, it stays in the lobby.
+func (s *Server) resolveLocalWaiting(session *Session, peerID string, admit bool) error {
+	session.mu.Lock()
+	waiting, exists := session.waiting[peerID]
+	if !exists || waiting.client == nil {
+		session.mu.Unlock()
+		return errNotWaiting
+	}
+	delete(session.waiting, peerID)
+	session.mu.Unlock()
+
+	client := waiting.client
+	if !admit {
+		s.lobbyResolved(session, waiting.info)
+		s.sendNotice(client, MessageTypeLobbyDenied, "the host did not let you in")
+		client.closeAfterFlush(websocket.CloseNormalClosure, "not admitted")
+		log.Printf("Client %s was denied entry to session %s", peerID, session.id)
+		return nil
+	}
+
+	if err := s.addClientToSession(session.id, client, true); err != nil {
+		session.mu.Lock()
+		session.waiting[peerID] = waiting
+		session.mu.Unlock()
+		return err
+	}
+	s.lobbyResolved(session, waiting.info)
+	s.notifyPeerJoined(client)
+	s.completeJoin(client, false)
+	log.Printf("Client %s was admitted to session %s", peerID, session.id)
+
+	// The connection may have dropped while it waited, after its read
+	// pump looked for it in the lobby.
+	select {
+	case <-client.done:
+		s.suspendClient(client)
+	default:
+	}
+	return nil
+}
+
+// lobbyResolved tells the hosts and co-hosts on every node that peer is no
+// longer waiting.
+func (s *Server) lobbyResolved(session *Session, peer PeerInfo) {
+	s.sendToModerators(session, lobbyMessage(MessageTypeLobbyLeft, session.id, peer))
+	s.publish(clusterEvent{Kind: eventLobbyLeft, SessionID: session.id, PeerID: peer.PeerID})
+}
+
+// closeLobby turns away everyone waiting on this node, for a session that
+// has ended.
+func (s *Server) closeLobby(session *Session, reason string) {
+	session.mu.Lock()
+	var clients []*ServerClient
+	for peerID, waiting := range session.waiting {
+		if waiting.client != nil {
+			clients = append(clients, waiting.client)
+		}
+		delete(session.waiting, peerID)
+	}
+	session.mu.Unlock()
+
+	for _, client := range clients {
+		s.sendNotice(client, MessageTypeLobbyDenied, reason)
+		client.closeAfterFlush(websocket.CloseNormalClosure, "session ended")
+	}
+}
+
+func (s *Server) remoteLobbyRequest(session *Session, peer PeerInfo, node string) {
+	session.mu.Lock()
+	_, known := session.waiting[peer.PeerID]
+	session.waiting[peer.PeerID] = waitingPeer{info: peer, node: node}
+	session.mu.Unlock()
+
+	if !known {
+		s.sendToModerators(session, lobbyMessage(MessageTypeLobbyRequest, session.id, peer))
+	}
+}
+
+func (s *Server) remoteLobbyLeft(session *Session, peerID, node string) {
+	session.mu.Lock()
+	waiting, exists := session.waiting[peerID]
+	if !exists || waiting.node != node {
+		session.mu.Unlock()
+		return
+	}
+	delete(session.waiting, peerID)
+	session.mu.Unlock()
+
+	s.sendToModerators(session, lobbyMessage(MessageTypeLobbyLeft, session.id, waiting.info))
+}
+
+// sendLobbyRequests brings a host or co-host that just joined up to date
+// with who is waiting.
+func (s *Server) sendLobbyRequests(session *Session, client *ServerClient) {
+	session.mu.RLock()
+	peers := make([]PeerInfo, 0, len(session.waiting))
+	for _, waiting := range session.waiting {
+		peers = append(peers, waiting.info)
+	}
+	session.mu.RUnlock()
+
+	for _, peer := range peers {
+		if message := lobbyMessage(MessageTypeLobbyRequest, session.id, peer); message != nil {
+			select {
+			case client.send <- message:
+			default:
+				log.Printf("Failed to send lobby request to client %s", client.peerID)
+				s.metrics.SendDropped()
+			}
+		}
+	}
+}
+
+// sendToModerators sends message to the session's hosts and co-hosts on
+// this node.
+func (s *Server) sendToModerators(session *Session, message []byte) {
+	if message == nil {
+		return
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	for peerID, client := range session.clients {
+		if roleRank(client.role) == 0 {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			log.Printf("Failed to send lobby message to client %s", peerID)
+			s.metrics.SendDropped()
+		}
+	}
+}
+
+func lobbyMessage(msgType MessageType, sessionID string, peer PeerInfo) []byte {
+	payload, _ := json.Marshal(LobbyPayload{
+		PeerID:   peer.PeerID,
+		Username: peer.Username,
+	})
+
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:      msgType,
+		SessionID: sessionID,
+		PeerID:    peer.PeerID,
+		Payload:   payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal %s message: %v", msgType, fmt.Errorf("peer %s: %w", peer.PeerID, err))
+		return nil
+	}
+	return msgBytes
+}
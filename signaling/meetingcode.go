@@ -0,0 +1,132 @@
+package signaling
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// DefaultMeetingCodeTTL is how long a meeting code resolves to its session.
+const DefaultMeetingCodeTTL = 24 * time.Hour
+
+const (
+	// Letters that are easy to read out and hard to confuse; l and q are
+	// left out, as are x and y.
+	codeConsonants = "bcdfghjkmnprstvwz"
+	codeVowels     = "aeiou"
+
+	// maxCodeAttempts bounds the search for an unused code. With about
+	// 1.5e10 codes a collision is already unlikely.
+	maxCodeAttempts = 10
+)
+
+// codePattern spells out a code in consonants (c) and vowels (v), with
+// dashes between groups, like "bok-dame-rit".
+var codePattern = []string{"cvc", "cvcv", "cvc"}
+
+// newMeetingCode returns a random, pronounceable meeting code.
+func newMeetingCode() (string, error) {
+	groups := make([]string, len(codePattern))
+	for i, pattern := range codePattern {
+		var group strings.Builder
+		for _, kind := range pattern {
+			letters := codeConsonants
+			if kind == 'v' {
+				letters = codeVowels
+			}
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+			if err != nil {
+				return "", fmt.Errorf("failed to generate meeting code: %w", err)
+			}
+			group.WriteByte(letters[n.Int64()])
+		}
+		groups[i] = group.String()
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// NormalizeMeetingCode turns a meeting code as a person might type it, in
+// any case, with or without dashes or spaces, into its canonical form. It
+// reports false if s cannot be a meeting code.
+func NormalizeMeetingCode(s string) (string, bool) {
+	var letters []byte
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			letters = append(letters, byte(r))
+		case r == '-' || r == ' ':
+		default:
+			return "", false
+		}
+	}
+
+	groups := make([]string, 0, len(codePattern))
+	for _, pattern := range codePattern {
+		if len(letters) < len(pattern) {
+			return "", false
+		}
+		groups = append(groups, string(letters[:len(pattern)]))
+		letters = letters[len(pattern):]
+	}
+	if len(letters) > 0 {
+		return "", false
+	}
+	return strings.Join(groups, "-"), true
+}
+
+// assignMeetingCode picks an unused code for a new session. The caller must
+// hold s.mu.
+func (s *Server) assignMeetingCode() (string, error) {
+	now := time.Now()
+	for range maxCodeAttempts {
+		code, err := newMeetingCode()
+		if err != nil {
+			return "", err
+		}
+		if sessionID, taken := s.codes[code]; taken {
+			// A code without its session yet is reserved by a
+			// concurrent createSession.
+			session := s.sessions[sessionID]
+			if session == nil || session.codeValid(now) {
+				continue
+			}
+			delete(s.codes, code)
+		}
+		return code, nil
+	}
+	return "", fmt.Errorf("failed to find an unused meeting code")
+}
+
+// findSession looks a session up by ID or by a meeting code that has not
+// expired.
+func (s *Server) findSession(idOrCode string) *Session {
+	if session := s.getSession(idOrCode); session != nil {
+		return session
+	}
+	code, ok := NormalizeMeetingCode(idOrCode)
+	if !ok {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session := s.sessions[s.codes[code]]
+	if session == nil || session.code != code || !session.codeValid(time.Now()) {
+		return nil
+	}
+	return session
+}
+
+// forgetMeetingCode drops the code of a deleted session, so it can be
+// reused. The caller must hold s.mu.
+func (s *Server) forgetMeetingCode(session *Session) {
+	if session.code != "" && s.codes[session.code] == session.id {
+		delete(s.codes, session.code)
+	}
+}
+
+func (session *Session) codeValid(now time.Time) bool {
+	return session.code != "" && now.Before(session.codeExpiresAt)
+}
@@ -0,0 +1,80 @@
+package signaling
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNormalizeMeetingCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"canonical", "bok-dame-rit", "bok-dame-rit", true},
+		{"upper case", "BOK-Dame-RIT", "bok-dame-rit", true},
+		{"no separators", "bokdamerit", "bok-dame-rit", true},
+		{"spaces", "bok dame rit", "bok-dame-rit", true},
+		{"mixed separators", " bok -dame  rit-", "bok-dame-rit", true},
+		{"regrouped", "bo-kdam-erit", "bok-dame-rit", true},
+		{"digit", "bok-dam3-rit", "", false},
+		{"underscore", "bok_dame_rit", "", false},
+		{"non-ASCII letter", "bök-dame-rit", "", false},
+		{"too short", "bok-dame-ri", "", false},
+		{"too long", "bok-dame-rits", "", false},
+		{"empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NormalizeMeetingCode(tt.input)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("NormalizeMeetingCode(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewMeetingCodeNormalizes(t *testing.T) {
+	for range 100 {
+		code, err := newMeetingCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if normalized, ok := NormalizeMeetingCode(code); !ok || normalized != code {
+			t.Fatalf("NormalizeMeetingCode(%q) = %q, %v", code, normalized, ok)
+		}
+	}
+}
+
+func TestExpiredMeetingCode(t *testing.T) {
+	server, baseURL := newTestServer(t, ServerConfig{})
+	created, err := CreateSession(wsURL(baseURL), CreateSessionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup, err := LookupSession(wsURL(baseURL), created.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookup.SessionID != created.SessionID {
+		t.Fatalf("code %s found session %s, want %s", created.Code, lookup.SessionID, created.SessionID)
+	}
+
+	session := server.getSession(created.SessionID)
+	session.mu.Lock()
+	session.codeExpiresAt = time.Now().Add(-time.Minute)
+	session.mu.Unlock()
+
+	var reqErr *RequestError
+	if _, err := LookupSession(wsURL(baseURL), created.Code); !errors.As(err, &reqErr) || reqErr.Status != http.StatusNotFound {
+		t.Fatalf("expired code lookup error = %v, want 404", err)
+	}
+	if _, err := LookupSession(wsURL(baseURL), created.SessionID); err != nil {
+		t.Fatalf("lookup by ID after the code expired: %v", err)
+	}
+}
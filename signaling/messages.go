@@ -2,6 +2,7 @@ package signaling
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -9,37 +10,209 @@ import (
 type MessageType string
 
 const (
-	MessageTypeJoin       MessageType = "join"
-	MessageTypeLeave      MessageType = "leave"
-	MessageTypeOffer      MessageType = "offer"
-	MessageTypeAnswer     MessageType = "answer"
-	MessageTypeCandidate  MessageType = "candidate"
-	MessageTypePeerJoined MessageType = "peer_joined"
-	MessageTypePeerLeft   MessageType = "peer_left"
-	MessageTypeError      MessageType = "error"
+	MessageTypeJoin           MessageType = "join"
+	MessageTypeJoined         MessageType = "joined"
+	MessageTypeLeave          MessageType = "leave"
+	MessageTypeOffer          MessageType = "offer"
+	MessageTypeAnswer         MessageType = "answer"
+	MessageTypeCandidate      MessageType = "candidate"
+	MessageTypePeerJoined     MessageType = "peer_joined"
+	MessageTypePeerLeft       MessageType = "peer_left"
+	MessageTypeSessionInfo    MessageType = "session_info"
+	MessageTypeNotice         MessageType = "notice"
+	MessageTypeKicked         MessageType = "kicked"
+	MessageTypeSessionClosed  MessageType = "session_closed"
+	MessageTypeServerShutdown MessageType = "server_shutdown"
+	MessageTypeMuteRequest    MessageType = "mute_request"
+	MessageTypeRemovePeer     MessageType = "remove_peer"
+	MessageTypeLockRoom       MessageType = "lock_room"
+	MessageTypeSetRole        MessageType = "set_role"
+	MessageTypeTransferHost   MessageType = "transfer_host"
+	MessageTypeRoleChanged    MessageType = "role_changed"
+	MessageTypeLobbyWaiting   MessageType = "lobby_waiting"
+	MessageTypeLobbyRequest   MessageType = "lobby_request"
+	MessageTypeLobbyLeft      MessageType = "lobby_left"
+	MessageTypeLobbyDenied    MessageType = "lobby_denied"
+	MessageTypeAdmit          MessageType = "admit"
+	MessageTypeDeny           MessageType = "deny"
+	MessageTypeProfileUpdate  MessageType = "profile_update"
+	MessageTypeChat           MessageType = "chat"
+	MessageTypeChatHistory    MessageType = "chat_history"
+	MessageTypeRefreshToken   MessageType = "refresh_token"
+	MessageTypeToken          MessageType = "token"
+	MessageTypeError          MessageType = "error"
+)
+
+// Media kinds a mute_request can turn off.
+const (
+	MediaAudio = "audio"
+	MediaVideo = "video"
 )
 
 type SignalingMessage struct {
-	Type      MessageType     `json:"type"`
-	SessionID string          `json:"session_id"`
-	PeerID    string          `json:"peer_id"`
-	Username  string          `json:"username,omitempty"`
-	Payload   json.RawMessage `json:"payload,omitempty"`
+	Type         MessageType     `json:"type"`
+	SessionID    string          `json:"session_id"`
+	PeerID       string          `json:"peer_id"`
+	TargetPeerID string          `json:"to,omitempty"`
+	Username     string          `json:"username,omitempty"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
 }
 
 type JoinPayload struct {
-	Username string `json:"username"`
+	Username    string `json:"username"`
+	Token       string `json:"token,omitempty"`
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Passcode is checked against the session's passcode, if it has one.
+	Passcode string `json:"passcode,omitempty"`
+	// Profile is how the peer presents itself. Its display name, if set,
+	// replaces the username in the join token.
+	Profile *Profile `json:"profile,omitempty"`
+}
+
+// Profile is how a peer presents itself to others: a display name, a
+// color as "#rrggbb" and a small PNG or JPEG avatar of at most
+// MaxAvatarSize bytes.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Color       string `json:"color,omitempty"`
+	Avatar      []byte `json:"avatar,omitempty"`
+}
+
+// ProfileUpdatePayload changes the sender's profile. The server forwards it
+// to the whole session, sender included, with PeerID set and DisplayName
+// filled in if the sender kept its name.
+type ProfileUpdatePayload struct {
+	PeerID  string  `json:"peer_id,omitempty"`
+	Profile Profile `json:"profile"`
+}
+
+// JoinedPayload acknowledges a join. ResumeToken lets the client rejoin
+// under the same peer ID after losing its connection; Resumed reports
+// whether this join did so.
+type JoinedPayload struct {
+	ResumeToken string `json:"resume_token"`
+	Resumed     bool   `json:"resumed"`
+	Role        string `json:"role,omitempty"`
+	// Username is the name the peer joined under, which a profile's display
+	// name may have changed from the token's.
+	Username string `json:"username,omitempty"`
+	// Token is a fresh join token for this peer, to rejoin with once the
+	// resume token is no longer accepted.
+	Token          string    `json:"token,omitempty"`
+	TokenExpiresAt time.Time `json:"token_expires_at,omitzero"`
+}
+
+// TokenPayload answers refresh_token with a new join token for the sender.
+type TokenPayload struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 type PeerJoinedPayload struct {
 	PeerID   string `json:"peer_id"`
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Avatar   []byte `json:"avatar,omitempty"`
 }
 
 type PeerLeftPayload struct {
 	PeerID string `json:"peer_id"`
 }
 
+type PeerInfo struct {
+	PeerID   string    `json:"peer_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role,omitempty"`
+	Color    string    `json:"color,omitempty"`
+	Avatar   []byte    `json:"avatar,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// SessionInfoPayload describes a session and everyone in it. It is sent to a
+// peer right after it joins and returned by the /sessions endpoints.
+type SessionInfoPayload struct {
+	SessionID string     `json:"session_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Peers     []PeerInfo `json:"peers"`
+	// MaxPeers is the room's capacity, or zero if unlimited.
+	MaxPeers int `json:"max_peers,omitempty"`
+	// UseSFU is set when the room is too big for a full mesh and clients
+	// should route media through an SFU.
+	UseSFU bool `json:"use_sfu,omitempty"`
+	// Locked is set while the room refuses new peers.
+	Locked bool `json:"locked,omitempty"`
+	// Lobby is set if new participants wait for a host to admit them.
+	Lobby bool `json:"lobby,omitempty"`
+	// PasscodeRequired is set if joins must carry the session's passcode.
+	PasscodeRequired bool `json:"passcode_required,omitempty"`
+	// Code is the session's meeting code, until it expires at
+	// CodeExpiresAt.
+	Code          string    `json:"code,omitempty"`
+	CodeExpiresAt time.Time `json:"code_expires_at,omitzero"`
+}
+
+// LobbyPayload names a peer waiting in the lobby, in lobby_request and
+// lobby_left.
+type LobbyPayload struct {
+	PeerID   string `json:"peer_id"`
+	Username string `json:"username,omitempty"`
+}
+
+// ChatPayload is a chat message. Clients send only Text, and To in the
+// envelope for a direct message; the server fills in the rest. Messages
+// sent peer to peer over data channels are stamped by the sender, which
+// hands room-wide ones to the server with their ID and the peers they
+// were Delivered to.
+type ChatPayload struct {
+	ID        string    `json:"id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Text      string    `json:"text"`
+	SentAt    time.Time `json:"sent_at,omitzero"`
+	Delivered []string  `json:"delivered,omitempty"`
+}
+
+// ChatHistoryPayload holds a session's recent room-wide messages, oldest
+// first, for a peer that just joined.
+type ChatHistoryPayload struct {
+	Messages []ChatPayload `json:"messages"`
+}
+
+// MuteRequestPayload asks the target peer to turn off its microphone, or
+// its camera if Media is MediaVideo.
+type MuteRequestPayload struct {
+	Media string `json:"media"`
+}
+
+type LockRoomPayload struct {
+	Locked bool `json:"locked"`
+}
+
+type SetRolePayload struct {
+	Role string `json:"role"`
+}
+
+// RoleChangedPayload announces a peer's new role to the whole session.
+type RoleChangedPayload struct {
+	PeerID string `json:"peer_id"`
+	Role   string `json:"role"`
+}
+
+// NoticePayload carries the text of a notice, or the reason for a kick or
+// a closed session.
+type NoticePayload struct {
+	Message string `json:"message"`
+}
+
+// ShutdownPayload tells clients the server is going away and when to
+// reconnect.
+type ShutdownPayload struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
 type OfferPayload struct {
 	SDP webrtc.SessionDescription `json:"sdp"`
 }
@@ -52,12 +225,36 @@ type CandidatePayload struct {
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
 }
 
+type ErrorCode string
+
+const (
+	ErrorCodeBadRequest       ErrorCode = "bad_request"
+	ErrorCodeAuthRequired     ErrorCode = "auth_required"
+	ErrorCodeInvalidToken     ErrorCode = "invalid_token"
+	ErrorCodeTokenExpired     ErrorCode = "token_expired"
+	ErrorCodePeerMismatch     ErrorCode = "peer_mismatch"
+	ErrorCodeAlreadyJoined    ErrorCode = "already_joined"
+	ErrorCodePeerNotFound     ErrorCode = "peer_not_found"
+	ErrorCodeSessionNotFound  ErrorCode = "session_not_found"
+	ErrorCodePeerRemoved      ErrorCode = "peer_removed"
+	ErrorCodeUnauthorized     ErrorCode = "unauthorized"
+	ErrorCodeRoomFull         ErrorCode = "room_full"
+	ErrorCodeServerFull       ErrorCode = "server_full"
+	ErrorCodeRoomLocked       ErrorCode = "room_locked"
+	ErrorCodeForbidden        ErrorCode = "forbidden"
+	ErrorCodePasscodeRequired ErrorCode = "passcode_required"
+	ErrorCodeInvalidPasscode  ErrorCode = "invalid_passcode"
+	ErrorCodeTooManyAttempts  ErrorCode = "too_many_attempts"
+	ErrorCodeInternal         ErrorCode = "internal"
+)
+
 type ErrorPayload struct {
-	Message string `json:"message"`
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message"`
 }
 
-func NewJoinMessage(sessionID, peerID, username string) (*SignalingMessage, error) {
-	payload, err := json.Marshal(JoinPayload{Username: username})
+func NewJoinMessage(sessionID, peerID string, join JoinPayload) (*SignalingMessage, error) {
+	payload, err := json.Marshal(join)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +262,20 @@ func NewJoinMessage(sessionID, peerID, username string) (*SignalingMessage, erro
 		Type:      MessageTypeJoin,
 		SessionID: sessionID,
 		PeerID:    peerID,
-		Username:  username,
+		Username:  join.Username,
+		Payload:   payload,
+	}, nil
+}
+
+func NewJoinedMessage(sessionID, peerID string, joined JoinedPayload) (*SignalingMessage, error) {
+	payload, err := json.Marshal(joined)
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:      MessageTypeJoined,
+		SessionID: sessionID,
+		PeerID:    peerID,
 		Payload:   payload,
 	}, nil
 }
@@ -78,47 +288,174 @@ func NewLeaveMessage(sessionID, peerID string) *SignalingMessage {
 	}
 }
 
-func NewOfferMessage(sessionID, peerID string, sdp webrtc.SessionDescription) (*SignalingMessage, error) {
+func NewOfferMessage(sessionID, peerID, targetPeerID string, sdp webrtc.SessionDescription) (*SignalingMessage, error) {
 	payload, err := json.Marshal(OfferPayload{SDP: sdp})
 	if err != nil {
 		return nil, err
 	}
 	return &SignalingMessage{
-		Type:      MessageTypeOffer,
+		Type:         MessageTypeOffer,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+func NewAnswerMessage(sessionID, peerID, targetPeerID string, sdp webrtc.SessionDescription) (*SignalingMessage, error) {
+	payload, err := json.Marshal(AnswerPayload{SDP: sdp})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:         MessageTypeAnswer,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+func NewCandidateMessage(sessionID, peerID, targetPeerID string, candidate webrtc.ICECandidateInit) (*SignalingMessage, error) {
+	payload, err := json.Marshal(CandidatePayload{Candidate: candidate})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:         MessageTypeCandidate,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+func NewMuteRequestMessage(sessionID, peerID, targetPeerID, media string) (*SignalingMessage, error) {
+	payload, err := json.Marshal(MuteRequestPayload{Media: media})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:         MessageTypeMuteRequest,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+func NewRemovePeerMessage(sessionID, peerID, targetPeerID string) *SignalingMessage {
+	return &SignalingMessage{
+		Type:         MessageTypeRemovePeer,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+	}
+}
+
+func NewLockRoomMessage(sessionID, peerID string, locked bool) (*SignalingMessage, error) {
+	payload, err := json.Marshal(LockRoomPayload{Locked: locked})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:      MessageTypeLockRoom,
 		SessionID: sessionID,
 		PeerID:    peerID,
 		Payload:   payload,
 	}, nil
 }
 
-func NewAnswerMessage(sessionID, peerID string, sdp webrtc.SessionDescription) (*SignalingMessage, error) {
-	payload, err := json.Marshal(AnswerPayload{SDP: sdp})
+func NewSetRoleMessage(sessionID, peerID, targetPeerID, role string) (*SignalingMessage, error) {
+	payload, err := json.Marshal(SetRolePayload{Role: role})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:         MessageTypeSetRole,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+// NewAdmitMessage lets targetPeerID in from the lobby, or with admit false
+// turns it away.
+func NewAdmitMessage(sessionID, peerID, targetPeerID string, admit bool) *SignalingMessage {
+	msgType := MessageTypeAdmit
+	if !admit {
+		msgType = MessageTypeDeny
+	}
+	return &SignalingMessage{
+		Type:         msgType,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+	}
+}
+
+func NewProfileUpdateMessage(sessionID, peerID string, profile Profile) (*SignalingMessage, error) {
+	payload, err := json.Marshal(ProfileUpdatePayload{Profile: profile})
 	if err != nil {
 		return nil, err
 	}
 	return &SignalingMessage{
-		Type:      MessageTypeAnswer,
+		Type:      MessageTypeProfileUpdate,
 		SessionID: sessionID,
 		PeerID:    peerID,
 		Payload:   payload,
 	}, nil
 }
 
-func NewCandidateMessage(sessionID, peerID string, candidate webrtc.ICECandidateInit) (*SignalingMessage, error) {
-	payload, err := json.Marshal(CandidatePayload{Candidate: candidate})
+func NewChatMessage(sessionID, peerID, targetPeerID, text string) (*SignalingMessage, error) {
+	payload, err := json.Marshal(ChatPayload{Text: text})
 	if err != nil {
 		return nil, err
 	}
 	return &SignalingMessage{
-		Type:      MessageTypeCandidate,
+		Type:         MessageTypeChat,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+		Payload:      payload,
+	}, nil
+}
+
+// NewRecordedChatMessage hands the server a room-wide message the sender
+// has already sent to the delivered peers over data channels.
+func NewRecordedChatMessage(sessionID, peerID string, chat ChatPayload, delivered []string) (*SignalingMessage, error) {
+	payload, err := json.Marshal(ChatPayload{ID: chat.ID, Text: chat.Text, Delivered: delivered})
+	if err != nil {
+		return nil, err
+	}
+	return &SignalingMessage{
+		Type:      MessageTypeChat,
 		SessionID: sessionID,
 		PeerID:    peerID,
 		Payload:   payload,
 	}, nil
 }
 
-func NewErrorMessage(sessionID, peerID, message string) (*SignalingMessage, error) {
-	payload, err := json.Marshal(ErrorPayload{Message: message})
+func NewRefreshTokenMessage(sessionID, peerID string) *SignalingMessage {
+	return &SignalingMessage{
+		Type:      MessageTypeRefreshToken,
+		SessionID: sessionID,
+		PeerID:    peerID,
+	}
+}
+
+func NewTransferHostMessage(sessionID, peerID, targetPeerID string) *SignalingMessage {
+	return &SignalingMessage{
+		Type:         MessageTypeTransferHost,
+		SessionID:    sessionID,
+		PeerID:       peerID,
+		TargetPeerID: targetPeerID,
+	}
+}
+
+func NewErrorMessage(sessionID, peerID string, code ErrorCode, message string) (*SignalingMessage, error) {
+	payload, err := json.Marshal(ErrorPayload{Code: code, Message: message})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,83 @@
+package signaling
+
+import (
+	"time"
+
+	"github.com/javanhut/zero/metrics"
+)
+
+// Metrics receives the events the server reports for monitoring.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	SessionOpened()
+	SessionClosed()
+	ClientConnected()
+	ClientDisconnected()
+	MessageReceived(msgType MessageType)
+	SendDropped()
+	WebSocketError()
+	JoinCompleted(latency time.Duration)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) SessionOpened()              {}
+func (nopMetrics) SessionClosed()              {}
+func (nopMetrics) ClientConnected()            {}
+func (nopMetrics) ClientDisconnected()         {}
+func (nopMetrics) MessageReceived(MessageType) {}
+func (nopMetrics) SendDropped()                {}
+func (nopMetrics) WebSocketError()             {}
+func (nopMetrics) JoinCompleted(time.Duration) {}
+
+// PrometheusMetrics records server events in a metrics.Registry.
+type PrometheusMetrics struct {
+	sessions        *metrics.Gauge
+	clients         *metrics.Gauge
+	messages        *metrics.CounterVec
+	droppedSends    *metrics.Counter
+	websocketErrors *metrics.Counter
+	joinLatency     *metrics.Histogram
+}
+
+func NewPrometheusMetrics(registry *metrics.Registry) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		sessions: registry.NewGauge("zero_signaling_active_sessions",
+			"Sessions currently open on the server."),
+		clients: registry.NewGauge("zero_signaling_connected_clients",
+			"WebSocket connections currently open."),
+		messages: registry.NewCounterVec("zero_signaling_messages_received_total",
+			"Signaling messages received from clients, by type.", "type"),
+		droppedSends: registry.NewCounter("zero_signaling_dropped_sends_total",
+			"Messages dropped because a client's send buffer was full."),
+		websocketErrors: registry.NewCounter("zero_signaling_websocket_errors_total",
+			"Failed upgrades, unexpected closes and write errors."),
+		joinLatency: registry.NewHistogram("zero_signaling_join_duration_seconds",
+			"Time from receiving a join to sending joined.",
+			[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}),
+	}
+}
+
+func (m *PrometheusMetrics) SessionOpened()      { m.sessions.Inc() }
+func (m *PrometheusMetrics) SessionClosed()      { m.sessions.Dec() }
+func (m *PrometheusMetrics) ClientConnected()    { m.clients.Inc() }
+func (m *PrometheusMetrics) ClientDisconnected() { m.clients.Dec() }
+func (m *PrometheusMetrics) SendDropped()        { m.droppedSends.Inc() }
+func (m *PrometheusMetrics) WebSocketError()     { m.websocketErrors.Inc() }
+
+// MessageReceived counts types a client may send by name and everything
+// else as "unknown", so clients cannot grow the label set.
+func (m *PrometheusMetrics) MessageReceived(msgType MessageType) {
+	switch msgType {
+	case MessageTypeJoin, MessageTypeLeave, MessageTypeOffer, MessageTypeAnswer, MessageTypeCandidate,
+		MessageTypeMuteRequest, MessageTypeRemovePeer, MessageTypeLockRoom, MessageTypeSetRole, MessageTypeTransferHost,
+		MessageTypeAdmit, MessageTypeDeny, MessageTypeProfileUpdate, MessageTypeChat, MessageTypeRefreshToken:
+		m.messages.Inc(string(msgType))
+	default:
+		m.messages.Inc("unknown")
+	}
+}
+
+func (m *PrometheusMetrics) JoinCompleted(latency time.Duration) {
+	m.joinLatency.Observe(latency.Seconds())
+}
@@ -0,0 +1,40 @@
+package signaling
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/javanhut/zero/metrics"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	registry := metrics.NewRegistry()
+	server, baseURL := newTestServer(t, ServerConfig{Metrics: NewPrometheusMetrics(registry)})
+	server.Handle("GET /metrics", registry.Handler())
+
+	joinTestClient(t, baseURL)
+
+	status, body := get(t, baseURL+"/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("/metrics = %d", status)
+	}
+
+	for _, line := range []string{
+		"# TYPE zero_signaling_active_sessions gauge",
+		"zero_signaling_active_sessions 1",
+		"# TYPE zero_signaling_connected_clients gauge",
+		"zero_signaling_connected_clients 1",
+		"# TYPE zero_signaling_messages_received_total counter",
+		`zero_signaling_messages_received_total{type="join"} 1`,
+		"# TYPE zero_signaling_join_duration_seconds histogram",
+		`zero_signaling_join_duration_seconds_bucket{le="+Inf"} 1`,
+		"zero_signaling_join_duration_seconds_count 1",
+		"zero_signaling_dropped_sends_total 0",
+		"zero_signaling_websocket_errors_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics is missing %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// roleRank orders roles by authority. A moderator may only act on peers
+// ranked below it.
+func roleRank(role string) int {
+	switch role {
+	case RoleHost:
+		return 2
+	case RoleCoHost:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// handleModeration carries out a host or co-host command after checking
+// the sender may give it. Hosts and co-hosts may mute, turn off the video
+// of and remove peers ranked below them, lock the room and admit or deny
+// peers in the lobby; only the host may change roles or hand over the host
+// role.
+func (s *Server) handleModeration(client *ServerClient, msg *SignalingMessage, rawMsg []byte) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	role := s.peerRole(session.id, client.peerID)
+	allowed := roleRank(role) > 0
+	if msg.Type == MessageTypeSetRole || msg.Type == MessageTypeTransferHost {
+		allowed = role == RoleHost
+	}
+	if !allowed {
+		log.Printf("Rejecting %s from %s: role %s may not send it", msg.Type, client.peerID, role)
+		s.sendError(client, session.id, ErrorCodeForbidden, fmt.Sprintf("a %s may not send %s", role, msg.Type))
+		return
+	}
+
+	if msg.Type == MessageTypeLockRoom {
+		var payload LockRoomPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			s.sendError(client, session.id, ErrorCodeBadRequest, "invalid lock_room payload")
+			return
+		}
+		s.setLocked(session, payload.Locked)
+		s.publish(clusterEvent{Kind: eventRoomLocked, SessionID: session.id, Locked: payload.Locked})
+		log.Printf("Client %s set session %s locked=%t", client.peerID, session.id, payload.Locked)
+		return
+	}
+
+	target := msg.TargetPeerID
+	if target == "" || target == client.peerID {
+		s.sendError(client, session.id, ErrorCodeBadRequest, fmt.Sprintf("%s needs another peer in \"to\"", msg.Type))
+		return
+	}
+
+	if msg.Type == MessageTypeAdmit || msg.Type == MessageTypeDeny {
+		if err := s.resolveWaiting(session, target, msg.Type == MessageTypeAdmit); err != nil {
+			code := ErrorCodeInternal
+			switch {
+			case errors.Is(err, errNotWaiting):
+				code = ErrorCodePeerNotFound
+			case errors.Is(err, errRoomFull):
+				code = ErrorCodeRoomFull
+			case errors.Is(err, errServerFull):
+				code = ErrorCodeServerFull
+			}
+			s.sendError(client, session.id, code, fmt.Sprintf("could not %s %s: %v", msg.Type, target, err))
+			return
+		}
+		log.Printf("Client %s sent %s for %s in session %s", client.peerID, msg.Type, target, session.id)
+		return
+	}
+
+	targetRole := s.peerRole(session.id, target)
+	if targetRole == "" {
+		s.sendError(client, session.id, ErrorCodePeerNotFound, fmt.Sprintf("peer %s not found in session", target))
+		return
+	}
+
+	switch msg.Type {
+	case MessageTypeMuteRequest, MessageTypeRemovePeer:
+		if roleRank(targetRole) >= roleRank(role) {
+			s.sendError(client, session.id, ErrorCodeForbidden, fmt.Sprintf("a %s may not moderate a %s", role, targetRole))
+			return
+		}
+		if msg.Type == MessageTypeRemovePeer {
+			s.kickPeer(session, target)
+			s.publish(clusterEvent{Kind: eventKick, SessionID: session.id, PeerID: target})
+			log.Printf("Client %s removed %s from session %s", client.peerID, target, session.id)
+			return
+		}
+
+		var payload MuteRequestPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil || (payload.Media != MediaAudio && payload.Media != MediaVideo) {
+			s.sendError(client, session.id, ErrorCodeBadRequest, "mute_request media must be audio or video")
+			return
+		}
+		s.sendToPeer(session.id, target, rawMsg)
+
+	case MessageTypeSetRole:
+		var payload SetRolePayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil || (payload.Role != RoleCoHost && payload.Role != RoleParticipant) {
+			s.sendError(client, session.id, ErrorCodeBadRequest, "set_role role must be cohost or participant")
+			return
+		}
+		s.changeRole(session, target, payload.Role)
+
+	case MessageTypeTransferHost:
+		s.changeRole(session, target, RoleHost)
+		s.changeRole(session, client.peerID, RoleCoHost)
+		log.Printf("Client %s handed host of session %s to %s", client.peerID, session.id, target)
+	}
+}
+
+// peerRole returns the role of peerID in the session, on any node, or ""
+// if it is not there.
+func (s *Server) peerRole(sessionID, peerID string) string {
+	session := s.getSession(sessionID)
+	if session == nil {
+		return ""
+	}
+
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if client, exists := session.clients[peerID]; exists {
+		return client.role
+	}
+	if peer, exists := session.remote[peerID]; exists {
+		return peer.info.Role
+	}
+	return ""
+}
+
+// changeRole gives peerID a new role and tells the session on every node.
+func (s *Server) changeRole(session *Session, peerID, role string) {
+	if !s.setRole(session, peerID, role) {
+		return
+	}
+	s.broadcastLocal(session.id, "", roleChangedMessage(session.id, peerID, role))
+	s.publish(clusterEvent{Kind: eventRoleChanged, SessionID: session.id, PeerID: peerID, Role: role})
+	s.admitIfLobbyOpen(session)
+}
+
+func (s *Server) setRole(session *Session, peerID, role string) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if client, exists := session.clients[peerID]; exists {
+		client.role = role
+		session.roles[peerID] = role
+		return true
+	}
+	if peer, exists := session.remote[peerID]; exists {
+		peer.info.Role = role
+		session.remote[peerID] = peer
+		session.roles[peerID] = role
+		return true
+	}
+	return false
+}
+
+// setLocked locks or unlocks the session and sends its peers on this node
+// the new session info.
+func (s *Server) setLocked(session *Session, locked bool) {
+	session.mu.Lock()
+	changed := session.locked != locked
+	session.locked = locked
+	session.mu.Unlock()
+
+	if changed {
+		s.sendSessionInfoToAll(session, "")
+	}
+}
+
+func roleChangedMessage(sessionID, peerID, role string) []byte {
+	payload, _ := json.Marshal(RoleChangedPayload{
+		PeerID: peerID,
+		Role:   role,
+	})
+
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:      MessageTypeRoleChanged,
+		SessionID: sessionID,
+		PeerID:    peerID,
+		Payload:   payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal role changed message: %v", err)
+		return nil
+	}
+	return msgBytes
+}
@@ -0,0 +1,235 @@
+package signaling
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// passcodeIterations makes each guess at a passcode cost a few
+	// milliseconds of PBKDF2-SHA256.
+	passcodeIterations = 100_000
+	passcodeSaltSize   = 16
+	passcodeKeySize    = 32
+
+	maxPasscodeLength = 128
+
+	// Wrong passcodes are counted over passcodeFailureWindow. A join token's
+	// peer ID or a remote address that reaches its limit is refused,
+	// without hashing, until older failures age out. A session under
+	// attack from many addresses only slows down: every check waits
+	// passcodeSessionDelay first, so the right passcode still gets in.
+	passcodeFailureWindow         = 10 * time.Minute
+	maxPasscodeFailuresPerPeer    = 5
+	maxPasscodeFailuresPerAddr    = 20
+	maxPasscodeFailuresPerSession = 100
+	passcodeSessionDelay          = time.Second
+)
+
+var (
+	errPasscodeRequired = errors.New("session requires a passcode")
+	errInvalidPasscode  = errors.New("invalid passcode")
+	errTooManyPasscodes = errors.New("too many wrong passcodes, try again later")
+)
+
+// hashPasscode derives a salted hash of passcode in the form
+// "pbkdf2-sha256$<iterations>$<salt>$<key>", so the server never keeps the
+// passcode itself.
+func hashPasscode(passcode string) (string, error) {
+	salt := make([]byte, passcodeSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate passcode salt: %w", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passcode, salt, passcodeIterations, passcodeKeySize)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash passcode: %w", err)
+	}
+
+	return strings.Join([]string{
+		"pbkdf2-sha256",
+		strconv.Itoa(passcodeIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// checkPasscode reports whether passcode matches a hash from hashPasscode.
+func checkPasscode(hash, passcode string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passcode, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// verifyPasscode checks passcode against the session's, if it has one.
+func (session *Session) verifyPasscode(passcode string) error {
+	session.mu.RLock()
+	hash := session.passcode
+	session.mu.RUnlock()
+
+	switch {
+	case hash == "":
+		return nil
+	case passcode == "":
+		return errPasscodeRequired
+	case !checkPasscode(hash, passcode):
+		return errInvalidPasscode
+	}
+	return nil
+}
+
+// passcodeLimiter counts wrong passcodes by join token peer ID, remote
+// address and session. Each node counts its own.
+type passcodeLimiter struct {
+	perPeer      int
+	perAddr      int
+	perSession   int
+	sessionDelay time.Duration
+
+	mu        sync.Mutex
+	bySession map[string][]time.Time
+	byPeer    map[string][]time.Time
+	byAddr    map[string][]time.Time
+	// swept is when keys nobody has tried since were last dropped.
+	swept time.Time
+}
+
+func newPasscodeLimiter() *passcodeLimiter {
+	return &passcodeLimiter{
+		perPeer:      maxPasscodeFailuresPerPeer,
+		perAddr:      maxPasscodeFailuresPerAddr,
+		perSession:   maxPasscodeFailuresPerSession,
+		sessionDelay: passcodeSessionDelay,
+		bySession:    make(map[string][]time.Time),
+		byPeer:       make(map[string][]time.Time),
+		byAddr:       make(map[string][]time.Time),
+	}
+}
+
+// allow reports whether a passcode for sessionID from peerID at addr may be
+// checked, and how long to wait before checking it.
+func (l *passcodeLimiter) allow(sessionID, peerID, addr string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if recentFailures(l.byPeer, sessionID+"/"+peerID, now) >= l.perPeer ||
+		recentFailures(l.byAddr, addr, now) >= l.perAddr {
+		return false, 0
+	}
+	if recentFailures(l.bySession, sessionID, now) >= l.perSession {
+		return true, l.sessionDelay
+	}
+	return true, 0
+}
+
+func (l *passcodeLimiter) fail(sessionID, peerID, addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= passcodeFailureWindow {
+		for _, failures := range []map[string][]time.Time{l.bySession, l.byPeer, l.byAddr} {
+			for key := range failures {
+				recentFailures(failures, key, now)
+			}
+		}
+		l.swept = now
+	}
+
+	l.bySession[sessionID] = append(l.bySession[sessionID], now)
+	l.byPeer[sessionID+"/"+peerID] = append(l.byPeer[sessionID+"/"+peerID], now)
+	l.byAddr[addr] = append(l.byAddr[addr], now)
+}
+
+// recentFailures drops failures under key older than passcodeFailureWindow
+// and returns how many are left.
+func recentFailures(failures map[string][]time.Time, key string, now time.Time) int {
+	times := failures[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= passcodeFailureWindow {
+		i++
+	}
+	if i == len(times) {
+		delete(failures, key)
+		return 0
+	}
+	failures[key] = times[i:]
+	return len(times) - i
+}
+
+// checkJoinPasscode verifies the passcode sent with a join for claims,
+// telling the client why if it is missing or wrong. Once the limiter
+// refuses the token or address, the connection is closed.
+func (s *Server) checkJoinPasscode(client *ServerClient, claims *JoinClaims, passcode string) bool {
+	session := s.getSession(claims.SessionID)
+	if session == nil {
+		// addClientToSession reports the missing session.
+		return true
+	}
+
+	session.mu.RLock()
+	protected := session.passcode != ""
+	session.mu.RUnlock()
+	if protected && passcode != "" {
+		allowed, delay := s.passcodes.allow(claims.SessionID, claims.PeerID, client.remoteAddr)
+		if !allowed {
+			log.Printf("Refusing passcode from %s for session %s: too many wrong passcodes", client.remoteAddr, claims.SessionID)
+			s.sendError(client, claims.SessionID, ErrorCodeTooManyAttempts, errTooManyPasscodes.Error())
+			client.closeAfterFlush(websocket.ClosePolicyViolation, "too many wrong passcodes")
+			return false
+		}
+		// Only this connection's read pump waits.
+		time.Sleep(delay)
+	}
+
+	err := session.verifyPasscode(passcode)
+	if err == nil {
+		return true
+	}
+
+	code := ErrorCodePasscodeRequired
+	if errors.Is(err, errInvalidPasscode) {
+		code = ErrorCodeInvalidPasscode
+		s.passcodes.fail(claims.SessionID, claims.PeerID, client.remoteAddr)
+	}
+	log.Printf("Rejecting join to session %s: %v", claims.SessionID, err)
+	s.sendError(client, claims.SessionID, code, err.Error())
+
+	if allowed, _ := s.passcodes.allow(claims.SessionID, claims.PeerID, client.remoteAddr); code == ErrorCodeInvalidPasscode && !allowed {
+		log.Printf("Closing connection from %s after too many wrong passcodes for session %s", client.remoteAddr, claims.SessionID)
+		client.closeAfterFlush(websocket.ClosePolicyViolation, "too many wrong passcodes")
+	}
+	return false
+}
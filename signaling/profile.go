@@ -0,0 +1,158 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxDisplayNameLength is the longest display name, in characters.
+	MaxDisplayNameLength = 64
+	// MaxAvatarSize is the largest avatar image in bytes. Avatars travel in
+	// every peer_joined and session_info, so they must stay small.
+	MaxAvatarSize = 16 * 1024
+	// MaxAvatarDimension is the largest width or height of an avatar.
+	MaxAvatarDimension = 256
+)
+
+// validateProfile checks a profile sent by a client and returns it with the
+// display name trimmed and the color in lower case.
+func validateProfile(profile Profile) (Profile, error) {
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	if !utf8.ValidString(profile.DisplayName) || strings.IndexFunc(profile.DisplayName, unicode.IsControl) >= 0 {
+		return Profile{}, fmt.Errorf("invalid profile: display name has invalid characters")
+	}
+	if utf8.RuneCountInString(profile.DisplayName) > MaxDisplayNameLength {
+		return Profile{}, fmt.Errorf("invalid profile: display name is longer than %d characters", MaxDisplayNameLength)
+	}
+
+	profile.Color = strings.ToLower(profile.Color)
+	if profile.Color != "" && !isHexColor(profile.Color) {
+		return Profile{}, fmt.Errorf("invalid profile: color %q is not #rrggbb", profile.Color)
+	}
+
+	if len(profile.Avatar) > 0 {
+		if len(profile.Avatar) > MaxAvatarSize {
+			return Profile{}, fmt.Errorf("invalid profile: avatar is larger than %d bytes", MaxAvatarSize)
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(profile.Avatar))
+		if err != nil || (format != "png" && format != "jpeg") {
+			return Profile{}, fmt.Errorf("invalid profile: avatar is not a PNG or JPEG image")
+		}
+		if config.Width > MaxAvatarDimension || config.Height > MaxAvatarDimension {
+			return Profile{}, fmt.Errorf("invalid profile: avatar is larger than %dx%d", MaxAvatarDimension, MaxAvatarDimension)
+		}
+	}
+	return profile, nil
+}
+
+func isHexColor(s string) bool {
+	if len(s) != 7 || s[0] != '#' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleProfileUpdate changes client's profile and tells its session on
+// every node. An empty display name keeps the current one.
+func (s *Server) handleProfileUpdate(client *ServerClient, msg *SignalingMessage) {
+	var payload ProfileUpdatePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, "invalid profile_update payload")
+		return
+	}
+	profile, err := validateProfile(payload.Profile)
+	if err != nil {
+		s.sendError(client, client.sessionID, ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.Lock()
+	if session.clients[client.peerID] != client {
+		session.mu.Unlock()
+		return
+	}
+	if profile.DisplayName != "" {
+		client.username = profile.DisplayName
+	}
+	client.color = profile.Color
+	client.avatar = profile.Avatar
+	peer := client.info()
+	session.mu.Unlock()
+
+	s.broadcastLocal(session.id, "", profileUpdateMessage(session.id, peer))
+	s.publish(clusterEvent{Kind: eventProfileUpdated, SessionID: session.id, Peer: &peer})
+	log.Printf("Client %s updated its profile in session %s", peer.PeerID, session.id)
+}
+
+// remoteProfileUpdate records the new profile of a peer on node and tells
+// the local peers.
+func (s *Server) remoteProfileUpdate(session *Session, peer PeerInfo, node string) {
+	session.mu.Lock()
+	remote, exists := session.remote[peer.PeerID]
+	if !exists || remote.node != node {
+		session.mu.Unlock()
+		return
+	}
+	remote.info.Username = peer.Username
+	remote.info.Color = peer.Color
+	remote.info.Avatar = peer.Avatar
+	session.remote[peer.PeerID] = remote
+	session.mu.Unlock()
+
+	s.broadcastLocal(session.id, "", profileUpdateMessage(session.id, peer))
+}
+
+func profileUpdateMessage(sessionID string, peer PeerInfo) []byte {
+	payload, _ := json.Marshal(ProfileUpdatePayload{
+		PeerID: peer.PeerID,
+		Profile: Profile{
+			DisplayName: peer.Username,
+			Color:       peer.Color,
+			Avatar:      peer.Avatar,
+		},
+	})
+
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:      MessageTypeProfileUpdate,
+		SessionID: sessionID,
+		PeerID:    peer.PeerID,
+		Username:  peer.Username,
+		Payload:   payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal profile update message: %v", err)
+		return nil
+	}
+	return msgBytes
+}
+
+// withoutAvatars drops the avatars from info, for the admin endpoints,
+// which list many sessions at once.
+func (info SessionInfoPayload) withoutAvatars() SessionInfoPayload {
+	peers := make([]PeerInfo, len(info.Peers))
+	for i, peer := range info.Peers {
+		peer.Avatar = nil
+		peers[i] = peer
+	}
+	info.Peers = peers
+	return info
+}
@@ -1,109 +1,637 @@
 package signaling
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// resumeGracePeriod is how long a dropped client keeps its place in the
+// session. Rejoining with its resume token within this window restores it
+// without the other peers seeing it leave.
+const resumeGracePeriod = 30 * time.Second
+
+const (
+	DefaultWSPath                 = "/ws"
+	DefaultMaxMessageSize         = 64 * 1024
+	DefaultSendBufferSize         = 256
+	DefaultShutdownReconnectDelay = 2 * time.Second
+)
+
 type ServerClient struct {
-	conn      *websocket.Conn
-	sessionID string
-	peerID    string
-	username  string
-	send      chan []byte
+	conn        *websocket.Conn
+	sessionID   string
+	peerID      string
+	username    string
+	role        string
+	color       string
+	avatar      []byte
+	joinedAt    time.Time
+	resumeToken string
+	send        chan []byte
+	done        chan struct{}
+	left        bool
+	expiry      *time.Timer
+	closing     chan struct{}
+	closeOnce   sync.Once
+	closeFrame  []byte
+	rtt         rttMeter
+	// remoteAddr is the host the connection came from, which wrong
+	// passcodes are counted against.
+	remoteAddr string
 }
 
 type Session struct {
-	clients map[string]*ServerClient
-	mu      sync.RWMutex
+	id        string
+	createdAt time.Time
+	clients   map[string]*ServerClient
+	// remote holds peers of this session connected to other nodes.
+	remote map[string]remotePeer
+	// removed holds peers kicked by an admin, who may not rejoin.
+	removed map[string]bool
+	// creator is the peer ID the host token from POST /sessions was
+	// issued for.
+	creator string
+	// roles holds the role each peer last had here, which it gets back
+	// when it rejoins. Roles in join tokens are not trusted.
+	roles map[string]string
+	// maxPeers caps the session's size across all nodes; zero means no
+	// limit beyond the server's.
+	maxPeers int
+	// locked keeps new peers out; members may still rejoin.
+	locked bool
+	// lobby holds new participants in waiting until a host admits them.
+	lobby bool
+	// listed shows the session in GET /sessions.
+	listed bool
+	// guarded is set once a peer has been kicked, who could come back
+	// with a new token. New participants then wait in the lobby too, but
+	// only while a host or co-host is there to admit them.
+	guarded bool
+	waiting map[string]waitingPeer
+	// passcode is the hash of the passcode joins must carry, if any.
+	passcode string
+	// code is the session's meeting code, which finds it until
+	// codeExpiresAt.
+	code          string
+	codeExpiresAt time.Time
+	// chat holds the latest room-wide chat messages, oldest first.
+	chat []ChatPayload
+	mu   sync.RWMutex
 }
 
 type Server struct {
 	sessions map[string]*Session
-	mu       sync.RWMutex
-	upgrader websocket.Upgrader
+	// codes maps meeting codes to session IDs.
+	codes          map[string]string
+	mu             sync.RWMutex
+	upgrader       websocket.Upgrader
+	heartbeat      HeartbeatConfig
+	tokens         *TokenIssuer
+	adminToken     string
+	metrics        Metrics
+	maxMessageSize int64
+	sendBufferSize int
+	tlsCertFile    string
+	tlsKeyFile     string
+	mux            *http.ServeMux
+	httpServer     *http.Server
+	ready          atomic.Bool
+	// conns tracks every open websocket so Shutdown can reach clients that
+	// have not joined a session yet.
+	conns          map[*ServerClient]struct{}
+	connsMu        sync.Mutex
+	pumps          sync.WaitGroup
+	shuttingDown   bool
+	reconnectAfter time.Duration
+	nodeID         string
+	backplane      Backplane
+	ownsBackplane  bool
+	// peerCount is the number of peers joined to sessions on this node,
+	// checked against maxPeers.
+	peerCount          atomic.Int64
+	maxPeers           int
+	maxPeersPerSession int
+	meshThreshold      int
+	meetingCodeTTL     time.Duration
+	passcodes          *passcodeLimiter
+	trustedProxies     []netip.Prefix
 }
 
-func NewServer() *Server {
-	return &Server{
-		sessions: make(map[string]*Session),
+type ServerConfig struct {
+	// Addr is the address Start listens on. Defaults to ":8080".
+	Addr string
+	// WSPath is where the websocket endpoint is served. Defaults to "/ws".
+	WSPath string
+	// TLSCertFile and TLSKeyFile make Start serve TLS, so clients connect
+	// with wss://. Both or neither must be set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TrustedProxies lists the addresses, single IPs or CIDR ranges, of
+	// reverse proxies whose X-Forwarded-For header names the client. Wrong
+	// passcodes are counted against that address instead of the proxy's.
+	TrustedProxies []string
+	// AllowedOrigins lists the Origin headers accepted on websocket
+	// upgrades, or "*" for any. If empty only same-host origins are
+	// accepted. Requests without an Origin header, such as those from the
+	// desktop client, are always accepted.
+	AllowedOrigins []string
+	// MaxMessageSize is the largest message in bytes a client may send.
+	// Defaults to DefaultMaxMessageSize.
+	MaxMessageSize int64
+	// SendBufferSize is how many outgoing messages are queued per client
+	// before further ones are dropped. Defaults to DefaultSendBufferSize.
+	SendBufferSize int
+	// Heartbeat controls pings to clients and how quickly silent ones are
+	// evicted. Zero fields use DefaultHeartbeatConfig.
+	Heartbeat HeartbeatConfig
+	// Tokens configures signing of join tokens.
+	Tokens TokenIssuerConfig
+	// AdminToken is the bearer token for the /admin endpoints. The admin
+	// API is disabled if empty.
+	AdminToken string
+	// Metrics receives monitoring events. Nothing is recorded if nil.
+	Metrics Metrics
+	// ShutdownReconnectDelay is how long Shutdown tells clients to wait
+	// before reconnecting. Defaults to DefaultShutdownReconnectDelay.
+	ShutdownReconnectDelay time.Duration
+	// Backplane connects this server to the other nodes of a cluster. A
+	// private in-memory one is used if nil, for a single node.
+	Backplane Backplane
+	// MaxPeersPerSession caps the size of every session, and is the upper
+	// bound for a limit chosen when a session is created. Zero means no
+	// limit.
+	MaxPeersPerSession int
+	// MaxPeers caps the peers joined across all sessions on this node.
+	// Zero means no limit.
+	MaxPeers int
+	// MeshThreshold is the largest session clients should run as a full
+	// mesh. Bigger sessions are flagged with use_sfu in session_info. Zero
+	// disables the hint.
+	MeshThreshold int
+	// MeetingCodeTTL is how long a new session's meeting code can be used
+	// to find it. Defaults to DefaultMeetingCodeTTL.
+	MeetingCodeTTL time.Duration
+}
+
+func NewServer(config ServerConfig) (*Server, error) {
+	// Every node must verify the tokens the others issue, which a random
+	// per-process key would not.
+	if config.Backplane != nil && len(config.Tokens.Secret) == 0 {
+		return nil, fmt.Errorf("a token secret is required with a shared backplane")
+	}
+	tokens, err := NewTokenIssuer(config.Tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key")
+	}
+
+	trustedProxies := make([]netip.Prefix, 0, len(config.TrustedProxies))
+	for _, proxy := range config.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = nopMetrics{}
+	}
+
+	addr := config.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	wsPath := config.WSPath
+	if wsPath == "" {
+		wsPath = DefaultWSPath
+	}
+	maxMessageSize := config.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	sendBufferSize := config.SendBufferSize
+	if sendBufferSize <= 0 {
+		sendBufferSize = DefaultSendBufferSize
+	}
+
+	backplane := config.Backplane
+	if backplane == nil {
+		backplane = NewMemoryBackplane()
+	}
+
+	reconnectAfter := config.ShutdownReconnectDelay
+	if reconnectAfter <= 0 {
+		reconnectAfter = DefaultShutdownReconnectDelay
+	}
+	meetingCodeTTL := config.MeetingCodeTTL
+	if meetingCodeTTL <= 0 {
+		meetingCodeTTL = DefaultMeetingCodeTTL
+	}
+
+	s := &Server{
+		sessions:           make(map[string]*Session),
+		codes:              make(map[string]string),
+		conns:              make(map[*ServerClient]struct{}),
+		nodeID:             uuid.New().String(),
+		backplane:          backplane,
+		ownsBackplane:      config.Backplane == nil,
+		reconnectAfter:     reconnectAfter,
+		maxPeers:           max(config.MaxPeers, 0),
+		maxPeersPerSession: max(config.MaxPeersPerSession, 0),
+		meshThreshold:      max(config.MeshThreshold, 0),
+		meetingCodeTTL:     meetingCodeTTL,
+		passcodes:          newPasscodeLimiter(),
+		trustedProxies:     trustedProxies,
+		heartbeat:          config.Heartbeat.withDefaults(),
+		tokens:             tokens,
+		adminToken:         config.AdminToken,
+		metrics:            metrics,
+		maxMessageSize:     maxMessageSize,
+		sendBufferSize:     sendBufferSize,
+		tlsCertFile:        config.TLSCertFile,
+		tlsKeyFile:         config.TLSKeyFile,
+		mux:                http.NewServeMux(),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin: checkOrigin(config.AllowedOrigins),
 		},
 	}
+	s.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mux.HandleFunc(wsPath, s.HandleWebSocket)
+	s.mux.HandleFunc("/token", s.HandleToken)
+	s.mux.HandleFunc("POST /sessions", s.HandleCreateSession)
+	s.mux.HandleFunc("GET /sessions", s.HandleListSessions)
+	s.mux.HandleFunc("GET /sessions/{id}", s.HandleGetSession)
+	s.mux.HandleFunc("GET /admin/sessions", s.requireAdmin(s.HandleAdminListSessions))
+	s.mux.HandleFunc("GET /admin/sessions/{id}", s.requireAdmin(s.HandleAdminGetSession))
+	s.mux.HandleFunc("DELETE /admin/sessions/{id}", s.requireAdmin(s.HandleAdminCloseSession))
+	s.mux.HandleFunc("DELETE /admin/sessions/{id}/peers/{peerID}", s.requireAdmin(s.HandleAdminKickPeer))
+	s.mux.HandleFunc("POST /admin/sessions/{id}/notice", s.requireAdmin(s.HandleAdminNotice))
+	s.mux.HandleFunc("PUT /admin/sessions/{id}/lock", s.requireAdmin(s.HandleAdminLock))
+	s.mux.HandleFunc("PUT /admin/sessions/{id}/lobby", s.requireAdmin(s.HandleAdminLobby))
+	s.mux.HandleFunc("POST /admin/sessions/{id}/lobby/{peerID}/admit", s.requireAdmin(s.HandleAdminAdmit))
+	s.mux.HandleFunc("GET /healthz", s.HandleHealth)
+	s.mux.HandleFunc("GET /readyz", s.HandleReady)
+
+	if err := s.backplane.Subscribe(s.handleClusterEvent); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to backplane: %w", err)
+	}
+	// Nodes already running reply with their sessions and peers.
+	s.publish(clusterEvent{Kind: eventSyncRequest})
+
+	return s, nil
+}
+
+// checkOrigin builds the upgrader's origin check from the allowed list.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		// The upgrader's default: no Origin header, or the same host.
+		return nil
+	}
+
+	origins := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		if origin == "*" {
+			return func(r *http.Request) bool {
+				return true
+			}
+		}
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || origins[strings.ToLower(origin)] {
+			return true
+		}
+		log.Printf("Rejecting websocket from origin %s", origin)
+		return false
+	}
+}
+
+// clientAddr is the address r came from: the connection's peer or, when
+// that is a trusted proxy, the last address in X-Forwarded-For that no
+// trusted proxy added.
+func (s *Server) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !s.trustedProxy(addr) {
+		return addr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+func (s *Server) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns the server's routes, for use with httptest or another
+// http.Server.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Handle adds a route to the server's mux, such as a metrics endpoint.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
 }
 
 func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
+		s.metrics.WebSocketError()
 		return
 	}
+	s.metrics.ClientConnected()
+	conn.SetReadLimit(s.maxMessageSize)
 
 	client := &ServerClient{
-		conn: conn,
-		send: make(chan []byte, 256),
+		conn:       conn,
+		send:       make(chan []byte, s.sendBufferSize),
+		done:       make(chan struct{}),
+		closing:    make(chan struct{}),
+		remoteAddr: s.clientAddr(r),
 	}
 
-	go client.writePump()
-	go s.readPump(client)
+	s.connsMu.Lock()
+	if s.shuttingDown {
+		s.connsMu.Unlock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(s.heartbeat.WriteTimeout))
+		conn.Close()
+		s.metrics.ClientDisconnected()
+		return
+	}
+	s.conns[client] = struct{}{}
+	s.pumps.Add(2)
+	s.connsMu.Unlock()
+
+	startHeartbeat(conn, s.heartbeat, &client.rtt)
+
+	go func() {
+		defer s.pumps.Done()
+		client.writePump(s.heartbeat, s.metrics)
+	}()
+	go func() {
+		defer s.pumps.Done()
+		s.readPump(client)
+	}()
+}
+
+func (s *Server) getSession(sessionID string) *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions[sessionID]
 }
 
-func (s *Server) getOrCreateSession(sessionID string) *Session {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+var (
+	errSessionNotFound = errors.New("session not found")
+	errPeerRemoved     = errors.New("removed from this session")
+	errRoomFull        = errors.New("session is full")
+	errServerFull      = errors.New("server is full")
+	errRoomLocked      = errors.New("session is locked")
+)
 
-	session, exists := s.sessions[sessionID]
-	if !exists {
-		session = &Session{
-			clients: make(map[string]*ServerClient),
-		}
-		s.sessions[sessionID] = session
-		log.Printf("Created new session: %s", sessionID)
+// addClientToSession adds client to an existing session. Sessions are only
+// created through the API, so joining one that has ended fails, as does
+// joining one at its capacity or while this node is at its own. A locked
+// session only takes peers a host admitted from the lobby.
+func (s *Server) addClientToSession(sessionID string, client *ServerClient, admitted bool) error {
+	session := s.getSession(sessionID)
+	if session == nil {
+		return errSessionNotFound
 	}
-	return session
-}
 
-func (s *Server) addClientToSession(sessionID string, client *ServerClient) {
-	session := s.getOrCreateSession(sessionID)
 	session.mu.Lock()
-	defer session.mu.Unlock()
-
+	if session.removed[client.peerID] {
+		session.mu.Unlock()
+		return errPeerRemoved
+	}
+	// A peer already counted in the session keeps its place.
+	_, replacing := session.clients[client.peerID]
+	_, moving := session.remote[client.peerID]
+	if !replacing && !moving && session.locked && !admitted {
+		session.mu.Unlock()
+		return errRoomLocked
+	}
+	if !replacing && !moving && session.maxPeers > 0 &&
+		len(session.clients)+len(session.remote) >= session.maxPeers {
+		session.mu.Unlock()
+		return errRoomFull
+	}
+	if !replacing && !s.reservePeer() {
+		session.mu.Unlock()
+		return errServerFull
+	}
 	session.clients[client.peerID] = client
+	// The peer may have moved here from another node.
+	delete(session.remote, client.peerID)
+	session.mu.Unlock()
+
+	// An empty session can be deleted between lookup and insert.
+	if s.getSession(sessionID) != session {
+		session.mu.Lock()
+		delete(session.clients, client.peerID)
+		session.mu.Unlock()
+		if !replacing {
+			s.peerCount.Add(-1)
+		}
+		return errSessionNotFound
+	}
+
 	log.Printf("Added client %s to session %s", client.peerID, sessionID)
+	return nil
 }
 
-func (s *Server) removeClientFromSession(sessionID, peerID string) {
-	s.mu.RLock()
-	session, exists := s.sessions[sessionID]
-	s.mu.RUnlock()
+// reservePeer counts one more peer on this node unless it is at maxPeers.
+func (s *Server) reservePeer() bool {
+	count := s.peerCount.Add(1)
+	if s.maxPeers > 0 && count > int64(s.maxPeers) {
+		s.peerCount.Add(-1)
+		return false
+	}
+	return true
+}
 
-	if !exists {
-		return
+// removeClient removes client from its session if it still holds its peer
+// ID there, and reports whether it did. A client that was replaced by a
+// resumed connection is left alone.
+func (s *Server) removeClient(client *ServerClient) bool {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return false
 	}
 
 	session.mu.Lock()
-	delete(session.clients, peerID)
-	clientCount := len(session.clients)
+	if session.clients[client.peerID] != client {
+		session.mu.Unlock()
+		return false
+	}
+	delete(session.clients, client.peerID)
+	clientCount := len(session.clients) + len(session.remote)
 	session.mu.Unlock()
+	s.peerCount.Add(-1)
 
-	log.Printf("Removed client %s from session %s", peerID, sessionID)
+	log.Printf("Removed client %s from session %s", client.peerID, client.sessionID)
 
 	if clientCount == 0 {
-		s.mu.Lock()
-		delete(s.sessions, sessionID)
-		s.mu.Unlock()
-		log.Printf("Deleted empty session: %s", sessionID)
+		s.deleteSessionIfEmpty(session)
+	}
+	return true
+}
+
+// suspendClient keeps a dropped client in its session for resumeGracePeriod
+// before removing it and telling the other peers.
+func (s *Server) suspendClient(client *ServerClient) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.clients[client.peerID] != client || client.expiry != nil {
+		return
 	}
+
+	client.expiry = time.AfterFunc(resumeGracePeriod, func() {
+		if s.removeClient(client) {
+			s.notifyPeerLeft(client.sessionID, client.peerID)
+			log.Printf("Client %s did not resume, removed from session %s", client.peerID, client.sessionID)
+		}
+	})
+	log.Printf("Client %s disconnected, holding its place for %v", client.peerID, resumeGracePeriod)
 }
 
+// resumeClient swaps client in for the dropped connection holding peerID if
+// token matches that connection's resume token. The identity and any
+// messages queued for the old connection carry over to the new one.
+func (s *Server) resumeClient(client *ServerClient, sessionID, peerID, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	session := s.getSession(sessionID)
+	if session == nil {
+		return false
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	old, exists := session.clients[peerID]
+	if !exists || subtle.ConstantTimeCompare([]byte(old.resumeToken), []byte(token)) != 1 {
+		return false
+	}
+
+	client.sessionID = old.sessionID
+	client.peerID = old.peerID
+	client.username = old.username
+	client.role = old.role
+	client.color = old.color
+	client.avatar = old.avatar
+	client.joinedAt = old.joinedAt
+
+	if old.expiry != nil {
+		old.expiry.Stop()
+	}
+	// The old socket may not have noticed it is dead yet.
+	old.conn.Close()
+
+	for pending := true; pending; {
+		select {
+		case message := <-old.send:
+			select {
+			case client.send <- message:
+			default:
+				log.Printf("Dropping queued message for resumed client %s", peerID)
+				s.metrics.SendDropped()
+			}
+		default:
+			pending = false
+		}
+	}
+
+	session.clients[client.peerID] = client
+	return true
+}
+
+func newResumeToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate resume token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// broadcastToSession sends message to everyone in the session except the
+// sender, including peers connected to other nodes.
 func (s *Server) broadcastToSession(sessionID, senderPeerID string, message []byte) {
+	s.broadcastLocal(sessionID, senderPeerID, message)
+	s.publish(clusterEvent{Kind: eventMessage, SessionID: sessionID, From: senderPeerID, Data: message})
+}
+
+// broadcastLocal sends message to the session's peers on this node only.
+func (s *Server) broadcastLocal(sessionID, senderPeerID string, message []byte) {
+	if message == nil {
+		return
+	}
+
 	s.mu.RLock()
 	session, exists := s.sessions[sessionID]
 	s.mu.RUnlock()
@@ -121,72 +649,182 @@ func (s *Server) broadcastToSession(sessionID, senderPeerID string, message []by
 			case client.send <- message:
 			default:
 				log.Printf("Failed to send message to client %s", peerID)
+				s.metrics.SendDropped()
 			}
 		}
 	}
 }
 
-func (s *Server) notifyPeerJoined(sessionID, newPeerID, username string) {
-	payload, _ := json.Marshal(PeerJoinedPayload{
-		PeerID:   newPeerID,
-		Username: username,
-	})
+// sendToPeer delivers message to targetPeerID on whichever node it is
+// connected to, and reports whether the peer is in the session.
+func (s *Server) sendToPeer(sessionID, targetPeerID string, message []byte) bool {
+	if s.sendLocal(sessionID, targetPeerID, message) {
+		return true
+	}
 
-	msg := &SignalingMessage{
-		Type:      MessageTypePeerJoined,
-		SessionID: sessionID,
-		PeerID:    newPeerID,
-		Username:  username,
-		Payload:   payload,
+	session := s.getSession(sessionID)
+	if session == nil {
+		return false
+	}
+	session.mu.RLock()
+	_, remote := session.remote[targetPeerID]
+	session.mu.RUnlock()
+
+	if !remote {
+		return false
+	}
+	s.publish(clusterEvent{Kind: eventMessage, SessionID: sessionID, To: targetPeerID, Data: message})
+	return true
+}
+
+func (s *Server) sendLocal(sessionID, targetPeerID string, message []byte) bool {
+	s.mu.RLock()
+	session, exists := s.sessions[sessionID]
+	s.mu.RUnlock()
+
+	if !exists {
+		return false
+	}
+
+	session.mu.RLock()
+	client, exists := session.clients[targetPeerID]
+	session.mu.RUnlock()
+
+	if !exists {
+		return false
+	}
+
+	select {
+	case client.send <- message:
+	default:
+		log.Printf("Failed to send message to client %s", targetPeerID)
+		s.metrics.SendDropped()
+	}
+	return true
+}
+
+func (s *Server) sendError(client *ServerClient, sessionID string, code ErrorCode, message string) {
+	msg, err := NewErrorMessage(sessionID, client.peerID, code, message)
+	if err != nil {
+		log.Printf("Failed to create error message: %v", err)
+		return
 	}
+	s.sendMessage(client, msg)
+}
 
+func (s *Server) sendMessage(client *ServerClient, msg *SignalingMessage) {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Failed to marshal peer joined message: %v", err)
+		log.Printf("Failed to marshal %s message: %v", msg.Type, err)
 		return
 	}
 
-	s.broadcastToSession(sessionID, newPeerID, msgBytes)
+	select {
+	case client.send <- msgBytes:
+	default:
+		log.Printf("Failed to send %s to client %s", msg.Type, client.peerID)
+		s.metrics.SendDropped()
+	}
+}
+
+// notifyPeerJoined tells the rest of client's session, on this node and
+// others, that it joined.
+func (s *Server) notifyPeerJoined(client *ServerClient) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+	session.mu.RLock()
+	peer := client.info()
+	session.mu.RUnlock()
+
+	s.broadcastLocal(session.id, peer.PeerID, peerJoinedMessage(session.id, peer))
+	event := session.event(eventPeerJoined)
+	event.Peer = &peer
+	s.publish(event)
 }
 
 func (s *Server) notifyPeerLeft(sessionID, peerID string) {
+	s.broadcastLocal(sessionID, peerID, peerLeftMessage(sessionID, peerID))
+	s.publish(clusterEvent{Kind: eventPeerLeft, SessionID: sessionID, PeerID: peerID})
+	if session := s.getSession(sessionID); session != nil {
+		s.admitIfLobbyOpen(session)
+	}
+}
+
+func peerJoinedMessage(sessionID string, peer PeerInfo) []byte {
+	payload, _ := json.Marshal(PeerJoinedPayload{
+		PeerID:   peer.PeerID,
+		Username: peer.Username,
+		Role:     peer.Role,
+		Color:    peer.Color,
+		Avatar:   peer.Avatar,
+	})
+
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:      MessageTypePeerJoined,
+		SessionID: sessionID,
+		PeerID:    peer.PeerID,
+		Username:  peer.Username,
+		Payload:   payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal peer joined message: %v", err)
+		return nil
+	}
+	return msgBytes
+}
+
+func peerLeftMessage(sessionID, peerID string) []byte {
 	payload, _ := json.Marshal(PeerLeftPayload{
 		PeerID: peerID,
 	})
 
-	msg := &SignalingMessage{
+	msgBytes, err := json.Marshal(&SignalingMessage{
 		Type:      MessageTypePeerLeft,
 		SessionID: sessionID,
 		PeerID:    peerID,
 		Payload:   payload,
-	}
-
-	msgBytes, err := json.Marshal(msg)
+	})
 	if err != nil {
 		log.Printf("Failed to marshal peer left message: %v", err)
-		return
+		return nil
 	}
-
-	s.broadcastToSession(sessionID, peerID, msgBytes)
+	return msgBytes
 }
 
 func (s *Server) readPump(client *ServerClient) {
 	defer func() {
-		if client.sessionID != "" && client.peerID != "" {
-			s.removeClientFromSession(client.sessionID, client.peerID)
-			s.notifyPeerLeft(client.sessionID, client.peerID)
-		}
+		close(client.done)
 		client.conn.Close()
+		s.metrics.ClientDisconnected()
+
+		s.connsMu.Lock()
+		delete(s.conns, client)
+		shuttingDown := s.shuttingDown
+		s.connsMu.Unlock()
+
+		if client.sessionID != "" && client.peerID != "" && !client.left && !shuttingDown && !s.leaveLobby(client) {
+			s.suspendClient(client)
+		}
 	}()
 
 	for {
 		_, message, err := client.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Client %s silent for %v, closing connection", client.peerID, s.heartbeat.readTimeout())
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("Client %s sent a message over %d bytes, closing connection", client.peerID, s.maxMessageSize)
+				s.metrics.WebSocketError()
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
+				s.metrics.WebSocketError()
 			}
 			break
 		}
+		extendReadDeadline(client.conn, s.heartbeat)
 
 		var msg SignalingMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -199,49 +837,468 @@ func (s *Server) readPump(client *ServerClient) {
 }
 
 func (s *Server) handleMessage(client *ServerClient, msg *SignalingMessage, rawMsg []byte) {
-	switch msg.Type {
-	case MessageTypeJoin:
-		client.sessionID = msg.SessionID
-		client.peerID = msg.PeerID
-		client.username = msg.Username
-		s.addClientToSession(msg.SessionID, client)
-		s.notifyPeerJoined(msg.SessionID, msg.PeerID, msg.Username)
-		log.Printf("Client %s joined session %s", msg.PeerID, msg.SessionID)
+	s.metrics.MessageReceived(msg.Type)
 
+	if msg.Type == MessageTypeJoin {
+		s.handleJoin(client, msg)
+		return
+	}
+
+	if client.peerID == "" {
+		s.sendError(client, msg.SessionID, ErrorCodeAuthRequired, "join the session before sending messages")
+		return
+	}
+	if msg.PeerID != client.peerID || msg.SessionID != client.sessionID {
+		log.Printf("Rejecting %s from %s claiming to be %s in session %s", msg.Type, client.peerID, msg.PeerID, msg.SessionID)
+		s.sendError(client, client.sessionID, ErrorCodePeerMismatch, "peer_id and session_id must match the joined identity")
+		return
+	}
+
+	if s.isWaiting(client) {
+		if msg.Type == MessageTypeLeave {
+			client.left = true
+			s.leaveLobby(client)
+			return
+		}
+		s.sendError(client, client.sessionID, ErrorCodeForbidden, "waiting to be admitted")
+		return
+	}
+
+	switch msg.Type {
 	case MessageTypeLeave:
-		s.removeClientFromSession(msg.SessionID, msg.PeerID)
-		s.notifyPeerLeft(msg.SessionID, msg.PeerID)
-		log.Printf("Client %s left session %s", msg.PeerID, msg.SessionID)
+		client.left = true
+		if s.removeClient(client) {
+			s.notifyPeerLeft(client.sessionID, client.peerID)
+			log.Printf("Client %s left session %s", client.peerID, client.sessionID)
+		}
+
+	case MessageTypeMuteRequest, MessageTypeRemovePeer, MessageTypeLockRoom,
+		MessageTypeSetRole, MessageTypeTransferHost, MessageTypeAdmit, MessageTypeDeny:
+		s.handleModeration(client, msg, rawMsg)
+
+	case MessageTypeProfileUpdate:
+		s.handleProfileUpdate(client, msg)
+
+	case MessageTypeChat:
+		s.handleChat(client, msg)
+
+	case MessageTypeRefreshToken:
+		s.handleRefreshToken(client)
 
 	case MessageTypeOffer, MessageTypeAnswer, MessageTypeCandidate:
-		s.broadcastToSession(msg.SessionID, msg.PeerID, rawMsg)
+		if msg.TargetPeerID == "" {
+			s.broadcastToSession(msg.SessionID, msg.PeerID, rawMsg)
+			return
+		}
+		if !s.sendToPeer(msg.SessionID, msg.TargetPeerID, rawMsg) {
+			log.Printf("Dropping %s from %s: unknown target peer %s", msg.Type, msg.PeerID, msg.TargetPeerID)
+			s.sendError(client, msg.SessionID, ErrorCodePeerNotFound, fmt.Sprintf("peer %s not found in session", msg.TargetPeerID))
+		}
 
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
 	}
 }
 
-func (client *ServerClient) writePump() {
+// handleJoin admits client to a session, either by resuming a dropped
+// connection with its resume token or with a valid join token. The peer ID
+// comes from the token, never from the message; the username does too
+// unless the join carries a profile with a display name. The role is the
+// one the session last knew the peer by.
+func (s *Server) handleJoin(client *ServerClient, msg *SignalingMessage) {
+	start := time.Now()
+
+	if client.peerID != "" {
+		s.sendError(client, msg.SessionID, ErrorCodeAlreadyJoined, "already joined")
+		return
+	}
+
+	var payload JoinPayload
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			s.sendError(client, msg.SessionID, ErrorCodeBadRequest, "invalid join payload")
+			return
+		}
+	}
+
+	token, err := newResumeToken()
+	if err != nil {
+		log.Printf("Failed to join client %s: %v", msg.PeerID, err)
+		s.sendError(client, msg.SessionID, ErrorCodeInternal, "failed to join session")
+		return
+	}
+	client.resumeToken = token
+
+	resumed := s.resumeClient(client, msg.SessionID, msg.PeerID, payload.ResumeToken)
+	if resumed {
+		log.Printf("Client %s resumed session %s", client.peerID, client.sessionID)
+	} else {
+		claims, err := s.tokens.Verify(payload.Token)
+		if err != nil {
+			code := ErrorCodeInvalidToken
+			switch {
+			case errors.Is(err, ErrTokenMissing):
+				code = ErrorCodeAuthRequired
+			case errors.Is(err, ErrTokenExpired):
+				code = ErrorCodeTokenExpired
+			}
+			log.Printf("Rejecting join from %s: %v", msg.PeerID, err)
+			s.sendError(client, msg.SessionID, code, err.Error())
+			return
+		}
+		if claims.SessionID != msg.SessionID || claims.PeerID != msg.PeerID {
+			log.Printf("Rejecting join from %s: token is for peer %s in session %s", msg.PeerID, claims.PeerID, claims.SessionID)
+			s.sendError(client, msg.SessionID, ErrorCodePeerMismatch, "join token does not match peer_id and session_id")
+			return
+		}
+		var profile Profile
+		if payload.Profile != nil {
+			if profile, err = validateProfile(*payload.Profile); err != nil {
+				s.sendError(client, msg.SessionID, ErrorCodeBadRequest, err.Error())
+				return
+			}
+		}
+		if !s.checkJoinPasscode(client, claims, payload.Passcode) {
+			return
+		}
+
+		client.sessionID = claims.SessionID
+		client.peerID = claims.PeerID
+		client.username = claims.Username
+		if profile.DisplayName != "" {
+			client.username = profile.DisplayName
+		}
+		client.color = profile.Color
+		client.avatar = profile.Avatar
+		client.role = RoleParticipant
+		client.joinedAt = time.Now()
+
+		session := s.getSession(claims.SessionID)
+		if session != nil {
+			client.role = session.memberRole(claims.PeerID)
+		}
+		if session != nil && s.needsAdmission(session, client) {
+			if err := s.enterLobby(session, client); err != nil {
+				code := ErrorCodePeerRemoved
+				if errors.Is(err, errRoomLocked) {
+					code = ErrorCodeRoomLocked
+				}
+				log.Printf("Rejecting join from %s: %v", claims.PeerID, err)
+				client.sessionID, client.peerID = "", ""
+				s.sendError(client, msg.SessionID, code, err.Error())
+			}
+			return
+		}
+
+		if err := s.addClientToSession(claims.SessionID, client, false); err != nil {
+			code := ErrorCodeSessionNotFound
+			switch {
+			case errors.Is(err, errPeerRemoved):
+				code = ErrorCodePeerRemoved
+			case errors.Is(err, errRoomFull):
+				code = ErrorCodeRoomFull
+			case errors.Is(err, errServerFull):
+				code = ErrorCodeServerFull
+			case errors.Is(err, errRoomLocked):
+				code = ErrorCodeRoomLocked
+			}
+			log.Printf("Rejecting join from %s: %v", claims.PeerID, err)
+			client.sessionID, client.peerID = "", ""
+			s.sendError(client, msg.SessionID, code, err.Error())
+			return
+		}
+		s.notifyPeerJoined(client)
+		log.Printf("Client %s joined session %s as %s", client.peerID, client.sessionID, client.role)
+	}
+
+	s.completeJoin(client, resumed)
+	s.metrics.JoinCompleted(time.Since(start))
+}
+
+// completeJoin tells a client that joined, directly or from the lobby, who
+// is in its session.
+func (s *Server) completeJoin(client *ServerClient, resumed bool) {
+	role := s.peerRole(client.sessionID, client.peerID)
+	token, err := s.rejoinToken(client)
+	if err != nil {
+		// The resume token still covers short drops.
+		log.Printf("Failed to issue rejoin token for %s: %v", client.peerID, err)
+	}
+	joined, err := NewJoinedMessage(client.sessionID, client.peerID, JoinedPayload{
+		ResumeToken:    client.resumeToken,
+		Resumed:        resumed,
+		Role:           role,
+		Username:       client.username,
+		Token:          token.Token,
+		TokenExpiresAt: token.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to create joined message: %v", err)
+		return
+	}
+	s.sendMessage(client, joined)
+	s.sendSessionInfo(client)
+
+	session := s.getSession(client.sessionID)
+	if !resumed {
+		// A resumed peer got the messages it missed from its buffer.
+		s.sendChatHistory(client)
+		s.checkMeshThreshold(session, client.peerID)
+	}
+	if roleRank(role) > 0 && session != nil {
+		s.sendLobbyRequests(session, client)
+	}
+}
+
+// HandleToken issues a join token for a new participant in an existing
+// session. The server picks the peer ID so clients cannot choose someone
+// else's. Only the session's creator is made host, with the token returned
+// by POST /sessions.
+func (s *Server) HandleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, ErrorCodeBadRequest, "use POST")
+		return
+	}
+
+	var req TokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "invalid token request")
+		return
+	}
+	if req.SessionID == "" {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "session_id is required")
+		return
+	}
+
+	session := s.getSession(req.SessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeSessionNotFound, fmt.Sprintf("session %s not found", req.SessionID))
+		return
+	}
+
+	session.mu.RLock()
+	locked := session.locked
+	full := session.maxPeers > 0 && len(session.clients)+len(session.remote) >= session.maxPeers
+	session.mu.RUnlock()
+	if locked {
+		writeJSONError(w, http.StatusForbidden, ErrorCodeRoomLocked, fmt.Sprintf("session %s is locked", req.SessionID))
+		return
+	}
+
+	if full {
+		writeJSONError(w, http.StatusConflict, ErrorCodeRoomFull, fmt.Sprintf("session %s is full", req.SessionID))
+		return
+	}
+
+	grant, err := s.issueToken(req.SessionID, uuid.New().String(), req.Username, RoleParticipant)
+	if err != nil {
+		log.Printf("Failed to issue join token: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, ErrorCodeInternal, "failed to issue token")
+		return
+	}
+	writeJSON(w, http.StatusOK, grant)
+}
+
+// issueToken signs a join token for peerID, naming it after its ID if
+// username is empty.
+func (s *Server) issueToken(sessionID, peerID, username, role string) (TokenResponse, error) {
+	if username == "" {
+		username = fmt.Sprintf("User_%s", peerID[:8])
+	}
+
+	claims := JoinClaims{
+		SessionID: sessionID,
+		PeerID:    peerID,
+		Username:  username,
+		Role:      role,
+		ExpiresAt: time.Now().Add(s.tokens.ttl),
+	}
+	token, err := s.tokens.Issue(claims)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{
+		Token:     token,
+		PeerID:    claims.PeerID,
+		Username:  claims.Username,
+		Role:      claims.Role,
+		ExpiresAt: claims.ExpiresAt,
+	}, nil
+}
+
+// rejoinToken issues a join token for a peer that is in its session, so it
+// can rejoin under the same peer ID after its resume token has lapsed.
+func (s *Server) rejoinToken(client *ServerClient) (TokenPayload, error) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return TokenPayload{}, fmt.Errorf("session %s not found", client.sessionID)
+	}
+
+	session.mu.RLock()
+	if session.clients[client.peerID] != client {
+		session.mu.RUnlock()
+		return TokenPayload{}, fmt.Errorf("peer %s is not in session %s", client.peerID, client.sessionID)
+	}
+	claims := JoinClaims{
+		SessionID: client.sessionID,
+		PeerID:    client.peerID,
+		Username:  client.username,
+		Role:      client.role,
+		ExpiresAt: time.Now().Add(s.tokens.ttl),
+	}
+	session.mu.RUnlock()
+
+	token, err := s.tokens.Issue(claims)
+	if err != nil {
+		return TokenPayload{}, err
+	}
+	return TokenPayload{Token: token, ExpiresAt: claims.ExpiresAt}, nil
+}
+
+// handleRefreshToken replaces a joined peer's join token before it expires.
+func (s *Server) handleRefreshToken(client *ServerClient) {
+	token, err := s.rejoinToken(client)
+	if err != nil {
+		log.Printf("Failed to refresh token for %s: %v", client.peerID, err)
+		s.sendError(client, client.sessionID, ErrorCodeInternal, "failed to refresh token")
+		return
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		log.Printf("Failed to marshal token: %v", err)
+		return
+	}
+	s.sendMessage(client, &SignalingMessage{
+		Type:      MessageTypeToken,
+		SessionID: client.sessionID,
+		PeerID:    client.peerID,
+		Payload:   payload,
+	})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	writeJSON(w, status, ErrorPayload{Code: code, Message: message})
+}
+
+func (client *ServerClient) writePump(heartbeat HeartbeatConfig, metrics Metrics) {
+	ticker := time.NewTicker(heartbeat.PingInterval)
 	defer func() {
+		ticker.Stop()
 		client.conn.Close()
 	}()
 
 	for {
-		message, ok := <-client.send
-		if !ok {
-			client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		select {
+		case <-client.done:
+			// Anything left in send stays there for a resumed connection.
 			return
+		case <-client.closing:
+			client.flush(heartbeat)
+			client.conn.WriteControl(websocket.CloseMessage, client.closeFrame,
+				time.Now().Add(heartbeat.WriteTimeout))
+			// Give the client a moment to answer the close frame so
+			// readPump sees a clean close.
+			select {
+			case <-client.done:
+			case <-time.After(heartbeat.WriteTimeout):
+			}
+			return
+		case <-ticker.C:
+			if err := sendPing(client.conn, heartbeat); err != nil {
+				log.Printf("Failed to ping client %s: %v", client.peerID, err)
+				metrics.WebSocketError()
+				return
+			}
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(heartbeat.WriteTimeout))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("Failed to write message: %v", err)
+				metrics.WebSocketError()
+				return
+			}
 		}
+	}
+}
+
+// closeAfterFlush makes writePump send whatever is queued and then close
+// the connection with the given close code and reason.
+func (client *ServerClient) closeAfterFlush(code int, reason string) {
+	client.closeOnce.Do(func() {
+		client.closeFrame = websocket.FormatCloseMessage(code, reason)
+		close(client.closing)
+	})
+}
 
-		if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Failed to write message: %v", err)
+func (client *ServerClient) flush(heartbeat HeartbeatConfig) {
+	for {
+		select {
+		case message := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(heartbeat.WriteTimeout))
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		default:
 			return
 		}
 	}
 }
 
-func (s *Server) Start(addr string) error {
-	http.HandleFunc("/ws", s.HandleWebSocket)
-	log.Printf("Signaling server starting on %s", addr)
-	return http.ListenAndServe(addr, nil)
+// GetPeerRTT returns the last signaling round-trip time measured for a
+// connected peer, or false if the peer is unknown or no pong arrived yet.
+func (s *Server) GetPeerRTT(sessionID, peerID string) (time.Duration, bool) {
+	session := s.getSession(sessionID)
+	if session == nil {
+		return 0, false
+	}
+
+	session.mu.RLock()
+	client, exists := session.clients[peerID]
+	session.mu.RUnlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	rtt := client.rtt.get()
+	return rtt, rtt > 0
+}
+
+// Start listens on the configured address and serves until the server is
+// shut down or fails.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.httpServer.Addr, err)
+	}
+	s.ready.Store(true)
+	defer s.ready.Store(false)
+
+	if s.tlsCertFile != "" {
+		log.Printf("Signaling server starting on %s with TLS", s.httpServer.Addr)
+		return s.httpServer.ServeTLS(listener, s.tlsCertFile, s.tlsKeyFile)
+	}
+
+	log.Printf("Signaling server starting on %s", s.httpServer.Addr)
+	return s.httpServer.Serve(listener)
+}
+
+// HandleHealth reports that the process is up.
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// HandleReady reports whether the server is accepting connections.
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
 }
@@ -0,0 +1,836 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestServer serves a Server made from config with httptest and returns
+// it with its base URL.
+func newTestServer(t *testing.T, config ServerConfig) (*Server, string) {
+	t.Helper()
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.Handler())
+	t.Cleanup(ts.Close)
+	return server, ts.URL
+}
+
+// wsURL is the websocket URL of the test server at baseURL.
+func wsURL(baseURL string) string {
+	return "ws" + strings.TrimPrefix(baseURL, "http") + DefaultWSPath
+}
+
+// joinTestClient creates a session on the test server at baseURL and joins
+// it as its host, returning once the server has answered with joined.
+func joinTestClient(t *testing.T, baseURL string) *Client {
+	t.Helper()
+
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{Username: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(wsURL(baseURL), session.SessionID, session.Host.PeerID, session.Host.Username)
+	client.SetJoinToken(session.Host.Token)
+	t.Cleanup(client.Disconnect)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	joined := client.Subscribe(ctx, MessageTypeJoined)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("no joined before the timeout")
+	}
+	return client
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server, err := NewServer(ServerConfig{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not ready before it listens.
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before Start = %d, want 503", recorder.Code)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+
+	// Without keep-alives no idle connection holds up Shutdown.
+	httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	base := "http://" + addr
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := httpClient.Get(base + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/readyz never became ready: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := httpClient.Get(base + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+		t.Errorf("/healthz = %d %q, want 200 \"ok\\n\"", resp.StatusCode, body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-started; err != http.ErrServerClosed {
+		t.Errorf("Start returned %v, want http.ErrServerClosed", err)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after Shutdown = %d, want 503", recorder.Code)
+	}
+}
+
+func TestOriginCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		wantOK  bool
+	}{
+		{"default allows no origin", nil, "", true},
+		{"default rejects another host", nil, "https://evil.example", false},
+		{"listed origin", []string{"https://app.example/"}, "https://APP.example", true},
+		{"unlisted origin", []string{"https://app.example"}, "https://evil.example", false},
+		{"listed allows no origin", []string{"https://app.example"}, "", true},
+		{"wildcard", []string{"*"}, "https://anything.example", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, baseURL := newTestServer(t, ServerConfig{AllowedOrigins: tt.allowed})
+
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL(baseURL), header)
+			if tt.wantOK {
+				if err != nil {
+					t.Fatalf("dial from %q failed: %v", tt.origin, err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatalf("dial from %q was accepted", tt.origin)
+			}
+			if resp == nil || resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("dial from %q failed with %v, want 403", tt.origin, err)
+			}
+		})
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{MaxMessageSize: 1024})
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(baseURL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A message at the limit is read; a bad join is answered with an error.
+	join := `{"type":"join","session_id":"s","peer_id":"p","payload":{"username":"` + strings.Repeat("a", 900) + `"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(join)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply SignalingMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("no reply to a message under the limit: %v", err)
+	}
+	if reply.Type != MessageTypeError {
+		t.Fatalf("reply = %s, want error", reply.Type)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after an oversized message = %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+// joinWithNewToken joins sessionID as a new participant and returns the
+// client with the server's answer to the join.
+func joinWithNewToken(t *testing.T, baseURL, sessionID string) (*Client, *SignalingMessage) {
+	t.Helper()
+
+	grant, err := RequestJoinToken(wsURL(baseURL), sessionID, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(wsURL(baseURL), sessionID, grant.PeerID, grant.Username)
+	client.SetJoinToken(grant.Token)
+	t.Cleanup(client.Disconnect)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	answers := client.Subscribe(ctx, MessageTypeJoined, MessageTypeLobbyWaiting)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	answer, ok := <-answers
+	if !ok {
+		t.Fatal("no answer to join before the timeout")
+	}
+	return client, answer
+}
+
+func TestKickedPeerCannotRejoinWithNewToken(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	host := joinTestClient(t, baseURL)
+
+	guest, answer := joinWithNewToken(t, baseURL, host.GetSessionID())
+	if answer.Type != MessageTypeJoined {
+		t.Fatalf("guest got %s before any kick, want joined", answer.Type)
+	}
+	if err := host.RemovePeer(guest.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same user comes back under a new peer ID and has to be admitted.
+	_, answer = joinWithNewToken(t, baseURL, host.GetSessionID())
+	if answer.Type != MessageTypeLobbyWaiting {
+		t.Fatalf("rejoin after a kick got %s, want lobby_waiting", answer.Type)
+	}
+}
+
+// guessPasscodes joins with grant on a new connection, sending passcode
+// up to attempts times, and returns the error code of each answer.
+func guessPasscodes(t *testing.T, baseURL string, grant *TokenResponse, sessionID string, attempts int) []ErrorCode {
+	t.Helper()
+
+	var codes []ErrorCode
+	for _, reply := range sendPasscodes(t, baseURL, nil, grant, sessionID, "wrong", attempts) {
+		var payload ErrorPayload
+		json.Unmarshal(reply.Payload, &payload)
+		codes = append(codes, payload.Code)
+	}
+	return codes
+}
+
+// sendPasscodes joins sessionID with passcode up to attempts times on one
+// raw connection dialled with header, returning the replies received
+// before the server closed it.
+func sendPasscodes(t *testing.T, baseURL string, header http.Header, grant *TokenResponse, sessionID, passcode string, attempts int) []SignalingMessage {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(baseURL), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	join, err := NewJoinMessage(sessionID, grant.PeerID, JoinPayload{Username: grant.Username, Token: grant.Token, Passcode: passcode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []SignalingMessage
+	for range attempts {
+		if err := conn.WriteJSON(join); err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply SignalingMessage
+		if err := conn.ReadJSON(&reply); err != nil {
+			break
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func TestWrongPasscodesAreLimited(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{Passcode: "right"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGrant := func() *TokenResponse {
+		grant, err := RequestJoinToken(wsURL(baseURL), session.SessionID, "guest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return grant
+	}
+
+	// A token's guesses count across connections.
+	grant := newGrant()
+	codes := guessPasscodes(t, baseURL, grant, session.SessionID, maxPasscodeFailuresPerPeer+1)
+	if len(codes) != maxPasscodeFailuresPerPeer {
+		t.Fatalf("got %d answers before the connection closed, want %d", len(codes), maxPasscodeFailuresPerPeer)
+	}
+	for _, code := range codes {
+		if code != ErrorCodeInvalidPasscode {
+			t.Fatalf("answers = %v, want all invalid_passcode", codes)
+		}
+	}
+	if codes := guessPasscodes(t, baseURL, grant, session.SessionID, 1); len(codes) != 1 || codes[0] != ErrorCodeTooManyAttempts {
+		t.Fatalf("same token on a new connection got %v, want too_many_attempts", codes)
+	}
+
+	// New tokens from the same address run into its limit.
+	for range maxPasscodeFailuresPerAddr/maxPasscodeFailuresPerPeer - 1 {
+		guessPasscodes(t, baseURL, newGrant(), session.SessionID, maxPasscodeFailuresPerPeer)
+	}
+	if codes := guessPasscodes(t, baseURL, newGrant(), session.SessionID, 1); len(codes) != 1 || codes[0] != ErrorCodeTooManyAttempts {
+		t.Fatalf("new token after %d failures from one address got %v, want too_many_attempts", maxPasscodeFailuresPerAddr, codes)
+	}
+}
+
+func TestRightPasscodeAfterOthersFail(t *testing.T) {
+	server, baseURL := newTestServer(t, ServerConfig{TrustedProxies: []string{"127.0.0.1"}})
+	server.passcodes.perSession = 2 * maxPasscodeFailuresPerPeer
+	server.passcodes.sessionDelay = 10 * time.Millisecond
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{Passcode: "right"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newGrant := func() *TokenResponse {
+		grant, err := RequestJoinToken(wsURL(baseURL), session.SessionID, "guest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return grant
+	}
+	from := func(addr string) http.Header {
+		return http.Header{"X-Forwarded-For": {addr}}
+	}
+
+	// Guessers behind the proxy use up more than the session's share of
+	// failures, and one of them its address's share.
+	for i := range maxPasscodeFailuresPerAddr / maxPasscodeFailuresPerPeer {
+		replies := sendPasscodes(t, baseURL, from("203.0.113.1"), newGrant(), session.SessionID, "wrong", maxPasscodeFailuresPerPeer)
+		if len(replies) != maxPasscodeFailuresPerPeer {
+			t.Fatalf("guesser %d got %d answers, want %d", i, len(replies), maxPasscodeFailuresPerPeer)
+		}
+	}
+	replies := sendPasscodes(t, baseURL, from("203.0.113.1"), newGrant(), session.SessionID, "right", 1)
+	if len(replies) != 1 || replies[0].Type != MessageTypeError {
+		t.Fatalf("exhausted address got %v, want an error", replies)
+	}
+
+	// Another client's address is counted apart, even when the proxy
+	// forwards a spoofed hop, and the right passcode still gets it in.
+	replies = sendPasscodes(t, baseURL, from("203.0.113.1, 198.51.100.7"), newGrant(), session.SessionID, "right", 1)
+	if len(replies) != 1 || replies[0].Type != MessageTypeJoined {
+		t.Fatalf("right passcode after other clients' failures got %v, want joined", replies)
+	}
+}
+
+// nextChat waits for the next chat message on messages.
+func nextChat(t *testing.T, messages <-chan *SignalingMessage) ChatPayload {
+	t.Helper()
+
+	msg, ok := <-messages
+	if !ok {
+		t.Fatal("no chat before the timeout")
+	}
+	var chat ChatPayload
+	if err := json.Unmarshal(msg.Payload, &chat); err != nil {
+		t.Fatal(err)
+	}
+	return chat
+}
+
+func TestRecordedChatSkipsDeliveredPeers(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	host := joinTestClient(t, baseURL)
+	sessionID := host.GetSessionID()
+	reached, _ := joinWithNewToken(t, baseURL, sessionID)
+	missed, _ := joinWithNewToken(t, baseURL, sessionID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reachedChats := reached.Subscribe(ctx, MessageTypeChat)
+	missedChats := missed.Subscribe(ctx, MessageTypeChat)
+
+	recorded := ChatPayload{ID: uuid.NewString(), Text: "sent peer to peer"}
+	if err := host.RecordChat(recorded, []string{reached.GetPeerID()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.SendChat("", "sent through the server"); err != nil {
+		t.Fatal(err)
+	}
+
+	if chat := nextChat(t, missedChats); chat.ID != recorded.ID || chat.From != host.GetPeerID() {
+		t.Fatalf("peer the sender missed got %+v, want the recorded message", chat)
+	}
+	if chat := nextChat(t, reachedChats); chat.Text != "sent through the server" {
+		t.Fatalf("peer the sender reached got %q again from the server", chat.Text)
+	}
+
+	// Both are in the history for a peer that joins later.
+	grant, err := RequestJoinToken(wsURL(baseURL), sessionID, "late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := NewClient(wsURL(baseURL), sessionID, grant.PeerID, grant.Username)
+	late.SetJoinToken(grant.Token)
+	t.Cleanup(late.Disconnect)
+	history := late.Subscribe(ctx, MessageTypeChatHistory)
+	if err := late.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := <-history
+	if !ok {
+		t.Fatal("no chat_history before the timeout")
+	}
+	var payload ChatHistoryPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Messages) != 2 || payload.Messages[0].ID != recorded.ID || payload.Messages[0].Delivered != nil {
+		t.Fatalf("history = %+v, want the recorded message first", payload.Messages)
+	}
+}
+
+const testAdminToken = "test-admin-token"
+
+// admin sends an admin API request with body, if not empty, and returns the
+// response status.
+func admin(t *testing.T, method, url, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminKickWithoutHostLetsNewPeersIn(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{AdminToken: testAdminToken})
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host never joins, so nobody could admit anyone from a lobby.
+	guest, answer := joinWithNewToken(t, baseURL, session.SessionID)
+	if answer.Type != MessageTypeJoined {
+		t.Fatalf("guest got %s, want joined", answer.Type)
+	}
+	stayer, _ := joinWithNewToken(t, baseURL, session.SessionID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	left := stayer.Subscribe(ctx, MessageTypePeerLeft)
+	if status := admin(t, http.MethodDelete, baseURL+"/admin/sessions/"+session.SessionID+"/peers/"+guest.GetPeerID(), ""); status != http.StatusNoContent {
+		t.Fatalf("kick = %d, want 204", status)
+	}
+	if _, ok := <-left; !ok {
+		t.Fatal("no peer_left for the kicked guest")
+	}
+
+	if _, answer := joinWithNewToken(t, baseURL, session.SessionID); answer.Type != MessageTypeJoined {
+		t.Fatalf("join after a kick with no host got %s, want joined", answer.Type)
+	}
+}
+
+func TestAdminAdmitsFromLobby(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{AdminToken: testAdminToken})
+	host := joinTestClient(t, baseURL)
+	sessionID := host.GetSessionID()
+	guest, _ := joinWithNewToken(t, baseURL, sessionID)
+	if err := host.RemovePeer(guest.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting, answer := joinWithNewToken(t, baseURL, sessionID)
+	if answer.Type != MessageTypeLobbyWaiting {
+		t.Fatalf("join after a kick got %s, want lobby_waiting", answer.Type)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	joined := waiting.Subscribe(ctx, MessageTypeJoined)
+	if status := admin(t, http.MethodPost, baseURL+"/admin/sessions/"+sessionID+"/lobby/"+waiting.GetPeerID()+"/admit", ""); status != http.StatusNoContent {
+		t.Fatalf("admit = %d, want 204", status)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("admitted peer got no joined")
+	}
+	if status := admin(t, http.MethodPost, baseURL+"/admin/sessions/"+sessionID+"/lobby/nobody/admit", ""); status != http.StatusNotFound {
+		t.Fatalf("admit of a peer not waiting = %d, want 404", status)
+	}
+
+	// Turning the lobby off lets everyone waiting in.
+	waiting, _ = joinWithNewToken(t, baseURL, sessionID)
+	joined = waiting.Subscribe(ctx, MessageTypeJoined)
+	if status := admin(t, http.MethodPut, baseURL+"/admin/sessions/"+sessionID+"/lobby", `{"enabled": false}`); status != http.StatusNoContent {
+		t.Fatalf("lobby off = %d, want 204", status)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("waiting peer got no joined when the lobby was turned off")
+	}
+}
+
+func TestListSessionsShowsOnlyListedSessions(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+
+	listed, err := CreateSession(wsURL(baseURL), CreateSessionRequest{Listed: true, Passcode: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateSession(wsURL(baseURL), CreateSessionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lookups, err := ListSessions(wsURL(baseURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lookups) != 1 || lookups[0].SessionID != listed.SessionID || !lookups[0].PasscodeRequired {
+		t.Fatalf("listed sessions = %+v, want only %s with a passcode", lookups, listed.SessionID)
+	}
+}
+
+// joinAsHost joins session on the server at serverURL (its websocket URL)
+// with the host token it was created with.
+func joinAsHost(t *testing.T, serverURL string, session *CreateSessionResponse) *Client {
+	t.Helper()
+
+	client := NewClient(serverURL, session.SessionID, session.Host.PeerID, session.Host.Username)
+	client.SetJoinToken(session.Host.Token)
+	t.Cleanup(client.Disconnect)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	joined := client.Subscribe(ctx, MessageTypeJoined)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("host got no joined before the timeout")
+	}
+	return client
+}
+
+// nextLobbyPeer waits for the next lobby message on messages and returns
+// the peer it names.
+func nextLobbyPeer(t *testing.T, messages <-chan *SignalingMessage) string {
+	t.Helper()
+
+	msg, ok := <-messages
+	if !ok {
+		t.Fatal("no lobby message before the timeout")
+	}
+	var payload LobbyPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload.PeerID
+}
+
+// waitInLobby joins sessionID through the server at baseURL and checks it
+// is held in the lobby.
+func waitInLobby(t *testing.T, baseURL, sessionID string) *Client {
+	t.Helper()
+
+	guest, answer := joinWithNewToken(t, baseURL, sessionID)
+	if answer.Type != MessageTypeLobbyWaiting {
+		t.Fatalf("join got %s, want lobby_waiting", answer.Type)
+	}
+	return guest
+}
+
+func newLobbySession(t *testing.T, baseURL string) (*CreateSessionResponse, *Client) {
+	t.Helper()
+
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{Lobby: true, Username: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, joinAsHost(t, wsURL(baseURL), session)
+}
+
+func TestLobbyAdmit(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	session, host := newLobbySession(t, baseURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	requests := host.Subscribe(ctx, MessageTypeLobbyRequest)
+	joins := host.Subscribe(ctx, MessageTypePeerJoined)
+
+	guest := waitInLobby(t, baseURL, session.SessionID)
+	if peerID := nextLobbyPeer(t, requests); peerID != guest.GetPeerID() {
+		t.Fatalf("lobby_request for %s, want %s", peerID, guest.GetPeerID())
+	}
+
+	joined := guest.Subscribe(ctx, MessageTypeJoined)
+	if err := host.Admit(guest.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("admitted guest got no joined")
+	}
+	if msg, ok := <-joins; !ok || msg.PeerID != guest.GetPeerID() {
+		t.Fatal("host got no peer_joined for the admitted guest")
+	}
+}
+
+func TestLobbyDeny(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	session, host := newLobbySession(t, baseURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	left := host.Subscribe(ctx, MessageTypeLobbyLeft)
+
+	guest := waitInLobby(t, baseURL, session.SessionID)
+	denied := guest.Subscribe(ctx, MessageTypeLobbyDenied)
+	if err := host.Deny(guest.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-denied; !ok {
+		t.Fatal("denied guest got no lobby_denied")
+	}
+	if peerID := nextLobbyPeer(t, left); peerID != guest.GetPeerID() {
+		t.Fatalf("lobby_left for %s, want %s", peerID, guest.GetPeerID())
+	}
+}
+
+func TestLobbyWaitingPeerDisconnects(t *testing.T) {
+	server, baseURL := newTestServer(t, ServerConfig{})
+	session, host := newLobbySession(t, baseURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	left := host.Subscribe(ctx, MessageTypeLobbyLeft)
+
+	guest := waitInLobby(t, baseURL, session.SessionID)
+	guest.Disconnect()
+	if peerID := nextLobbyPeer(t, left); peerID != guest.GetPeerID() {
+		t.Fatalf("lobby_left for %s, want %s", peerID, guest.GetPeerID())
+	}
+
+	lobby := server.getSession(session.SessionID)
+	lobby.mu.RLock()
+	_, waiting := lobby.waiting[guest.GetPeerID()]
+	lobby.mu.RUnlock()
+	if waiting {
+		t.Fatal("disconnected guest is still waiting")
+	}
+}
+
+func TestLobbyAcrossNodes(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	t.Cleanup(func() { backplane.Close() })
+	config := ServerConfig{Backplane: backplane, Tokens: TokenIssuerConfig{Secret: []byte("cluster secret")}}
+	_, hostURL := newTestServer(t, config)
+	guestServer, guestURL := newTestServer(t, config)
+
+	session, host := newLobbySession(t, hostURL)
+	waitFor(t, "session on the other node", func() bool {
+		return guestServer.getSession(session.SessionID) != nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	requests := host.Subscribe(ctx, MessageTypeLobbyRequest)
+
+	// The host's admit reaches the guest's node as an admit event.
+	guest := waitInLobby(t, guestURL, session.SessionID)
+	if peerID := nextLobbyPeer(t, requests); peerID != guest.GetPeerID() {
+		t.Fatalf("lobby_request for %s, want %s", peerID, guest.GetPeerID())
+	}
+	joined := guest.Subscribe(ctx, MessageTypeJoined)
+	if err := host.Admit(guest.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-joined; !ok {
+		t.Fatal("guest on the other node got no joined")
+	}
+
+	// And a deny as a deny event.
+	turnedAway := waitInLobby(t, guestURL, session.SessionID)
+	if peerID := nextLobbyPeer(t, requests); peerID != turnedAway.GetPeerID() {
+		t.Fatalf("lobby_request for %s, want %s", peerID, turnedAway.GetPeerID())
+	}
+	denied := turnedAway.Subscribe(ctx, MessageTypeLobbyDenied)
+	if err := host.Deny(turnedAway.GetPeerID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-denied; !ok {
+		t.Fatal("guest on the other node got no lobby_denied")
+	}
+}
+
+func TestRoomFull(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	const maxPeers = 3
+	session, err := CreateSession(wsURL(baseURL), CreateSessionRequest{MaxPeers: maxPeers, Username: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinAsHost(t, wsURL(baseURL), session)
+
+	// A token fetched while there is room no longer gets in once the
+	// others have filled it.
+	late, err := RequestJoinToken(wsURL(baseURL), session.SessionID, "late")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range maxPeers - 1 {
+		if _, answer := joinWithNewToken(t, baseURL, session.SessionID); answer.Type != MessageTypeJoined {
+			t.Fatalf("join with room left got %s, want joined", answer.Type)
+		}
+	}
+
+	var reqErr *RequestError
+	if _, err := RequestJoinToken(wsURL(baseURL), session.SessionID, "guest"); !errors.As(err, &reqErr) || reqErr.Code != ErrorCodeRoomFull {
+		t.Fatalf("token for a full room: %v, want room_full", err)
+	}
+
+	replies := sendPasscodes(t, baseURL, nil, late, session.SessionID, "", 1)
+	if len(replies) != 1 || replies[0].Type != MessageTypeError {
+		t.Fatalf("join of a full room got %v, want an error", replies)
+	}
+	var payload ErrorPayload
+	if err := json.Unmarshal(replies[0].Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != ErrorCodeRoomFull {
+		t.Fatalf("join of a full room failed with %s, want room_full", payload.Code)
+	}
+}
+
+func TestOfferToUnknownPeer(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	host := joinTestClient(t, baseURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := host.Subscribe(ctx, MessageTypeError)
+	if err := host.SendOfferTo("nobody", webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, ok := <-errs
+	if !ok {
+		t.Fatal("no error for an offer to an unknown peer")
+	}
+	var payload ErrorPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != ErrorCodePeerNotFound {
+		t.Fatalf("offer to an unknown peer failed with %s, want peer_not_found", payload.Code)
+	}
+}
+
+func TestTargetedOfferReachesOnlyTarget(t *testing.T) {
+	_, baseURL := newTestServer(t, ServerConfig{})
+	host := joinTestClient(t, baseURL)
+	target, _ := joinWithNewToken(t, baseURL, host.GetSessionID())
+	bystander, _ := joinWithNewToken(t, baseURL, host.GetSessionID())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	targetOffers := target.Subscribe(ctx, MessageTypeOffer)
+	bystanderOffers := bystander.Subscribe(ctx, MessageTypeOffer)
+
+	offer := func(to *Client, sdp string) {
+		if err := host.SendOfferTo(to.GetPeerID(), webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer(target, "for target")
+	// Sent after the first, so it is what the bystander sees first unless
+	// the first leaked.
+	offer(bystander, "for bystander")
+
+	for _, tt := range []struct {
+		offers <-chan *SignalingMessage
+		to     *Client
+		want   string
+	}{
+		{targetOffers, target, "for target"},
+		{bystanderOffers, bystander, "for bystander"},
+	} {
+		msg, ok := <-tt.offers
+		if !ok {
+			t.Fatalf("%s got no offer", tt.to.GetPeerID())
+		}
+		var payload OfferPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if sdp := payload.SDP; sdp.SDP != tt.want || msg.PeerID != host.GetPeerID() || msg.TargetPeerID != tt.to.GetPeerID() {
+			t.Fatalf("%s got %q from %s to %s, want %q from the host", tt.to.GetPeerID(), payload.SDP.SDP, msg.PeerID, msg.TargetPeerID, tt.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// emptySessionTTL is how long a session created through the API survives
+// without anyone joining it.
+const emptySessionTTL = 10 * time.Minute
+
+func newSession(sessionID string, createdAt time.Time, options CreateSessionRequest) *Session {
+	roles := make(map[string]string)
+	if options.creator != "" {
+		roles[options.creator] = RoleHost
+	}
+	return &Session{
+		id:            sessionID,
+		createdAt:     createdAt,
+		maxPeers:      options.MaxPeers,
+		lobby:         options.Lobby,
+		guarded:       options.guarded,
+		listed:        options.Listed,
+		passcode:      options.passcodeHash,
+		code:          options.code,
+		codeExpiresAt: options.codeExpiresAt,
+		clients:       make(map[string]*ServerClient),
+		remote:        make(map[string]remotePeer),
+		removed:       make(map[string]bool),
+		creator:       options.creator,
+		roles:         roles,
+		waiting:       make(map[string]waitingPeer),
+	}
+}
+
+// memberRole is the role peerID gets when it joins: the one it last had in
+// the session, or participant if it is new.
+func (session *Session) memberRole(peerID string) string {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	if role, exists := session.roles[peerID]; exists {
+		return role
+	}
+	return RoleParticipant
+}
+
+// size counts the session's peers on every node.
+func (session *Session) size() int {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	return len(session.clients) + len(session.remote)
+}
+
+// info describes client to other peers. The caller must hold its session's
+// lock, since the role can change.
+func (client *ServerClient) info() PeerInfo {
+	return PeerInfo{
+		PeerID:   client.peerID,
+		Username: client.username,
+		Role:     client.role,
+		Color:    client.color,
+		Avatar:   client.avatar,
+		JoinedAt: client.joinedAt,
+	}
+}
+
+func (session *Session) info() SessionInfoPayload {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(session.clients)+len(session.remote))
+	for _, client := range session.clients {
+		peers = append(peers, client.info())
+	}
+	for _, peer := range session.remote {
+		peers = append(peers, peer.info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].JoinedAt.Before(peers[j].JoinedAt)
+	})
+
+	info := SessionInfoPayload{
+		SessionID:        session.id,
+		CreatedAt:        session.createdAt,
+		Peers:            peers,
+		MaxPeers:         session.maxPeers,
+		Locked:           session.locked,
+		Lobby:            session.lobbyActiveLocked(),
+		PasscodeRequired: session.passcode != "",
+	}
+	if session.codeValid(time.Now()) {
+		info.Code = session.code
+		info.CodeExpiresAt = session.codeExpiresAt
+	}
+	return info
+}
+
+// sessionInfo describes session to clients, flagging it for an SFU if it
+// has outgrown the mesh threshold.
+func (s *Server) sessionInfo(session *Session) SessionInfoPayload {
+	info := session.info()
+	info.UseSFU = s.meshThreshold > 0 && len(info.Peers) > s.meshThreshold
+	return info
+}
+
+// checkMeshThreshold sends fresh session info to the session's peers on
+// this node, except skipPeerID, when a join has just taken it past the mesh
+// threshold.
+func (s *Server) checkMeshThreshold(session *Session, skipPeerID string) {
+	if session == nil || s.meshThreshold <= 0 || session.size() != s.meshThreshold+1 {
+		return
+	}
+	log.Printf("Session %s outgrew a mesh of %d peers", session.id, s.meshThreshold)
+	s.sendSessionInfoToAll(session, skipPeerID)
+}
+
+// sendSessionInfoToAll sends fresh session info to the session's peers on
+// this node, except skipPeerID.
+func (s *Server) sendSessionInfoToAll(session *Session, skipPeerID string) {
+	session.mu.RLock()
+	clients := make([]*ServerClient, 0, len(session.clients))
+	for peerID, client := range session.clients {
+		if peerID != skipPeerID {
+			clients = append(clients, client)
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, client := range clients {
+		s.sendSessionInfo(client)
+	}
+}
+
+// createSession registers a new, empty session with a fresh meeting code
+// and a host peer ID for its creator. It is removed again if nobody joins
+// within emptySessionTTL.
+func (s *Server) createSession(options CreateSessionRequest) *Session {
+	sessionID := uuid.New().String()
+	now := time.Now()
+	options.creator = uuid.New().String()
+
+	s.mu.Lock()
+	code, err := s.assignMeetingCode()
+	if err == nil {
+		s.codes[code] = sessionID
+	}
+	s.mu.Unlock()
+	if err != nil {
+		// The session still works by its ID.
+		log.Printf("Session %s has no meeting code: %v", sessionID, err)
+	} else {
+		options.code, options.codeExpiresAt = code, now.Add(s.meetingCodeTTL)
+	}
+
+	session := s.addSession(sessionID, now, options)
+	s.publish(session.event(eventSessionCreated))
+
+	log.Printf("Created new session: %s (code %s)", session.id, session.code)
+	return session
+}
+
+// addSession registers a session created here or announced by another
+// node, returning the existing one if it is already known.
+func (s *Server) addSession(sessionID string, createdAt time.Time, options CreateSessionRequest) *Session {
+	s.mu.Lock()
+	if session, exists := s.sessions[sessionID]; exists {
+		s.mu.Unlock()
+		return session
+	}
+	session := newSession(sessionID, createdAt, options)
+	s.sessions[sessionID] = session
+	if session.code != "" {
+		s.codes[session.code] = sessionID
+	}
+	s.mu.Unlock()
+	s.metrics.SessionOpened()
+
+	time.AfterFunc(emptySessionTTL, func() {
+		s.deleteSessionIfEmpty(session)
+	})
+	return session
+}
+
+func (s *Server) deleteSessionIfEmpty(session *Session) {
+	s.mu.Lock()
+	// Someone may have joined, or the session been replaced, since the
+	// caller saw it empty.
+	if s.sessions[session.id] != session || session.size() > 0 {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, session.id)
+	s.forgetMeetingCode(session)
+	s.mu.Unlock()
+
+	s.metrics.SessionClosed()
+	log.Printf("Deleted empty session: %s", session.id)
+	// Nobody is left to admit anyone still waiting.
+	s.closeLobby(session, "the session ended")
+}
+
+func (s *Server) sendSessionInfo(client *ServerClient) {
+	session := s.getSession(client.sessionID)
+	if session == nil {
+		return
+	}
+
+	payload, err := json.Marshal(s.sessionInfo(session))
+	if err != nil {
+		log.Printf("Failed to marshal session info: %v", err)
+		return
+	}
+
+	s.sendMessage(client, &SignalingMessage{
+		Type:      MessageTypeSessionInfo,
+		SessionID: client.sessionID,
+		PeerID:    client.peerID,
+		Payload:   payload,
+	})
+}
+
+// CreateSessionRequest is the optional body of POST /sessions.
+type CreateSessionRequest struct {
+	// MaxPeers caps the session's size. Zero, or anything above the
+	// server's limit, means the server's limit.
+	MaxPeers int `json:"max_peers,omitempty"`
+	// Lobby makes new participants wait until a host or co-host admits
+	// them.
+	Lobby bool `json:"lobby,omitempty"`
+	// Passcode, if set, must be sent with every join. Only a hash of it
+	// is kept.
+	Passcode string `json:"passcode,omitempty"`
+	// Username is the creator's name in the returned host token.
+	Username string `json:"username,omitempty"`
+	// Listed makes the session show up in GET /sessions, for anyone to
+	// find and join. Other sessions need their ID or meeting code.
+	Listed bool `json:"listed,omitempty"`
+
+	passcodeHash  string
+	code          string
+	codeExpiresAt time.Time
+	creator       string
+	guarded       bool
+}
+
+// CreateSessionResponse is the new session and the join token that makes
+// its creator the host. Nobody else can get a host token for it.
+type CreateSessionResponse struct {
+	SessionInfoPayload
+	Host TokenResponse `json:"host"`
+}
+
+func (s *Server) HandleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req CreateSessionRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "invalid session request")
+		return
+	}
+	if req.MaxPeers < 0 {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, "max_peers must not be negative")
+		return
+	}
+
+	if len(req.Passcode) > maxPasscodeLength {
+		writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, fmt.Sprintf("passcode must be at most %d bytes", maxPasscodeLength))
+		return
+	}
+
+	if s.maxPeersPerSession > 0 && (req.MaxPeers == 0 || req.MaxPeers > s.maxPeersPerSession) {
+		req.MaxPeers = s.maxPeersPerSession
+	}
+	if req.Passcode != "" {
+		hash, err := hashPasscode(req.Passcode)
+		if err != nil {
+			log.Printf("Failed to create session: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, ErrorCodeInternal, "failed to create session")
+			return
+		}
+		req.Passcode, req.passcodeHash = "", hash
+	}
+
+	session := s.createSession(req)
+	host, err := s.issueToken(session.id, session.creator, req.Username, RoleHost)
+	if err != nil {
+		log.Printf("Failed to issue host token: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, ErrorCodeInternal, "failed to issue token")
+		return
+	}
+	writeJSON(w, http.StatusCreated, CreateSessionResponse{
+		SessionInfoPayload: s.sessionInfo(session),
+		Host:               host,
+	})
+}
+
+// SessionLookup is what anyone holding a session's ID or meeting code, or
+// listing the server's listed sessions, may learn about it: only what
+// joining it takes. Who is in it is for its members and the admin API.
+type SessionLookup struct {
+	SessionID        string    `json:"session_id"`
+	CreatedAt        time.Time `json:"created_at,omitzero"`
+	Locked           bool      `json:"locked,omitempty"`
+	Lobby            bool      `json:"lobby,omitempty"`
+	PasscodeRequired bool      `json:"passcode_required,omitempty"`
+}
+
+func (session *Session) lookup() SessionLookup {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	return SessionLookup{
+		SessionID:        session.id,
+		CreatedAt:        session.createdAt,
+		Locked:           session.locked,
+		Lobby:            session.lobbyActiveLocked(),
+		PasscodeRequired: session.passcode != "",
+	}
+}
+
+// HandleGetSession looks a session up by its ID or meeting code.
+func (s *Server) HandleGetSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.PathValue("id")
+
+	session := s.findSession(sessionID)
+	if session == nil {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeSessionNotFound, fmt.Sprintf("session %s not found", sessionID))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, session.lookup())
+}
+
+// HandleListSessions lists the sessions created with Listed set, oldest
+// first.
+func (s *Server) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	lookups := make([]SessionLookup, 0)
+	for _, session := range sessions {
+		session.mu.RLock()
+		listed := session.listed
+		session.mu.RUnlock()
+		if listed {
+			lookups = append(lookups, session.lookup())
+		}
+	}
+	sort.Slice(lookups, func(i, j int) bool {
+		return lookups[i].CreatedAt.Before(lookups[j].CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, lookups)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// CreateSession asks the signaling server at serverURL (its websocket URL)
+// to create a new session, returning it with the creator's host token.
+func CreateSession(serverURL string, req CreateSessionRequest) (*CreateSessionResponse, error) {
+	var info CreateSessionResponse
+	if err := httpJSON(http.MethodPost, serverURL, "/sessions", req, &info); err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	return &info, nil
+}
+
+// LookupSession finds a session by its ID or meeting code on the signaling
+// server at serverURL (its websocket URL).
+func LookupSession(serverURL, sessionIDOrCode string) (*SessionLookup, error) {
+	var lookup SessionLookup
+	if err := httpJSON(http.MethodGet, serverURL, "/sessions/"+url.PathEscape(sessionIDOrCode), nil, &lookup); err != nil {
+		return nil, fmt.Errorf("failed to get session %s: %w", sessionIDOrCode, err)
+	}
+	return &lookup, nil
+}
+
+// ListSessions returns the listed sessions on the signaling server at
+// serverURL (its websocket URL).
+func ListSessions(serverURL string) ([]SessionLookup, error) {
+	var lookups []SessionLookup
+	if err := httpJSON(http.MethodGet, serverURL, "/sessions", nil, &lookups); err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	return lookups, nil
+}
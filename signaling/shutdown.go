@@ -0,0 +1,94 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Shutdown stops accepting connections, tells every client to reconnect
+// later with a server_shutdown message, closes their sockets with a close
+// frame and waits for their pumps to finish. Connections still open when
+// ctx is done are closed outright and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ready.Store(false)
+
+	s.connsMu.Lock()
+	if s.shuttingDown {
+		s.connsMu.Unlock()
+		return fmt.Errorf("server already shutting down")
+	}
+	s.shuttingDown = true
+	clients := make([]*ServerClient, 0, len(s.conns))
+	for client := range s.conns {
+		clients = append(clients, client)
+	}
+	s.connsMu.Unlock()
+
+	// Stops the listener and waits for plain HTTP requests. Websockets are
+	// hijacked connections and are handled below.
+	if err := s.httpServer.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Failed to shut down HTTP server: %v", err)
+	}
+
+	payload, err := json.Marshal(ShutdownPayload{
+		Reason:           "server shutting down",
+		ReconnectAfterMs: s.reconnectAfter.Milliseconds(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal shutdown payload: %w", err)
+	}
+	// The message carries no session or peer ID, so the same bytes go to
+	// every client, joined or not.
+	msgBytes, err := json.Marshal(&SignalingMessage{
+		Type:    MessageTypeServerShutdown,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal shutdown message: %w", err)
+	}
+
+	log.Printf("Draining %d connections", len(clients))
+	for _, client := range clients {
+		select {
+		case client.send <- msgBytes:
+		default:
+			s.metrics.SendDropped()
+		}
+		client.closeAfterFlush(websocket.CloseGoingAway, "server shutting down")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.pumps.Wait()
+		close(drained)
+	}()
+
+	// Other nodes hold this node's peers for a while in case they
+	// reconnect there.
+	s.publish(clusterEvent{Kind: eventNodeDown})
+	defer func() {
+		if s.ownsBackplane {
+			s.backplane.Close()
+		}
+	}()
+
+	select {
+	case <-drained:
+		log.Println("All connections drained")
+		return nil
+	case <-ctx.Done():
+		s.connsMu.Lock()
+		for client := range s.conns {
+			client.conn.Close()
+		}
+		s.connsMu.Unlock()
+		<-drained
+		return ctx.Err()
+	}
+}
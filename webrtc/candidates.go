@@ -0,0 +1,30 @@
+package webrtc
+
+import (
+	"sync/atomic"
+)
+
+// maxPendingCandidates bounds how many early ICE candidates are kept per
+// peer. A normal gathering produces far fewer; anything beyond this is most
+// likely a misbehaving peer.
+const maxPendingCandidates = 100
+
+type CandidateStats struct {
+	Buffered uint64
+	Flushed  uint64
+	Dropped  uint64
+}
+
+type candidateCounters struct {
+	buffered atomic.Uint64
+	flushed  atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+func (c *candidateCounters) snapshot() CandidateStats {
+	return CandidateStats{
+		Buffered: c.buffered.Load(),
+		Flushed:  c.flushed.Load(),
+		Dropped:  c.dropped.Load(),
+	}
+}
@@ -0,0 +1,781 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Files travel over the negotiated "files" data channel. Control messages
+// are JSON text; chunks are binary: the 16-byte transfer ID, the chunk's
+// 8-byte big-endian offset, then the data.
+const (
+	fileChunkSize   = 16 * 1024
+	chunkHeaderSize = 24
+
+	// minReportStep keeps progress reports for large files to about one
+	// per percent, and small files from reporting every chunk.
+	minReportStep = 256 * 1024
+
+	// finishedTransferTTL is how long a finished transfer is remembered,
+	// so that an offer repeated after a reconnect gets the same answer
+	// instead of asking the user again.
+	finishedTransferTTL = 5 * time.Minute
+)
+
+const (
+	fileOffer    = "offer"
+	fileAccept   = "accept"
+	fileReject   = "reject"
+	fileCancel   = "cancel"
+	fileComplete = "complete"
+	fileFailed   = "failed"
+)
+
+var errTransferStopped = errors.New("transfer stopped")
+
+type TransferState string
+
+const (
+	// TransferOffered waits for the receiver to accept or reject the file.
+	TransferOffered TransferState = "offered"
+	TransferActive  TransferState = "active"
+	// TransferInterrupted lost its connection. The sender offers the file
+	// again when the connection is back, and the receiver resumes from what
+	// it already has.
+	TransferInterrupted TransferState = "interrupted"
+	TransferCompleted   TransferState = "completed"
+	TransferFailed      TransferState = "failed"
+	TransferRejected    TransferState = "rejected"
+	TransferCanceled    TransferState = "canceled"
+)
+
+// Done reports whether a transfer in this state is over.
+func (s TransferState) Done() bool {
+	switch s {
+	case TransferCompleted, TransferFailed, TransferRejected, TransferCanceled:
+		return true
+	}
+	return false
+}
+
+// Transfer describes a file transfer at one moment.
+type Transfer struct {
+	ID     string
+	PeerID string
+	Name   string
+	Size   int64
+	// SHA256 is the hex digest of the whole file, which the receiver checks
+	// before keeping it.
+	SHA256      string
+	Outgoing    bool
+	Transferred int64
+	State       TransferState
+	// Error explains a failed transfer.
+	Error string
+}
+
+type TransferHandler func(transfer Transfer)
+
+type fileMessage struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// transfer is the live state behind a Transfer, guarded by the manager's
+// transfersMu.
+type transfer struct {
+	Transfer
+	// path is the file being sent, or where a received file is kept. It is
+	// written to path+".part" until its checksum matches.
+	path string
+	// file is the partial download while chunks are arriving.
+	file *os.File
+	// stop is closed to end the current send.
+	stop     chan struct{}
+	reported int64
+}
+
+func (t *transfer) partPath() string {
+	return t.path + ".part"
+}
+
+// finishLocked moves t to a final state, ending its send and dropping a
+// partial download.
+func (t *transfer) finishLocked(state TransferState, reason string) {
+	t.State, t.Error = state, reason
+	t.stopLocked()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if !t.Outgoing && state != TransferCompleted && t.path != "" {
+		if err := os.Remove(t.partPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove partial file %s: %v", t.partPath(), err)
+		}
+	}
+}
+
+func (t *transfer) stopLocked() {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+}
+
+// progressLocked records how far t got, returning whether that is worth
+// reporting.
+func (t *transfer) progressLocked(transferred int64) bool {
+	t.Transferred = transferred
+	if transferred < t.Size && transferred-t.reported < max(t.Size/100, minReportStep) {
+		return false
+	}
+	t.reported = transferred
+	return true
+}
+
+// openPartLocked opens the partial download, keeping what an interrupted
+// attempt already received unless restart is set.
+func (t *transfer) openPartLocked(restart bool) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if restart {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(t.partPath(), flags, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", t.partPath(), err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %w", t.partPath(), err)
+	}
+
+	offset := min(info.Size(), t.Size)
+	if info.Size() > offset {
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to truncate %s: %w", t.partPath(), err)
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek %s: %w", t.partPath(), err)
+	}
+
+	t.file = file
+	t.Transferred, t.reported = offset, offset
+	return nil
+}
+
+// SendFile offers the file at path to peerID and returns the transfer's ID.
+// The file is sent once the peer accepts it.
+func (m *Manager) SendFile(peerID, path string) (string, error) {
+	m.mu.RLock()
+	peer, exists := m.peers[peerID]
+	m.mu.RUnlock()
+	if !exists {
+		return "", fmt.Errorf("peer %s not found", peerID)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+
+	t := &transfer{
+		Transfer: Transfer{
+			ID:       uuid.NewString(),
+			PeerID:   peerID,
+			Name:     filepath.Base(path),
+			Size:     info.Size(),
+			SHA256:   sum,
+			Outgoing: true,
+			State:    TransferOffered,
+		},
+		path: path,
+	}
+
+	m.transfersMu.Lock()
+	m.transfers[t.ID] = t
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+	m.reportTransfer(snapshot)
+
+	// If the channel is not open yet, the offer goes out when it opens.
+	if err := m.sendFileControl(peer, offerMessage(snapshot)); err != nil {
+		log.Printf("Offering %s to %s when the file channel opens: %v", t.Name, peerID, err)
+	}
+	log.Printf("Offered %s (%d bytes) to %s", t.Name, t.Size, peerID)
+	return t.ID, nil
+}
+
+// AcceptFile accepts an offered file, saving it at path once it has arrived
+// and its checksum matches.
+func (m *Manager) AcceptFile(transferID, path string) error {
+	m.transfersMu.Lock()
+	t, exists := m.transfers[transferID]
+	if !exists || t.Outgoing || t.State != TransferOffered {
+		m.transfersMu.Unlock()
+		return fmt.Errorf("no pending file offer %s", transferID)
+	}
+	t.path = path
+	if err := t.openPartLocked(true); err != nil {
+		m.transfersMu.Unlock()
+		return err
+	}
+	t.State = TransferActive
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	m.reportTransfer(snapshot)
+	m.answerOffer(snapshot)
+	return nil
+}
+
+func (m *Manager) RejectFile(transferID string) error {
+	m.transfersMu.Lock()
+	t, exists := m.transfers[transferID]
+	if !exists || t.Outgoing || t.State != TransferOffered {
+		m.transfersMu.Unlock()
+		return fmt.Errorf("no pending file offer %s", transferID)
+	}
+	t.finishLocked(TransferRejected, "")
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	m.reportTransfer(snapshot)
+	m.sendFileControlTo(snapshot.PeerID, fileMessage{Type: fileReject, ID: transferID})
+	return nil
+}
+
+// CancelTransfer stops a transfer in either direction and tells the peer.
+func (m *Manager) CancelTransfer(transferID string) error {
+	m.transfersMu.Lock()
+	t, exists := m.transfers[transferID]
+	if !exists || t.State.Done() {
+		m.transfersMu.Unlock()
+		return fmt.Errorf("no running transfer %s", transferID)
+	}
+	t.finishLocked(TransferCanceled, "")
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	m.reportTransfer(snapshot)
+	m.sendFileControlTo(snapshot.PeerID, fileMessage{Type: fileCancel, ID: transferID})
+	return nil
+}
+
+// answerOffer tells the sender where to start an accepted transfer, or
+// verifies it straight away if nothing is missing.
+func (m *Manager) answerOffer(t Transfer) {
+	m.sendFileControlTo(t.PeerID, fileMessage{Type: fileAccept, ID: t.ID, Offset: t.Transferred})
+	if t.Transferred == t.Size {
+		m.finishReceive(t.ID)
+	}
+}
+
+func (m *Manager) handleFileMessage(peerID string, data []byte, binary bool) {
+	if binary {
+		m.receiveChunk(peerID, data)
+		return
+	}
+
+	var msg fileMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Failed to unmarshal file message from %s: %v", peerID, err)
+		return
+	}
+	if msg.Type == fileOffer {
+		m.handleFileOffer(peerID, msg)
+		return
+	}
+
+	m.transfersMu.Lock()
+	t, exists := m.transfers[msg.ID]
+	if !exists || t.PeerID != peerID || t.State.Done() {
+		m.transfersMu.Unlock()
+		return
+	}
+
+	switch {
+	case msg.Type == fileCancel:
+		t.finishLocked(TransferCanceled, "")
+
+	case !t.Outgoing:
+		m.transfersMu.Unlock()
+		log.Printf("Unexpected %s from %s for incoming transfer %s", msg.Type, peerID, msg.ID)
+		return
+
+	case msg.Type == fileAccept:
+		if t.State == TransferActive || msg.Offset < 0 || msg.Offset > t.Size {
+			m.transfersMu.Unlock()
+			return
+		}
+		t.State = TransferActive
+		t.progressLocked(msg.Offset)
+		t.stop = make(chan struct{})
+		go m.sendChunks(t, msg.Offset, t.stop)
+
+	case msg.Type == fileReject:
+		t.finishLocked(TransferRejected, "")
+
+	case msg.Type == fileComplete:
+		t.progressLocked(t.Size)
+		t.finishLocked(TransferCompleted, "")
+
+	case msg.Type == fileFailed:
+		t.finishLocked(TransferFailed, msg.Reason)
+
+	default:
+		m.transfersMu.Unlock()
+		log.Printf("Unknown file message type from %s: %s", peerID, msg.Type)
+		return
+	}
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+	m.reportTransfer(snapshot)
+}
+
+// handleFileOffer asks about a new offer, or resumes one that was accepted
+// before the connection dropped.
+func (m *Manager) handleFileOffer(peerID string, msg fileMessage) {
+	if err := validateOffer(msg); err != nil {
+		log.Printf("Rejecting file offer from %s: %v", peerID, err)
+		m.sendFileControlTo(peerID, fileMessage{Type: fileReject, ID: msg.ID})
+		return
+	}
+
+	m.transfersMu.Lock()
+	t, exists := m.transfers[msg.ID]
+	if !exists {
+		if m.onFileOffer == nil {
+			m.transfersMu.Unlock()
+			m.sendFileControlTo(peerID, fileMessage{Type: fileReject, ID: msg.ID})
+			return
+		}
+		t = &transfer{Transfer: Transfer{
+			ID:     msg.ID,
+			PeerID: peerID,
+			Name:   msg.Name,
+			Size:   msg.Size,
+			SHA256: msg.SHA256,
+			State:  TransferOffered,
+		}}
+		m.transfers[t.ID] = t
+		snapshot := t.Transfer
+		m.transfersMu.Unlock()
+
+		log.Printf("%s offered %s (%d bytes)", peerID, msg.Name, msg.Size)
+		m.reportTransfer(snapshot)
+		m.onFileOffer(snapshot)
+		return
+	}
+	if t.Outgoing || t.PeerID != peerID {
+		m.transfersMu.Unlock()
+		return
+	}
+
+	switch t.State {
+	case TransferActive, TransferInterrupted:
+		if t.State == TransferActive && t.file == nil {
+			// Everything arrived and is being verified.
+			m.transfersMu.Unlock()
+			return
+		}
+		if t.file == nil {
+			// A changed file cannot continue from the old one.
+			changed := t.Size != msg.Size || t.SHA256 != msg.SHA256
+			t.Size, t.SHA256 = msg.Size, msg.SHA256
+			if err := t.openPartLocked(changed); err != nil {
+				t.finishLocked(TransferFailed, err.Error())
+				snapshot := t.Transfer
+				m.transfersMu.Unlock()
+				m.reportTransfer(snapshot)
+				m.sendFileControlTo(peerID, fileMessage{Type: fileFailed, ID: t.ID, Reason: "receiver could not write the file"})
+				return
+			}
+		}
+		t.State = TransferActive
+		snapshot := t.Transfer
+		m.transfersMu.Unlock()
+
+		log.Printf("Resuming %s from %s at %d bytes", t.Name, peerID, snapshot.Transferred)
+		m.reportTransfer(snapshot)
+		m.answerOffer(snapshot)
+
+	case TransferCompleted:
+		// Our confirmation was lost with the connection.
+		m.transfersMu.Unlock()
+		m.sendFileControlTo(peerID, fileMessage{Type: fileComplete, ID: t.ID})
+
+	case TransferFailed:
+		reason := t.Error
+		m.transfersMu.Unlock()
+		m.sendFileControlTo(peerID, fileMessage{Type: fileFailed, ID: t.ID, Reason: reason})
+
+	case TransferRejected:
+		m.transfersMu.Unlock()
+		m.sendFileControlTo(peerID, fileMessage{Type: fileReject, ID: t.ID})
+
+	case TransferCanceled:
+		m.transfersMu.Unlock()
+		m.sendFileControlTo(peerID, fileMessage{Type: fileCancel, ID: t.ID})
+
+	default:
+		// Still waiting for the user to answer the first offer.
+		m.transfersMu.Unlock()
+	}
+}
+
+func validateOffer(msg fileMessage) error {
+	if _, err := uuid.Parse(msg.ID); err != nil {
+		return fmt.Errorf("invalid transfer ID %q", msg.ID)
+	}
+	if msg.Name == "" || msg.Name == "." || msg.Name == ".." || strings.ContainsAny(msg.Name, `/\`) {
+		return fmt.Errorf("invalid file name %q", msg.Name)
+	}
+	if msg.Size < 0 {
+		return fmt.Errorf("invalid file size %d", msg.Size)
+	}
+	if sum, err := hex.DecodeString(msg.SHA256); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("invalid checksum %q", msg.SHA256)
+	}
+	return nil
+}
+
+// sendChunks streams t from offset until it is done or stop is closed,
+// pausing whenever the channel's queue is full.
+func (m *Manager) sendChunks(t *transfer, offset int64, stop chan struct{}) {
+	m.mu.RLock()
+	peer, exists := m.peers[t.PeerID]
+	m.mu.RUnlock()
+	if !exists {
+		m.interruptSend(t, stop, "peer is gone")
+		return
+	}
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		m.failSend(t, stop, fmt.Sprintf("failed to open file: %v", err))
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		m.failSend(t, stop, fmt.Sprintf("failed to seek file: %v", err))
+		return
+	}
+
+	id := uuid.MustParse(t.ID)
+	buf := make([]byte, chunkHeaderSize+fileChunkSize)
+	copy(buf, id[:])
+
+	for offset < t.Size {
+		n := int(min(fileChunkSize, t.Size-offset))
+		if _, err := io.ReadFull(file, buf[chunkHeaderSize:chunkHeaderSize+n]); err != nil {
+			m.failSend(t, stop, fmt.Sprintf("failed to read file: %v", err))
+			return
+		}
+		binary.BigEndian.PutUint64(buf[16:chunkHeaderSize], uint64(offset))
+
+		if err := peer.SendFileChunk(buf[:chunkHeaderSize+n], stop); err != nil {
+			if !errors.Is(err, errTransferStopped) {
+				m.interruptSend(t, stop, err.Error())
+			}
+			return
+		}
+		offset += int64(n)
+
+		m.transfersMu.Lock()
+		if t.stop != stop {
+			m.transfersMu.Unlock()
+			return
+		}
+		report := t.progressLocked(offset)
+		snapshot := t.Transfer
+		m.transfersMu.Unlock()
+		if report {
+			m.reportTransfer(snapshot)
+		}
+	}
+	// The receiver answers complete or failed once it has checked the file.
+}
+
+// interruptSend marks a send that lost its channel, to be offered again
+// when the peer's connection is back.
+func (m *Manager) interruptSend(t *transfer, stop chan struct{}, reason string) {
+	m.transfersMu.Lock()
+	if t.stop != stop {
+		m.transfersMu.Unlock()
+		return
+	}
+	t.stopLocked()
+	t.State = TransferInterrupted
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	log.Printf("Interrupted sending %s to %s: %s", t.Name, t.PeerID, reason)
+	m.reportTransfer(snapshot)
+}
+
+func (m *Manager) failSend(t *transfer, stop chan struct{}, reason string) {
+	m.transfersMu.Lock()
+	if t.stop != stop {
+		m.transfersMu.Unlock()
+		return
+	}
+	t.finishLocked(TransferFailed, reason)
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	log.Printf("Failed to send %s to %s: %s", t.Name, t.PeerID, reason)
+	m.reportTransfer(snapshot)
+	m.sendFileControlTo(t.PeerID, fileMessage{Type: fileFailed, ID: t.ID, Reason: "sender could not read the file"})
+}
+
+func (m *Manager) receiveChunk(peerID string, data []byte) {
+	if len(data) < chunkHeaderSize {
+		log.Printf("Dropping short file chunk from %s", peerID)
+		return
+	}
+	id, err := uuid.FromBytes(data[:16])
+	if err != nil {
+		return
+	}
+	offset := int64(binary.BigEndian.Uint64(data[16:chunkHeaderSize]))
+	chunk := data[chunkHeaderSize:]
+
+	m.transfersMu.Lock()
+	t, exists := m.transfers[id.String()]
+	// Chunks still in flight when a transfer ended are dropped.
+	if !exists || t.Outgoing || t.PeerID != peerID || t.State != TransferActive || t.file == nil {
+		m.transfersMu.Unlock()
+		return
+	}
+
+	var reason string
+	if offset != t.Transferred || offset+int64(len(chunk)) > t.Size {
+		reason = fmt.Sprintf("unexpected chunk at %d bytes", offset)
+	} else if _, err := t.file.Write(chunk); err != nil {
+		log.Printf("Failed to write %s: %v", t.partPath(), err)
+		reason = "receiver could not write the file"
+	}
+	if reason != "" {
+		t.finishLocked(TransferFailed, reason)
+		snapshot := t.Transfer
+		m.transfersMu.Unlock()
+		m.reportTransfer(snapshot)
+		m.sendFileControlTo(peerID, fileMessage{Type: fileFailed, ID: t.ID, Reason: reason})
+		return
+	}
+
+	report := t.progressLocked(offset + int64(len(chunk)))
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	if report {
+		m.reportTransfer(snapshot)
+	}
+	if snapshot.Transferred == snapshot.Size {
+		m.finishReceive(snapshot.ID)
+	}
+}
+
+// finishReceive checks a fully received file against the sender's
+// checksum, keeping it only if they match.
+func (m *Manager) finishReceive(transferID string) {
+	m.transfersMu.Lock()
+	t, exists := m.transfers[transferID]
+	if !exists || t.State != TransferActive || t.file == nil || t.Transferred != t.Size {
+		m.transfersMu.Unlock()
+		return
+	}
+	err := t.file.Close()
+	t.file = nil
+	m.transfersMu.Unlock()
+
+	var sum string
+	if err == nil {
+		sum, err = fileSHA256(t.partPath())
+	}
+
+	m.transfersMu.Lock()
+	if t.State != TransferActive {
+		// Canceled while verifying.
+		m.transfersMu.Unlock()
+		return
+	}
+	var reason string
+	switch {
+	case err != nil:
+		log.Printf("Failed to verify %s: %v", t.partPath(), err)
+		reason = "receiver could not read the file back"
+	case sum != t.SHA256:
+		reason = "checksum mismatch"
+	default:
+		if err := os.Rename(t.partPath(), t.path); err != nil {
+			log.Printf("Failed to save %s: %v", t.path, err)
+			reason = "receiver could not save the file"
+		}
+	}
+
+	reply := fileMessage{Type: fileComplete, ID: t.ID}
+	if reason != "" {
+		t.finishLocked(TransferFailed, reason)
+		reply = fileMessage{Type: fileFailed, ID: t.ID, Reason: reason}
+	} else {
+		t.finishLocked(TransferCompleted, "")
+	}
+	snapshot := t.Transfer
+	m.transfersMu.Unlock()
+
+	if reason == "" {
+		log.Printf("Received %s from %s", t.Name, t.PeerID)
+	} else {
+		log.Printf("Failed to receive %s from %s: %s", t.Name, t.PeerID, reason)
+	}
+	m.reportTransfer(snapshot)
+	m.sendFileControlTo(snapshot.PeerID, reply)
+}
+
+// interruptTransfers pauses the running transfers with peerID after its
+// connection closed, returning them to report.
+func (m *Manager) interruptTransfers(peerID string) []Transfer {
+	m.transfersMu.Lock()
+	defer m.transfersMu.Unlock()
+
+	var interrupted []Transfer
+	for _, t := range m.transfers {
+		if t.PeerID != peerID || t.State != TransferActive {
+			continue
+		}
+		t.stopLocked()
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+		t.State = TransferInterrupted
+		interrupted = append(interrupted, t.Transfer)
+	}
+	return interrupted
+}
+
+// resumeTransfers offers peerID every file it has not received yet, once
+// a new file channel to it opens.
+func (m *Manager) resumeTransfers(peerID string) {
+	m.transfersMu.Lock()
+	var offers []fileMessage
+	for _, t := range m.transfers {
+		if t.Outgoing && t.PeerID == peerID && (t.State == TransferOffered || t.State == TransferInterrupted) {
+			offers = append(offers, offerMessage(t.Transfer))
+		}
+	}
+	m.transfersMu.Unlock()
+
+	for _, offer := range offers {
+		m.sendFileControlTo(peerID, offer)
+	}
+}
+
+// cancelTransfers ends every running transfer when leaving the call.
+func (m *Manager) cancelTransfers() {
+	m.transfersMu.Lock()
+	var canceled []Transfer
+	for _, t := range m.transfers {
+		if !t.State.Done() {
+			t.finishLocked(TransferCanceled, "")
+			canceled = append(canceled, t.Transfer)
+		}
+	}
+	m.transfersMu.Unlock()
+
+	for _, snapshot := range canceled {
+		m.sendFileControlTo(snapshot.PeerID, fileMessage{Type: fileCancel, ID: snapshot.ID})
+		m.reportTransfer(snapshot)
+	}
+}
+
+func offerMessage(t Transfer) fileMessage {
+	return fileMessage{Type: fileOffer, ID: t.ID, Name: t.Name, Size: t.Size, SHA256: t.SHA256}
+}
+
+// sendFileControlTo sends a control message if peerID's file channel is
+// open. Anything lost is repaired by the offer that follows a reconnect.
+func (m *Manager) sendFileControlTo(peerID string, msg fileMessage) {
+	m.mu.RLock()
+	peer, exists := m.peers[peerID]
+	m.mu.RUnlock()
+	if !exists {
+		return
+	}
+	if err := m.sendFileControl(peer, msg); err != nil {
+		log.Printf("Failed to send file %s to %s: %v", msg.Type, peerID, err)
+	}
+}
+
+func (m *Manager) sendFileControl(peer *PeerConnection, msg fileMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file message: %w", err)
+	}
+	return peer.SendFileControl(data)
+}
+
+// reportTransfer tells the application about t. Every state change goes
+// through here, so it is also where finished transfers are let go of.
+func (m *Manager) reportTransfer(t Transfer) {
+	if t.State.Done() {
+		m.forgetTransfer(t.ID)
+	}
+	if m.onTransfer != nil {
+		m.onTransfer(t)
+	}
+}
+
+// forgetTransfer drops a finished transfer after finishedTransferTTL.
+func (m *Manager) forgetTransfer(transferID string) {
+	time.AfterFunc(m.transferTTL, func() {
+		m.transfersMu.Lock()
+		defer m.transfersMu.Unlock()
+		if t, exists := m.transfers[transferID]; exists && t.State.Done() {
+			delete(m.transfers, transferID)
+		}
+	})
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,294 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidateOffer(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	valid := fileMessage{Type: fileOffer, ID: uuid.NewString(), Name: "report.pdf", Size: 4, SHA256: hex.EncodeToString(sum[:])}
+
+	tests := []struct {
+		name    string
+		change  func(msg *fileMessage)
+		wantErr bool
+	}{
+		{"valid", func(msg *fileMessage) {}, false},
+		{"dotted name", func(msg *fileMessage) { msg.Name = "..hidden" }, false},
+		{"empty file", func(msg *fileMessage) { msg.Size = 0 }, false},
+		{"empty name", func(msg *fileMessage) { msg.Name = "" }, true},
+		{"dot", func(msg *fileMessage) { msg.Name = "." }, true},
+		{"dot dot", func(msg *fileMessage) { msg.Name = ".." }, true},
+		{"parent path", func(msg *fileMessage) { msg.Name = "../report.pdf" }, true},
+		{"absolute path", func(msg *fileMessage) { msg.Name = "/etc/passwd" }, true},
+		{"subdirectory", func(msg *fileMessage) { msg.Name = "docs/report.pdf" }, true},
+		{"backslash", func(msg *fileMessage) { msg.Name = `..\report.pdf` }, true},
+		{"invalid ID", func(msg *fileMessage) { msg.ID = "not-a-uuid" }, true},
+		{"negative size", func(msg *fileMessage) { msg.Size = -1 }, true},
+		{"short checksum", func(msg *fileMessage) { msg.SHA256 = "abcd" }, true},
+		{"checksum not hex", func(msg *fileMessage) { msg.SHA256 = "z" + msg.SHA256[1:] }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := valid
+			tt.change(&msg)
+			if err := validateOffer(msg); (err != nil) != tt.wantErr {
+				t.Fatalf("validateOffer(%+v) error = %v, want error %v", msg, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+const testSender = "sender"
+
+// receiver is a Manager with no peers, so control messages it answers with
+// go nowhere, recording every transfer it reports.
+type receiver struct {
+	*Manager
+	mu      sync.Mutex
+	reports []Transfer
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	r := &receiver{}
+	r.Manager = &Manager{
+		peers:       make(map[string]*PeerConnection),
+		transfers:   make(map[string]*transfer),
+		transferTTL: time.Hour,
+		onFileOffer: func(Transfer) {},
+		onTransfer: func(transfer Transfer) {
+			r.mu.Lock()
+			r.reports = append(r.reports, transfer)
+			r.mu.Unlock()
+		},
+	}
+	return r
+}
+
+func (r *receiver) last() Transfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reports[len(r.reports)-1]
+}
+
+// offer has the sender offer data under id as name.
+func (r *receiver) offer(t *testing.T, id, name string, data []byte) {
+	t.Helper()
+
+	sum := sha256.Sum256(data)
+	msg, err := json.Marshal(fileMessage{Type: fileOffer, ID: id, Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.handleFileMessage(testSender, msg, false)
+}
+
+// chunk has the sender send data at offset of transfer id.
+func (r *receiver) chunk(id string, offset int64, data []byte) {
+	chunk := make([]byte, chunkHeaderSize+len(data))
+	transferID := uuid.MustParse(id)
+	copy(chunk, transferID[:])
+	binary.BigEndian.PutUint64(chunk[16:chunkHeaderSize], uint64(offset))
+	copy(chunk[chunkHeaderSize:], data)
+	r.handleFileMessage(testSender, chunk, true)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func TestReceiveFile(t *testing.T) {
+	r := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "report.txt")
+	data := []byte("hello, file transfer")
+
+	// A stale partial download is discarded when a new offer is accepted.
+	if err := os.WriteFile(path+".part", []byte("stale bytes from before"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.NewString()
+	r.offer(t, id, "report.txt", data)
+	if err := r.AcceptFile(id, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.last().Transferred; got != 0 {
+		t.Fatalf("accepted new offer at %d bytes, want 0", got)
+	}
+	r.chunk(id, 0, data[:5])
+	r.chunk(id, 5, data[5:])
+
+	if got := r.last(); got.State != TransferCompleted || got.Transferred != int64(len(data)) {
+		t.Fatalf("transfer = %+v, want completed", got)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != string(data) {
+		t.Fatalf("saved %q, want %q", saved, data)
+	}
+	if fileExists(path + ".part") {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestReceiveChecksumMismatch(t *testing.T) {
+	r := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "report.txt")
+
+	id := uuid.NewString()
+	r.offer(t, id, "report.txt", []byte("offered contents"))
+	if err := r.AcceptFile(id, path); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(id, 0, []byte("altered contents"))
+
+	if got := r.last(); got.State != TransferFailed || got.Error != "checksum mismatch" {
+		t.Fatalf("transfer = %+v, want failed with a checksum mismatch", got)
+	}
+	if fileExists(path) || fileExists(path+".part") {
+		t.Fatal("kept a file that failed its checksum")
+	}
+}
+
+func TestReceiveUnexpectedOffset(t *testing.T) {
+	r := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "report.txt")
+	data := []byte("0123456789")
+
+	id := uuid.NewString()
+	r.offer(t, id, "report.txt", data)
+	if err := r.AcceptFile(id, path); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(id, 5, data[5:])
+
+	if got := r.last(); got.State != TransferFailed {
+		t.Fatalf("transfer = %+v, want failed", got)
+	}
+	if fileExists(path + ".part") {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestReceiveResumes(t *testing.T) {
+	r := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "report.txt")
+	data := []byte("0123456789")
+
+	id := uuid.NewString()
+	r.offer(t, id, "report.txt", data)
+	if err := r.AcceptFile(id, path); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(id, 0, data[:4])
+
+	// The connection drops, and the sender offers the file again once it is
+	// back. The receiver asks for the rest from where it got to.
+	if interrupted := r.interruptTransfers(testSender); len(interrupted) != 1 || interrupted[0].State != TransferInterrupted {
+		t.Fatalf("interrupted %+v, want the transfer", interrupted)
+	}
+	r.offer(t, id, "report.txt", data)
+	if got := r.last(); got.State != TransferActive || got.Transferred != 4 {
+		t.Fatalf("resumed transfer = %+v, want active at 4 bytes", got)
+	}
+	r.chunk(id, 4, data[4:])
+
+	if got := r.last(); got.State != TransferCompleted {
+		t.Fatalf("transfer = %+v, want completed", got)
+	}
+	if saved, err := os.ReadFile(path); err != nil || string(saved) != string(data) {
+		t.Fatalf("saved %q (%v), want %q", saved, err, data)
+	}
+}
+
+func TestReceiveRestartsChangedFile(t *testing.T) {
+	r := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "report.txt")
+
+	id := uuid.NewString()
+	r.offer(t, id, "report.txt", []byte("first version"))
+	if err := r.AcceptFile(id, path); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(id, 0, []byte("first"))
+	r.interruptTransfers(testSender)
+
+	// The file changed while the connection was down, so what arrived of
+	// the old one is thrown away.
+	data := []byte("second version")
+	r.offer(t, id, "report.txt", data)
+	if got := r.last(); got.State != TransferActive || got.Transferred != 0 {
+		t.Fatalf("changed offer = %+v, want active from the start", got)
+	}
+	r.chunk(id, 0, data)
+
+	if got := r.last(); got.State != TransferCompleted {
+		t.Fatalf("transfer = %+v, want completed", got)
+	}
+	if saved, err := os.ReadFile(path); err != nil || string(saved) != string(data) {
+		t.Fatalf("saved %q (%v), want %q", saved, err, data)
+	}
+}
+
+func TestFinishedTransfersAreForgotten(t *testing.T) {
+	r := newReceiver(t)
+	r.transferTTL = 10 * time.Millisecond
+	dir := t.TempDir()
+	data := []byte("data")
+
+	completed, failed, rejected := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	r.offer(t, completed, "completed.txt", data)
+	if err := r.AcceptFile(completed, filepath.Join(dir, "completed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(completed, 0, data)
+	r.offer(t, failed, "failed.txt", data)
+	if err := r.AcceptFile(failed, filepath.Join(dir, "failed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	r.chunk(failed, 1, data[1:])
+	r.offer(t, rejected, "rejected.txt", data)
+	if err := r.RejectFile(rejected); err != nil {
+		t.Fatal(err)
+	}
+	pending := uuid.NewString()
+	r.offer(t, pending, "pending.txt", data)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.transfersMu.Lock()
+		_, hasCompleted := r.transfers[completed]
+		_, hasFailed := r.transfers[failed]
+		_, hasRejected := r.transfers[rejected]
+		_, hasPending := r.transfers[pending]
+		r.transfersMu.Unlock()
+
+		if !hasPending {
+			t.Fatal("forgot a transfer that is still waiting for an answer")
+		}
+		if !hasCompleted && !hasFailed && !hasRejected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("finished transfers were not forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -4,22 +4,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/javanhut/zero/playback"
 	"github.com/javanhut/zero/signaling"
 	"github.com/pion/webrtc/v4"
 )
 
 type RemoteTrackHandler func(peerID string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
 
+// ChatHandler receives chat messages that travel over data channels,
+// including the local copy of one this peer sent.
+type ChatHandler func(chat signaling.ChatPayload)
+
 type Manager struct {
-	peers            map[string]*PeerConnection
-	config           *Config
-	signaling        *signaling.Client
-	localTracks      []*webrtc.TrackLocalStaticSample
-	onRemoteTrack    RemoteTrackHandler
-	onPeerDisconnect func(peerID string)
-	mu               sync.RWMutex
+	peers             map[string]*PeerConnection
+	peerNames         map[string]string
+	pendingCandidates map[string][]webrtc.ICECandidateInit
+	candidateStats    candidateCounters
+	config            *Config
+	signaling         *signaling.Client
+	localTracks       []*webrtc.TrackLocalStaticSample
+	onRemoteTrack     RemoteTrackHandler
+	onPeerDisconnect  func(peerID string)
+	onChat            ChatHandler
+	onFileOffer       TransferHandler
+	onTransfer        TransferHandler
+	transfers         map[string]*transfer
+	transfersMu       sync.Mutex
+	transferTTL       time.Duration
+	audioMixer        *playback.Mixer
+	mu                sync.RWMutex
 }
 
 type ManagerConfig struct {
@@ -27,16 +45,35 @@ type ManagerConfig struct {
 	SignalingClient  *signaling.Client
 	OnRemoteTrack    RemoteTrackHandler
 	OnPeerDisconnect func(peerID string)
+	// OnChat receives chat messages sent over data channels, direct and
+	// room-wide. The ones relayed by the signaling server arrive as chat
+	// messages there.
+	OnChat ChatHandler
+	// OnFileOffer is called when a peer offers a file. Answer it with
+	// AcceptFile or RejectFile; without a handler every offer is rejected.
+	OnFileOffer TransferHandler
+	// OnTransfer reports the progress and state changes of every file
+	// transfer, in both directions.
+	OnTransfer TransferHandler
+	AudioMixer *playback.Mixer
 }
 
 func NewManager(config ManagerConfig) *Manager {
 	m := &Manager{
-		peers:            make(map[string]*PeerConnection),
-		config:           config.WebRTCConfig,
-		signaling:        config.SignalingClient,
-		localTracks:      make([]*webrtc.TrackLocalStaticSample, 0),
-		onRemoteTrack:    config.OnRemoteTrack,
-		onPeerDisconnect: config.OnPeerDisconnect,
+		peers:             make(map[string]*PeerConnection),
+		peerNames:         make(map[string]string),
+		pendingCandidates: make(map[string][]webrtc.ICECandidateInit),
+		config:            config.WebRTCConfig,
+		signaling:         config.SignalingClient,
+		localTracks:       make([]*webrtc.TrackLocalStaticSample, 0),
+		onRemoteTrack:     config.OnRemoteTrack,
+		onPeerDisconnect:  config.OnPeerDisconnect,
+		onChat:            config.OnChat,
+		onFileOffer:       config.OnFileOffer,
+		onTransfer:        config.OnTransfer,
+		transfers:         make(map[string]*transfer),
+		transferTTL:       finishedTransferTTL,
+		audioMixer:        config.AudioMixer,
 	}
 
 	m.setupSignalingHandlers()
@@ -44,11 +81,39 @@ func NewManager(config ManagerConfig) *Manager {
 }
 
 func (m *Manager) setupSignalingHandlers() {
+	m.signaling.On(signaling.MessageTypeJoined, m.handleJoined)
 	m.signaling.On(signaling.MessageTypePeerJoined, m.handlePeerJoined)
 	m.signaling.On(signaling.MessageTypePeerLeft, m.handlePeerLeft)
 	m.signaling.On(signaling.MessageTypeOffer, m.handleOffer)
 	m.signaling.On(signaling.MessageTypeAnswer, m.handleAnswer)
 	m.signaling.On(signaling.MessageTypeCandidate, m.handleCandidate)
+	m.signaling.On(signaling.MessageTypeProfileUpdate, m.handleProfileUpdate)
+}
+
+// handleJoined drops every existing peer connection when a rejoin could not
+// resume the previous membership. The server has told the other peers that
+// we left, and they will connect again as if we were new.
+func (m *Manager) handleJoined(msg *signaling.SignalingMessage) {
+	var payload signaling.JoinedPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		log.Printf("Failed to unmarshal joined payload: %v", err)
+		return
+	}
+
+	if payload.Resumed {
+		return
+	}
+
+	m.mu.RLock()
+	peerIDs := make([]string, 0, len(m.peers))
+	for peerID := range m.peers {
+		peerIDs = append(peerIDs, peerID)
+	}
+	m.mu.RUnlock()
+
+	for _, peerID := range peerIDs {
+		m.removePeer(peerID)
+	}
 }
 
 func (m *Manager) handlePeerJoined(msg *signaling.SignalingMessage) {
@@ -63,15 +128,26 @@ func (m *Manager) handlePeerJoined(msg *signaling.SignalingMessage) {
 	}
 
 	log.Printf("Peer joined: %s (%s)", payload.Username, payload.PeerID)
+	m.setPeerUsername(payload.PeerID, payload.Username)
 
+	// The new connection's chat channel and local tracks fire
+	// OnNegotiationNeeded, which sends the offer.
 	if err := m.createPeerConnection(payload.PeerID); err != nil {
 		log.Printf("Failed to create peer connection: %v", err)
+	}
+}
+
+func (m *Manager) handleProfileUpdate(msg *signaling.SignalingMessage) {
+	var payload signaling.ProfileUpdatePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		log.Printf("Failed to unmarshal profile update payload: %v", err)
 		return
 	}
 
-	if err := m.sendOffer(payload.PeerID); err != nil {
-		log.Printf("Failed to send offer: %v", err)
+	if payload.PeerID == m.signaling.GetPeerID() {
+		return
 	}
+	m.setPeerUsername(payload.PeerID, payload.Profile.DisplayName)
 }
 
 func (m *Manager) handlePeerLeft(msg *signaling.SignalingMessage) {
@@ -86,6 +162,10 @@ func (m *Manager) handlePeerLeft(msg *signaling.SignalingMessage) {
 }
 
 func (m *Manager) handleOffer(msg *signaling.SignalingMessage) {
+	if !m.isAddressedToUs(msg) {
+		return
+	}
+
 	var payload signaling.OfferPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		log.Printf("Failed to unmarshal offer payload: %v", err)
@@ -93,6 +173,7 @@ func (m *Manager) handleOffer(msg *signaling.SignalingMessage) {
 	}
 
 	log.Printf("Received offer from peer: %s", msg.PeerID)
+	m.setPeerUsername(msg.PeerID, msg.Username)
 
 	m.mu.RLock()
 	peer, exists := m.peers[msg.PeerID]
@@ -108,17 +189,14 @@ func (m *Manager) handleOffer(msg *signaling.SignalingMessage) {
 		m.mu.RUnlock()
 	}
 
-	if err := peer.SetRemoteDescription(payload.SDP); err != nil {
-		log.Printf("Failed to set remote description: %v", err)
-		return
-	}
-
-	if err := m.sendAnswer(msg.PeerID); err != nil {
-		log.Printf("Failed to send answer: %v", err)
-	}
+	m.handleRemoteDescription(peer, payload.SDP)
 }
 
 func (m *Manager) handleAnswer(msg *signaling.SignalingMessage) {
+	if !m.isAddressedToUs(msg) {
+		return
+	}
+
 	var payload signaling.AnswerPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		log.Printf("Failed to unmarshal answer payload: %v", err)
@@ -136,32 +214,81 @@ func (m *Manager) handleAnswer(msg *signaling.SignalingMessage) {
 		return
 	}
 
-	if err := peer.SetRemoteDescription(payload.SDP); err != nil {
-		log.Printf("Failed to set remote description: %v", err)
+	m.handleRemoteDescription(peer, payload.SDP)
+}
+
+func (m *Manager) handleRemoteDescription(peer *PeerConnection, sdp webrtc.SessionDescription) {
+	answer, err := peer.HandleRemoteDescription(sdp)
+	if err != nil {
+		log.Printf("Failed to handle %s from peer %s: %v", sdp.Type, peer.GetPeerID(), err)
+		return
+	}
+
+	if answer == nil {
+		return
+	}
+
+	if err := m.signaling.SendAnswerTo(peer.GetPeerID(), *answer); err != nil {
+		log.Printf("Failed to send answer: %v", err)
 	}
 }
 
 func (m *Manager) handleCandidate(msg *signaling.SignalingMessage) {
+	if !m.isAddressedToUs(msg) {
+		return
+	}
+
 	var payload signaling.CandidatePayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		log.Printf("Failed to unmarshal candidate payload: %v", err)
 		return
 	}
 
-	m.mu.RLock()
+	// Checking for the peer and buffering happen under one lock so the
+	// candidate cannot slip in while createPeerConnection drains the buffer.
+	m.mu.Lock()
 	peer, exists := m.peers[msg.PeerID]
-	m.mu.RUnlock()
-
 	if !exists {
-		log.Printf("Received candidate for unknown peer: %s", msg.PeerID)
+		m.bufferCandidate(msg.PeerID, payload.Candidate)
+		m.mu.Unlock()
 		return
 	}
+	m.mu.Unlock()
 
 	if err := peer.AddICECandidate(payload.Candidate); err != nil {
 		log.Printf("Failed to add ICE candidate: %v", err)
 	}
 }
 
+func (m *Manager) isAddressedToUs(msg *signaling.SignalingMessage) bool {
+	return msg.TargetPeerID == "" || msg.TargetPeerID == m.signaling.GetPeerID()
+}
+
+// isPolite decides the perfect negotiation role for the connection to
+// peerID. Both sides compare the same two IDs, so exactly one of them ends up
+// polite.
+func (m *Manager) isPolite(peerID string) bool {
+	return m.signaling.GetPeerID() < peerID
+}
+
+// bufferCandidate must be called with m.mu held.
+func (m *Manager) bufferCandidate(peerID string, candidate webrtc.ICECandidateInit) {
+	pending := m.pendingCandidates[peerID]
+	if len(pending) >= maxPendingCandidates {
+		m.candidateStats.dropped.Add(1)
+		log.Printf("Dropping ICE candidate for unknown peer %s: pending queue full", peerID)
+		return
+	}
+
+	m.pendingCandidates[peerID] = append(pending, candidate)
+	m.candidateStats.buffered.Add(1)
+	log.Printf("Buffered ICE candidate for not yet connected peer: %s", peerID)
+}
+
+func (m *Manager) GetCandidateStats() CandidateStats {
+	return m.candidateStats.snapshot()
+}
+
 func (m *Manager) createPeerConnection(peerID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -171,10 +298,18 @@ func (m *Manager) createPeerConnection(peerID string) error {
 	}
 
 	peer, err := NewPeerConnection(PeerConnectionConfig{
-		PeerID:    peerID,
-		SessionID: m.signaling.GetSessionID(),
-		Config:    m.config.ToWebRTCConfig(),
+		PeerID:            peerID,
+		SessionID:         m.signaling.GetSessionID(),
+		Config:            m.config.ToWebRTCConfig(),
+		Polite:            m.isPolite(peerID),
+		PendingCandidates: m.pendingCandidates[peerID],
+		CandidateStats:    &m.candidateStats,
 		OnTrack: func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			if track.Kind() == webrtc.RTPCodecTypeAudio && m.audioMixer != nil {
+				if err := m.audioMixer.AddTrack(peerID, track); err != nil {
+					log.Printf("Failed to play audio from peer %s: %v", peerID, err)
+				}
+			}
 			if m.onRemoteTrack != nil {
 				m.onRemoteTrack(peerID, track, receiver)
 			}
@@ -185,12 +320,26 @@ func (m *Manager) createPeerConnection(peerID string) error {
 				m.onPeerDisconnect(pid)
 			}
 		},
+		OnNegotiationNeeded: func() {
+			if err := m.sendOffer(peerID); err != nil {
+				log.Printf("Failed to send renegotiation offer to %s: %v", peerID, err)
+			}
+		},
+		OnChat: func(data []byte) {
+			m.handleChat(peerID, data)
+		},
+		OnFileMessage: func(data []byte, binary bool) {
+			m.handleFileMessage(peerID, data, binary)
+		},
+		OnFilesOpen: func() {
+			go m.resumeTransfers(peerID)
+		},
 		OnICE: func(candidate *webrtc.ICECandidate) {
 			if candidate == nil {
 				return
 			}
 			init := candidate.ToJSON()
-			if err := m.signaling.SendCandidate(init); err != nil {
+			if err := m.signaling.SendCandidateTo(peerID, init); err != nil {
 				log.Printf("Failed to send ICE candidate: %v", err)
 			}
 		},
@@ -207,6 +356,7 @@ func (m *Manager) createPeerConnection(peerID string) error {
 	}
 
 	m.peers[peerID] = peer
+	delete(m.pendingCandidates, peerID)
 	log.Printf("Created peer connection for: %s", peerID)
 	return nil
 }
@@ -225,29 +375,62 @@ func (m *Manager) sendOffer(peerID string) error {
 		return err
 	}
 
-	return m.signaling.SendOffer(offer)
+	return m.signaling.SendOfferTo(peerID, offer)
 }
 
-func (m *Manager) sendAnswer(peerID string) error {
-	m.mu.RLock()
-	peer, exists := m.peers[peerID]
-	m.mu.RUnlock()
+func (m *Manager) AddLocalTrack(track *webrtc.TrackLocalStaticSample) error {
+	m.mu.Lock()
+	m.localTracks = append(m.localTracks, track)
+	peers := make([]*PeerConnection, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	m.mu.Unlock()
 
-	if !exists {
-		return fmt.Errorf("peer not found: %s", peerID)
+	for _, peer := range peers {
+		if err := peer.AddTrack(track); err != nil {
+			log.Printf("Failed to add track to peer %s: %v", peer.GetPeerID(), err)
+		}
 	}
 
-	answer, err := peer.CreateAnswer()
-	if err != nil {
-		return err
+	log.Printf("Added local track: %s", track.ID())
+	return nil
+}
+
+func (m *Manager) RemoveLocalTrack(track *webrtc.TrackLocalStaticSample) error {
+	m.mu.Lock()
+	m.localTracks = removeTrack(m.localTracks, track)
+	peers := make([]*PeerConnection, 0, len(m.peers))
+	for _, peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	m.mu.Unlock()
+
+	for _, peer := range peers {
+		if err := peer.RemoveTrack(track); err != nil {
+			log.Printf("Failed to remove track from peer %s: %v", peer.GetPeerID(), err)
+		}
 	}
 
-	return m.signaling.SendAnswer(answer)
+	log.Printf("Removed local track: %s", track.ID())
+	return nil
 }
 
-func (m *Manager) AddLocalTrack(track *webrtc.TrackLocalStaticSample) error {
+// ReplaceLocalTrack swaps oldTrack for newTrack on every peer, e.g. after a
+// camera or resolution change. If oldTrack is not a local track, newTrack is
+// simply added.
+func (m *Manager) ReplaceLocalTrack(oldTrack, newTrack *webrtc.TrackLocalStaticSample) error {
 	m.mu.Lock()
-	m.localTracks = append(m.localTracks, track)
+	replaced := false
+	for i, track := range m.localTracks {
+		if track == oldTrack {
+			m.localTracks[i] = newTrack
+			replaced = true
+		}
+	}
+	if !replaced {
+		m.localTracks = append(m.localTracks, newTrack)
+	}
 	peers := make([]*PeerConnection, 0, len(m.peers))
 	for _, peer := range m.peers {
 		peers = append(peers, peer)
@@ -255,12 +438,12 @@ func (m *Manager) AddLocalTrack(track *webrtc.TrackLocalStaticSample) error {
 	m.mu.Unlock()
 
 	for _, peer := range peers {
-		if err := peer.AddTrack(track); err != nil {
-			log.Printf("Failed to add track to peer %s: %v", peer.GetPeerID(), err)
+		if err := peer.ReplaceTrack(oldTrack, newTrack); err != nil {
+			log.Printf("Failed to replace track on peer %s: %v", peer.GetPeerID(), err)
 		}
 	}
 
-	log.Printf("Added local track: %s", track.ID())
+	log.Printf("Replaced local track: %s", newTrack.ID())
 	return nil
 }
 
@@ -268,16 +451,166 @@ func (m *Manager) removePeer(peerID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if pending, exists := m.pendingCandidates[peerID]; exists {
+		m.candidateStats.dropped.Add(uint64(len(pending)))
+		delete(m.pendingCandidates, peerID)
+	}
+
 	peer, exists := m.peers[peerID]
 	if !exists {
 		return
 	}
+	// Transfers continue when the peer connects again. Handlers may call
+	// back into the manager, so they hear about it on another goroutine.
+	interrupted := m.interruptTransfers(peerID)
+	go func() {
+		for _, t := range interrupted {
+			m.reportTransfer(t)
+		}
+	}()
 
 	peer.Close()
 	delete(m.peers, peerID)
+	delete(m.peerNames, peerID)
+	if m.audioMixer != nil {
+		m.audioMixer.RemovePeer(peerID)
+	}
 	log.Printf("Removed peer: %s", peerID)
 }
 
+// SendChat sends a chat message to targetPeerID, or to the whole session if
+// it is empty. Messages go straight to peers over their chat data channels
+// where those are open, stamped with their own ID and time. A room-wide
+// message is then handed to the signaling server, which relays it to the
+// peers it did not reach and keeps it for peers that join later. A direct
+// message whose channel is not open goes through the server instead.
+func (m *Manager) SendChat(targetPeerID, text string) error {
+	if err := signaling.ValidateChatText(text); err != nil {
+		return err
+	}
+
+	chat := signaling.ChatPayload{
+		ID:       uuid.NewString(),
+		From:     m.signaling.GetPeerID(),
+		Username: m.signaling.GetUsername(),
+		To:       targetPeerID,
+		Text:     text,
+		SentAt:   time.Now().UTC(),
+	}
+	data, err := json.Marshal(chat)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat: %w", err)
+	}
+
+	if targetPeerID == "" {
+		m.mu.RLock()
+		peers := make(map[string]*PeerConnection, len(m.peers))
+		maps.Copy(peers, m.peers)
+		m.mu.RUnlock()
+
+		var delivered []string
+		for peerID, peer := range peers {
+			if err := peer.SendChat(data); err != nil {
+				log.Printf("Sending chat to %s through signaling: %v", peerID, err)
+				continue
+			}
+			delivered = append(delivered, peerID)
+		}
+		if err := m.signaling.RecordChat(chat, delivered); err != nil {
+			if len(delivered) == 0 {
+				return err
+			}
+			log.Printf("Failed to hand chat to the signaling server: %v", err)
+		}
+		if m.onChat != nil {
+			m.onChat(chat)
+		}
+		return nil
+	}
+
+	m.mu.RLock()
+	peer, exists := m.peers[targetPeerID]
+	m.mu.RUnlock()
+
+	if exists {
+		err = peer.SendChat(data)
+		if err == nil {
+			if m.onChat != nil {
+				m.onChat(chat)
+			}
+			return nil
+		}
+		log.Printf("Sending chat to %s through signaling: %v", targetPeerID, err)
+	}
+
+	return m.signaling.SendChat(targetPeerID, text)
+}
+
+// handleChat delivers a chat message from peerID's data channel, addressed
+// to us or to the whole session. The sender and name are taken from the
+// connection rather than trusted from the message.
+func (m *Manager) handleChat(peerID string, data []byte) {
+	var chat signaling.ChatPayload
+	if err := json.Unmarshal(data, &chat); err != nil {
+		log.Printf("Failed to unmarshal chat from %s: %v", peerID, err)
+		return
+	}
+	if err := signaling.ValidateChatText(chat.Text); err != nil {
+		log.Printf("Dropping chat from %s: %v", peerID, err)
+		return
+	}
+
+	chat.From = peerID
+	chat.Username = m.GetPeerUsername(peerID)
+	if chat.To != "" {
+		chat.To = m.signaling.GetPeerID()
+	}
+	chat.Delivered = nil
+	if chat.ID == "" {
+		chat.ID = uuid.NewString()
+	}
+	if chat.SentAt.IsZero() {
+		chat.SentAt = time.Now().UTC()
+	}
+	if m.onChat != nil {
+		m.onChat(chat)
+	}
+}
+
+func (m *Manager) setPeerUsername(peerID, username string) {
+	if username == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerNames[peerID] = username
+}
+
+func (m *Manager) GetPeerUsername(peerID string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if username, ok := m.peerNames[peerID]; ok {
+		return username
+	}
+	return fmt.Sprintf("User_%.8s", peerID)
+}
+
+func (m *Manager) SetPeerVolume(peerID string, volume float64) error {
+	if m.audioMixer == nil {
+		return fmt.Errorf("audio playback is not enabled")
+	}
+	return m.audioMixer.SetVolume(peerID, volume)
+}
+
+func (m *Manager) SetPeerMuted(peerID string, muted bool) error {
+	if m.audioMixer == nil {
+		return fmt.Errorf("audio playback is not enabled")
+	}
+	return m.audioMixer.SetMuted(peerID, muted)
+}
+
 func (m *Manager) GetPeers() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -290,11 +623,16 @@ func (m *Manager) GetPeers() []string {
 }
 
 func (m *Manager) Close() {
+	m.cancelTransfers()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, peer := range m.peers {
+	for peerID, peer := range m.peers {
 		peer.Close()
+		if m.audioMixer != nil {
+			m.audioMixer.RemovePeer(peerID)
+		}
 	}
 	m.peers = make(map[string]*PeerConnection)
 }
@@ -1,24 +1,73 @@
 package webrtc
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
+// chatChannelID is the SCTP stream of the chat data channel. The channel is
+// negotiated, so both sides open it on this ID without announcing it.
+const chatChannelID = 0
+
+// filesChannelID is the SCTP stream of the negotiated file transfer channel.
+const filesChannelID = 1
+
+const (
+	// fileBufferedLow is where a paused file sender resumes: pion reports
+	// OnBufferedAmountLow once the channel's queue drains below it.
+	fileBufferedLow = 256 * 1024
+	// maxFileBuffered is how much a file sender may queue on the channel
+	// before it waits for the queue to drain.
+	maxFileBuffered = 1024 * 1024
+	// fileSendTimeout gives up on a channel whose queue stops draining.
+	fileSendTimeout = 30 * time.Second
+)
+
+var errFilesClosed = errors.New("file channel closed")
+
 type PeerConnection struct {
-	pc           *webrtc.PeerConnection
-	peerID       string
-	sessionID    string
-	localTracks  []*webrtc.TrackLocalStaticSample
-	remoteTracks []*webrtc.TrackRemote
-	onTrack      func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
-	onDisconnect func(string)
-	onICE        func(*webrtc.ICECandidate)
-	mu           sync.RWMutex
-	connected    bool
+	pc                  *webrtc.PeerConnection
+	peerID              string
+	sessionID           string
+	localTracks         []*webrtc.TrackLocalStaticSample
+	senders             map[*webrtc.TrackLocalStaticSample]*webrtc.RTPSender
+	remoteTracks        []*webrtc.TrackRemote
+	onTrack             func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+	onDisconnect        func(string)
+	onICE               func(*webrtc.ICECandidate)
+	onNegotiationNeeded func()
+	onChat              func([]byte)
+	chat                *webrtc.DataChannel
+	onFileMessage       func(data []byte, binary bool)
+	onFilesOpen         func()
+	files               *webrtc.DataChannel
+	filesLow            chan struct{}
+	filesMu             sync.Mutex
+	closed              chan struct{}
+	closeOnce           sync.Once
+	pendingCandidates   []webrtc.ICECandidateInit
+	candidateStats      *candidateCounters
+	mu                  sync.RWMutex
+	connected           bool
+
+	// Perfect negotiation state, see
+	// https://w3c.github.io/webrtc-pc/#perfect-negotiation-example
+	//
+	// negotiationMu serializes every offer, answer and remote description,
+	// so a local offer is always fully applied before a remote one is
+	// looked at. That makes the pattern's makingOffer flag unnecessary: a
+	// collision shows up as a have-local-offer signaling state. The lock
+	// is needed because pion cannot roll back an offer it is still making.
+	polite                       bool
+	ignoreOffer                  bool
+	isSettingRemoteAnswerPending bool
+	negotiationMu                sync.Mutex
 }
 
 type PeerConnectionConfig struct {
@@ -28,6 +77,25 @@ type PeerConnectionConfig struct {
 	OnTrack      func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
 	OnDisconnect func(string)
 	OnICE        func(*webrtc.ICECandidate)
+	Polite       bool
+
+	// OnNegotiationNeeded is called when a local change (such as adding or
+	// removing a track) requires a new offer/answer round-trip.
+	OnNegotiationNeeded func()
+
+	// OnChat receives the messages that arrive on the chat data channel.
+	OnChat func([]byte)
+
+	// OnFileMessage receives the messages that arrive on the file transfer
+	// channel: control messages as text, chunks as binary.
+	OnFileMessage func(data []byte, binary bool)
+	// OnFilesOpen is called when the file transfer channel opens.
+	OnFilesOpen func()
+
+	// PendingCandidates are candidates received before the connection
+	// existed. They are applied once a remote description is set.
+	PendingCandidates []webrtc.ICECandidateInit
+	CandidateStats    *candidateCounters
 }
 
 func NewPeerConnection(config PeerConnectionConfig) (*PeerConnection, error) {
@@ -37,15 +105,29 @@ func NewPeerConnection(config PeerConnectionConfig) (*PeerConnection, error) {
 	}
 
 	peer := &PeerConnection{
-		pc:           pc,
-		peerID:       config.PeerID,
-		sessionID:    config.SessionID,
-		localTracks:  make([]*webrtc.TrackLocalStaticSample, 0),
-		remoteTracks: make([]*webrtc.TrackRemote, 0),
-		onTrack:      config.OnTrack,
-		onDisconnect: config.OnDisconnect,
-		onICE:        config.OnICE,
-		connected:    false,
+		pc:                  pc,
+		peerID:              config.PeerID,
+		sessionID:           config.SessionID,
+		localTracks:         make([]*webrtc.TrackLocalStaticSample, 0),
+		senders:             make(map[*webrtc.TrackLocalStaticSample]*webrtc.RTPSender),
+		remoteTracks:        make([]*webrtc.TrackRemote, 0),
+		onTrack:             config.OnTrack,
+		onDisconnect:        config.OnDisconnect,
+		onICE:               config.OnICE,
+		connected:           false,
+		polite:              config.Polite,
+		onNegotiationNeeded: config.OnNegotiationNeeded,
+		onChat:              config.OnChat,
+		onFileMessage:       config.OnFileMessage,
+		onFilesOpen:         config.OnFilesOpen,
+		filesLow:            make(chan struct{}),
+		closed:              make(chan struct{}),
+		pendingCandidates:   config.PendingCandidates,
+		candidateStats:      config.CandidateStats,
+	}
+
+	if peer.candidateStats == nil {
+		peer.candidateStats = &candidateCounters{}
 	}
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -54,12 +136,27 @@ func NewPeerConnection(config PeerConnectionConfig) (*PeerConnection, error) {
 		}
 	})
 
+	pc.OnNegotiationNeeded(func() {
+		log.Printf("Negotiation needed with peer %s", peer.peerID)
+		if peer.onNegotiationNeeded != nil {
+			// pion calls this from its operations queue, which CreateOffer
+			// also needs, so the offer must be made on another goroutine.
+			go peer.onNegotiationNeeded()
+		}
+	})
+
 	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		log.Printf("Received track from peer %s: %s", peer.peerID, track.ID())
 		peer.mu.Lock()
 		peer.remoteTracks = append(peer.remoteTracks, track)
 		peer.mu.Unlock()
 
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			if err := peer.RequestKeyFrame(track); err != nil {
+				log.Printf("Failed to request key frame from peer %s: %v", peer.peerID, err)
+			}
+		}
+
 		if peer.onTrack != nil {
 			peer.onTrack(track, receiver)
 		}
@@ -94,6 +191,45 @@ func NewPeerConnection(config PeerConnectionConfig) (*PeerConnection, error) {
 		log.Printf("Peer %s ICE connection state: %s", peer.peerID, state.String())
 	})
 
+	negotiated, id := true, uint16(chatChannelID)
+	chat, err := pc.CreateDataChannel("chat", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id})
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to create chat channel: %w", err)
+	}
+	chat.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if peer.onChat != nil {
+			peer.onChat(msg.Data)
+		}
+	})
+	peer.chat = chat
+
+	filesID := uint16(filesChannelID)
+	files, err := pc.CreateDataChannel("files", &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &filesID})
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to create file channel: %w", err)
+	}
+	files.SetBufferedAmountLowThreshold(fileBufferedLow)
+	files.OnBufferedAmountLow(func() {
+		// Wake every waiting sender.
+		peer.filesMu.Lock()
+		close(peer.filesLow)
+		peer.filesLow = make(chan struct{})
+		peer.filesMu.Unlock()
+	})
+	files.OnOpen(func() {
+		if peer.onFilesOpen != nil {
+			peer.onFilesOpen()
+		}
+	})
+	files.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if peer.onFileMessage != nil {
+			peer.onFileMessage(msg.Data, !msg.IsString)
+		}
+	})
+	peer.files = files
+
 	return peer, nil
 }
 
@@ -114,13 +250,85 @@ func (p *PeerConnection) AddTrack(track *webrtc.TrackLocalStaticSample) error {
 
 	p.mu.Lock()
 	p.localTracks = append(p.localTracks, track)
+	p.senders[track] = sender
 	p.mu.Unlock()
 
 	log.Printf("Added track to peer %s: %s", p.peerID, track.ID())
 	return nil
 }
 
+// RemoveTrack stops sending track to the peer. This always needs a new
+// offer, which OnNegotiationNeeded takes care of.
+func (p *PeerConnection) RemoveTrack(track *webrtc.TrackLocalStaticSample) error {
+	p.mu.Lock()
+	sender, exists := p.senders[track]
+	if exists {
+		delete(p.senders, track)
+		p.localTracks = removeTrack(p.localTracks, track)
+	}
+	p.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("track %s not sent to peer %s", track.ID(), p.peerID)
+	}
+
+	if err := p.pc.RemoveTrack(sender); err != nil {
+		return fmt.Errorf("failed to remove track: %w", err)
+	}
+
+	log.Printf("Removed track from peer %s: %s", p.peerID, track.ID())
+	return nil
+}
+
+// ReplaceTrack swaps oldTrack for newTrack on the existing sender, so no
+// renegotiation is needed. If the sender cannot take the new track (for
+// example because its codec was never negotiated), it falls back to a
+// remove and add, which renegotiates.
+func (p *PeerConnection) ReplaceTrack(oldTrack, newTrack *webrtc.TrackLocalStaticSample) error {
+	p.mu.Lock()
+	sender, exists := p.senders[oldTrack]
+	p.mu.Unlock()
+
+	if !exists {
+		return p.AddTrack(newTrack)
+	}
+
+	if err := sender.ReplaceTrack(newTrack); err != nil {
+		log.Printf("Cannot replace track on peer %s in place, renegotiating: %v", p.peerID, err)
+		if err := p.RemoveTrack(oldTrack); err != nil {
+			return err
+		}
+		return p.AddTrack(newTrack)
+	}
+
+	p.mu.Lock()
+	delete(p.senders, oldTrack)
+	p.senders[newTrack] = sender
+	for i, track := range p.localTracks {
+		if track == oldTrack {
+			p.localTracks[i] = newTrack
+		}
+	}
+	p.mu.Unlock()
+
+	log.Printf("Replaced track on peer %s: %s -> %s", p.peerID, oldTrack.ID(), newTrack.ID())
+	return nil
+}
+
+func removeTrack(tracks []*webrtc.TrackLocalStaticSample, track *webrtc.TrackLocalStaticSample) []*webrtc.TrackLocalStaticSample {
+	result := tracks[:0]
+	for _, t := range tracks {
+		if t != track {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
 func (p *PeerConnection) CreateOffer() (webrtc.SessionDescription, error) {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
 	offer, err := p.pc.CreateOffer(nil)
 	if err != nil {
 		return webrtc.SessionDescription{}, fmt.Errorf("failed to create offer: %w", err)
@@ -134,6 +342,13 @@ func (p *PeerConnection) CreateOffer() (webrtc.SessionDescription, error) {
 }
 
 func (p *PeerConnection) CreateAnswer() (webrtc.SessionDescription, error) {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
+	return p.createAnswer()
+}
+
+func (p *PeerConnection) createAnswer() (webrtc.SessionDescription, error) {
 	answer, err := p.pc.CreateAnswer(nil)
 	if err != nil {
 		return webrtc.SessionDescription{}, fmt.Errorf("failed to create answer: %w", err)
@@ -147,24 +362,169 @@ func (p *PeerConnection) CreateAnswer() (webrtc.SessionDescription, error) {
 }
 
 func (p *PeerConnection) SetRemoteDescription(sdp webrtc.SessionDescription) error {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
 	if err := p.pc.SetRemoteDescription(sdp); err != nil {
 		return fmt.Errorf("failed to set remote description: %w", err)
 	}
+	p.flushPendingCandidates()
 	return nil
 }
 
+// HandleRemoteDescription applies an offer or answer from the remote peer
+// using the perfect negotiation pattern. When both sides offer at once, the
+// impolite peer ignores the incoming offer and the polite peer rolls back its
+// own. The returned answer is non-nil only when an offer was accepted and
+// must be sent back.
+func (p *PeerConnection) HandleRemoteDescription(sdp webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
+	p.mu.Lock()
+	readyForOffer := p.pc.SignalingState() == webrtc.SignalingStateStable || p.isSettingRemoteAnswerPending
+	offerCollision := sdp.Type == webrtc.SDPTypeOffer && !readyForOffer
+	p.ignoreOffer = !p.polite && offerCollision
+	ignoreOffer := p.ignoreOffer
+	p.mu.Unlock()
+
+	if ignoreOffer {
+		log.Printf("Ignoring colliding offer from peer %s (impolite)", p.peerID)
+		return nil, nil
+	}
+
+	if offerCollision {
+		log.Printf("Rolling back local offer to peer %s (polite)", p.peerID)
+		// pion rejects a rollback without SDP, though it ignores what it is.
+		rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}
+		if pending := p.pc.PendingLocalDescription(); pending != nil {
+			rollback.SDP = pending.SDP
+		}
+		if err := p.pc.SetLocalDescription(rollback); err != nil {
+			return nil, fmt.Errorf("failed to roll back local description: %w", err)
+		}
+	}
+
+	p.mu.Lock()
+	p.isSettingRemoteAnswerPending = sdp.Type == webrtc.SDPTypeAnswer
+	p.mu.Unlock()
+
+	err := p.pc.SetRemoteDescription(sdp)
+
+	p.mu.Lock()
+	p.isSettingRemoteAnswerPending = false
+	p.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	p.flushPendingCandidates()
+
+	if sdp.Type != webrtc.SDPTypeOffer {
+		return nil, nil
+	}
+
+	answer, err := p.createAnswer()
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+func (p *PeerConnection) IsPolite() bool {
+	return p.polite
+}
+
+// AddICECandidate applies candidate, or queues it if no remote description
+// has been set yet. Queued candidates are applied by flushPendingCandidates.
 func (p *PeerConnection) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	p.negotiationMu.Lock()
+	defer p.negotiationMu.Unlock()
+
+	if p.pc.RemoteDescription() == nil {
+		p.queueCandidate(candidate)
+		return nil
+	}
+
+	return p.addICECandidate(candidate)
+}
+
+func (p *PeerConnection) addICECandidate(candidate webrtc.ICECandidateInit) error {
 	if err := p.pc.AddICECandidate(candidate); err != nil {
+		p.mu.RLock()
+		ignoreOffer := p.ignoreOffer
+		p.mu.RUnlock()
+
+		// Candidates for an offer we ignored are expected to fail.
+		if ignoreOffer {
+			return nil
+		}
+		p.candidateStats.dropped.Add(1)
 		return fmt.Errorf("failed to add ICE candidate: %w", err)
 	}
 	return nil
 }
 
+func (p *PeerConnection) queueCandidate(candidate webrtc.ICECandidateInit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pendingCandidates) >= maxPendingCandidates {
+		p.candidateStats.dropped.Add(1)
+		log.Printf("Dropping ICE candidate from peer %s: pending queue full", p.peerID)
+		return
+	}
+
+	p.pendingCandidates = append(p.pendingCandidates, candidate)
+	p.candidateStats.buffered.Add(1)
+}
+
+// flushPendingCandidates must be called with negotiationMu held, right after
+// a remote description has been set.
+func (p *PeerConnection) flushPendingCandidates() {
+	p.mu.Lock()
+	pending := p.pendingCandidates
+	p.pendingCandidates = nil
+	p.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	log.Printf("Applying %d buffered ICE candidates for peer %s", len(pending), p.peerID)
+	for _, candidate := range pending {
+		if err := p.addICECandidate(candidate); err != nil {
+			log.Printf("Failed to add buffered ICE candidate: %v", err)
+			continue
+		}
+		p.candidateStats.flushed.Add(1)
+	}
+}
+
+func (p *PeerConnection) PendingCandidateCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.pendingCandidates)
+}
+
+// RequestKeyFrame sends a PLI so the remote encoder emits a key frame and a
+// freshly attached decoder can start without waiting for the next one.
+func (p *PeerConnection) RequestKeyFrame(track *webrtc.TrackRemote) error {
+	return p.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+	})
+}
+
 func (p *PeerConnection) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	p.connected = false
+	p.candidateStats.dropped.Add(uint64(len(p.pendingCandidates)))
+	p.pendingCandidates = nil
 
 	if p.pc != nil {
 		return p.pc.Close()
@@ -172,6 +532,68 @@ func (p *PeerConnection) Close() error {
 	return nil
 }
 
+// SendChat sends data on the chat data channel, which is ordered and
+// reliable. It fails if the channel is not open yet.
+func (p *PeerConnection) SendChat(data []byte) error {
+	if p.chat.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("chat channel to %s is not open", p.peerID)
+	}
+	if err := p.chat.Send(data); err != nil {
+		return fmt.Errorf("failed to send chat: %w", err)
+	}
+	return nil
+}
+
+// SendFileChunk sends a binary message on the file transfer channel. While
+// more than maxFileBuffered bytes are queued it first waits for the queue
+// to drain, so a large file is never read into memory ahead of the
+// network. It gives up if stop is closed, the connection closes or the
+// queue stalls.
+func (p *PeerConnection) SendFileChunk(data []byte, stop <-chan struct{}) error {
+	if p.files.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("file channel to %s is not open", p.peerID)
+	}
+
+	for {
+		// Take the channel before checking, so a drain in between still
+		// wakes us.
+		p.filesMu.Lock()
+		low := p.filesLow
+		p.filesMu.Unlock()
+		if p.files.BufferedAmount() <= maxFileBuffered {
+			break
+		}
+
+		select {
+		case <-low:
+		case <-stop:
+			return errTransferStopped
+		case <-p.closed:
+			return errFilesClosed
+		case <-time.After(fileSendTimeout):
+			return fmt.Errorf("file channel to %s stalled", p.peerID)
+		}
+	}
+
+	if err := p.files.Send(data); err != nil {
+		return fmt.Errorf("failed to send file chunk: %w", err)
+	}
+	return nil
+}
+
+// SendFileControl sends a control message on the file transfer channel.
+// Control messages are small and skip the queue limit, so a cancel is never
+// stuck behind chunks.
+func (p *PeerConnection) SendFileControl(data []byte) error {
+	if p.files.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("file channel to %s is not open", p.peerID)
+	}
+	if err := p.files.SendText(string(data)); err != nil {
+		return fmt.Errorf("failed to send file message: %w", err)
+	}
+	return nil
+}
+
 func (p *PeerConnection) IsConnected() bool {
 	p.mu.RLock()
 	defer p.mu.RUnlock()